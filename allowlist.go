@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// recipeAllowlist are the recipes autopkgd may run. An entry is a recipe
+// name or identifier, a pattern such as com.github.autopkg.*, or a prefix
+// ending in a dot such as local.munki. An empty allowlist allows
+// everything.
+type recipeAllowlist []string
+
+func (a recipeAllowlist) allows(recipe string) bool {
+	if len(a) == 0 {
+		return true
+	}
+	for _, entry := range a {
+		if entry == recipe || (strings.HasSuffix(entry, ".") && strings.HasPrefix(recipe, entry)) {
+			return true
+		}
+		if ok, _ := path.Match(entry, recipe); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (a recipeAllowlist) validate() error {
+	for _, entry := range a {
+		if _, err := path.Match(entry, ""); err != nil || entry == "" {
+			return fmt.Errorf("recipe_allowlist: invalid entry %q", entry)
+		}
+	}
+	return nil
+}
+
+// refuseRecipes alerts on the recipes of a cycle which were refused because
+// they aren't in the allowlist. The alert is only posted again when other
+// recipes are refused. It is only called by the run loop.
+func (d *daemon) refuseRecipes(refused []string) {
+	sort.Strings(refused)
+	list := strings.Join(refused, ", ")
+	if len(refused) == 0 || list == d.refused {
+		return
+	}
+	d.refused = list
+	msg := fmt.Sprintf(":no_entry: Refusing to run recipes which are not in the recipe allowlist: %s", list)
+	log.Println(msg)
+	if d.slack {
+		if err := postSlack(d.conf.Slack, msg); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiConfig configures the embedded HTTP API. The API is disabled unless
+// Listen is set.
+type apiConfig struct {
+	Listen string `toml:"listen"`
+	// URL is where the API is reached from outside, e.g.
+	// https://autopkgd.example.com:8080, for links in notifications.
+	URL string `toml:"url"`
+
+	// Tokens and Clients enable authentication. Without either, the API is
+	// open to anyone who can reach it.
+	Tokens  []apiToken  `toml:"tokens"`
+	Clients []apiClient `toml:"clients"`
+
+	// CertFile and KeyFile serve the API over TLS.
+	CertFile     string `toml:"cert_file"`
+	KeyFile      string `toml:"key_file"`
+	ClientCAFile string `toml:"client_ca_file"`
+	// ACME serves the API over TLS with certificates from an ACME CA
+	// instead of CertFile and KeyFile.
+	ACME acmeConfig `toml:"acme"`
+}
+
+func serveAPI(conf apiConfig, d *daemon) error {
+	return listenAndServe(conf, newAPIHandler(d, true))
+}
+
+// newAPIHandler returns the API routes. Without auth, every request is
+// trusted, which is only used for the control socket.
+func newAPIHandler(d *daemon, auth bool) http.Handler {
+	protect := func(h http.HandlerFunc) http.Handler {
+		if !auth {
+			return trusted(controlSocketPrincipal, h)
+		}
+		return requireAuth(d.conf.API, h)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/cycle", protect(d.handleCycle))
+	mux.Handle("/status", protect(d.handleStatus))
+	mux.Handle("/recipes", protect(d.handleRecipes))
+	mux.Handle("/recipes/", protect(d.handleRecipe))
+	mux.Handle("/reports", protect(d.handleReports))
+	mux.Handle("/progress", protect(d.handleProgress))
+	mux.Handle("/queue", protect(d.handleQueue))
+	mux.Handle("/pause", protect(d.handlePause))
+	mux.Handle("/resume", protect(d.handlePause))
+	mux.Handle("/settings", protect(d.handleSettings))
+	mux.Handle("/feed.atom", protect(d.handleFeed))
+	mux.Handle("/circuits", protect(d.handleCircuits))
+	mux.Handle("/held", protect(d.handleHeld))
+	mux.Handle("/held/", protect(d.handleHeld))
+	// webhooks authenticate with their own shared secret.
+	mux.HandleFunc("/webhook", d.handleWebhook)
+	mux.HandleFunc("/slack/actions", d.handleSlackActions)
+	// probes for load balancers and orchestrators reveal no data.
+	mux.HandleFunc("/healthz", d.handleHealthz)
+	mux.HandleFunc("/readyz", d.handleReadyz)
+	// the dashboard assets hold no data, the API calls they make are protected.
+	mux.Handle("/ui/", dashboardHandler())
+	// munki serves the icons to every client anyway.
+	mux.Handle("/icons/", http.StripPrefix("/icons/", http.FileServer(http.Dir(filepath.Join(d.conf.MunkiRepoPath, "icons")))))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		http.Redirect(w, r, "/ui/", http.StatusFound)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if len(outputLabels) > 0 {
+		w.Header().Set("X-Autopkgd-Labels", outputLabels.String())
+	}
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+// handleCycle queues a full cycle over the recipe list.
+func (d *daemon) handleCycle(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	if !d.enqueue(nil, requestPrincipal(r).Name, false) {
+		writeError(w, http.StatusServiceUnavailable, "too many runs queued")
+		return
+	}
+	log.Printf("full cycle queued by %s", requestPrincipal(r).Name)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+}
+
+// handlePause pauses scheduled cycles on POST /pause and resumes them on
+// POST /resume. Explicitly queued runs still run while paused.
+func (d *daemon) handlePause(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	paused := r.URL.Path == "/pause"
+	d.setPaused(paused)
+	log.Printf("scheduled cycles paused=%v by %s", paused, requestPrincipal(r).Name)
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": paused})
+}
+
+// handleSettings returns the runtime settings on GET and changes them on
+// POST, from a JSON settingsUpdate.
+func (d *daemon) handleSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var u settingsUpdate
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid settings: "+err.Error())
+			return
+		}
+		if err := u.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		d.updateSettings(u)
+		log.Printf("settings changed by %s: %+v", requestPrincipal(r).Name, d.settings())
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, d.settings())
+}
+
+// handleStatus returns the summary of the last cycle.
+func (d *daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	d.mu.Lock()
+	status := d.lastCycle
+	d.mu.Unlock()
+	writeJSON(w, http.StatusOK, status)
+}
+
+type recipeStatus struct {
+	Recipe  string     `json:"recipe"`
+	Enabled bool       `json:"enabled"`
+	LastRun *runRecord `json:"last_run"`
+	// LastSuccess and LastFailure are when the recipe last succeeded and
+	// failed.
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	// Stale is set when the recipe hasn't succeeded within the
+	// stale_recipes window.
+	Stale bool `json:"stale,omitempty"`
+}
+
+// handleRecipes lists the recipes in the recipe list with their last run on
+// GET, and adds a recipe on POST.
+func (d *daemon) handleRecipes(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		d.handleAddRecipe(w, r)
+		return
+	}
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	recipes, err := readRecipes(d.conf.RecipesFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	disabled, err := readDisabledRecipes(d.conf.RecipesFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	list := make([]recipeStatus, 0, len(recipes)+len(disabled))
+	now := time.Now()
+	d.mu.Lock()
+	for i, recipe := range append(recipes, disabled...) {
+		status := recipeStatus{Recipe: recipe, Enabled: i < len(recipes)}
+		if rec, ok := d.last[recipe]; ok {
+			status.LastRun = &rec
+		}
+		if t, ok := d.lastSuccess[recipe]; ok {
+			status.LastSuccess = &t
+		}
+		if t, ok := d.lastFailure[recipe]; ok {
+			status.LastFailure = &t
+		}
+		if status.Enabled {
+			_, status.Stale = d.staleSince(recipe, now)
+		}
+		list = append(list, status)
+	}
+	d.mu.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleAddRecipe appends the recipe in the JSON body to the recipe list.
+func (d *daemon) handleAddRecipe(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Recipe string `json:"recipe"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if !d.conf.RecipeAllowlist.allows(body.Recipe) {
+		writeError(w, http.StatusForbidden, "recipe "+body.Recipe+" is not in the recipe allowlist")
+		return
+	}
+	d.changeRecipes(w, r, "add", body.Recipe, func() error {
+		return addRecipe(d.conf.RecipesFile, body.Recipe)
+	})
+}
+
+// handleEditRecipe removes a recipe on DELETE /recipes/{name} and enables or
+// disables it on POST /recipes/{name}/enable and /disable.
+func (d *daemon) handleEditRecipe(w http.ResponseWriter, r *http.Request, name, action string) {
+	method := "POST"
+	if action == "remove" {
+		method = "DELETE"
+	}
+	if !requireMethod(w, r, method) {
+		return
+	}
+	d.changeRecipes(w, r, action, name, func() error {
+		if action == "remove" {
+			return removeRecipe(d.conf.RecipesFile, name)
+		}
+		return setRecipeEnabled(d.conf.RecipesFile, name, action == "enable")
+	})
+}
+
+// changeRecipes applies a change to the recipe list and records it in the
+// audit log.
+func (d *daemon) changeRecipes(w http.ResponseWriter, r *http.Request, action, name string, change func() error) {
+	switch err := change(); err {
+	case nil:
+	case errInvalidRecipe:
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	case errRecipeExists:
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case errRecipeNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	actor := requestPrincipal(r).Name
+	log.Printf("recipe %s: %s by %s", action, name, actor)
+	if d.conf.AuditLog != "" {
+		ev := auditEvent{Actor: actor, Action: "recipe." + action, Recipe: name}
+		if err := appendAudit(d.conf.AuditLog, ev); err != nil {
+			log.Println(err)
+		}
+	}
+	status := action + "ed"
+	if strings.HasSuffix(action, "e") {
+		status = action + "d"
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": status, "recipe": name})
+}
+
+// handleRecipe handles the /recipes/{name} endpoints: running, editing and
+// the logs, report and history of a recipe.
+func (d *daemon) handleRecipe(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/recipes/")
+	if path != "" && !strings.Contains(path, "/") {
+		d.handleEditRecipe(w, r, path, "remove")
+		return
+	}
+	i := strings.LastIndex(path, "/")
+	if i < 1 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	name := path[:i]
+	switch action := path[i+1:]; action {
+	case "enable", "disable":
+		d.handleEditRecipe(w, r, name, action)
+	case "run":
+		d.handleRunRecipe(w, r, name)
+	case "cancel":
+		d.handleCancelRecipe(w, r, name)
+	case "reset":
+		d.handleResetRecipe(w, r, name)
+	case "logs":
+		if requireMethod(w, r, "GET") {
+			d.logs.serveLogStream(w, r, name)
+		}
+	case "report":
+		d.handleRecipeReport(w, r, name)
+	case "history":
+		d.handleRecipeHistory(w, r, name)
+	case "trust-diff":
+		d.handleTrustDiff(w, r, name)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleRunRecipe queues a single recipe, which needn't be in the recipe
+// list but must be allowed by the recipe allowlist. With ?check=true it runs
+// with --check.
+func (d *daemon) handleRunRecipe(w http.ResponseWriter, r *http.Request, name string) {
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+
+	if !d.conf.RecipeAllowlist.allows(name) {
+		writeError(w, http.StatusForbidden, "recipe "+name+" is not in the recipe allowlist")
+		return
+	}
+	if d.isRecipePaused(name) {
+		writeError(w, http.StatusConflict, "recipe "+name+" is paused")
+		return
+	}
+	check := r.URL.Query().Get("check") == "true"
+	if !d.enqueue([]string{name}, requestPrincipal(r).Name, check) {
+		writeError(w, http.StatusServiceUnavailable, "too many runs queued")
+		return
+	}
+	log.Printf("%s queued by %s", name, requestPrincipal(r).Name)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued", "recipe": name})
+}
+
+// handleCancelRecipe terminates a running recipe.
+func (d *daemon) handleCancelRecipe(w http.ResponseWriter, r *http.Request, name string) {
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	if !d.cancelRecipe(name) {
+		writeError(w, http.StatusNotFound, "recipe "+name+" is not running")
+		return
+	}
+	log.Printf("%s cancelled by %s", name, requestPrincipal(r).Name)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "cancelled", "recipe": name})
+}
+
+// handleCircuits lists the recipes whose circuit is open.
+func (d *daemon) handleCircuits(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	writeJSON(w, http.StatusOK, d.breaker.open())
+}
+
+// handleResetRecipe closes the circuit of a recipe, so it runs again.
+func (d *daemon) handleResetRecipe(w http.ResponseWriter, r *http.Request, name string) {
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	if !d.breaker.reset(name) {
+		writeError(w, http.StatusNotFound, "the circuit of "+name+" is not open")
+		return
+	}
+	log.Printf("circuit of %s reset by %s", name, requestPrincipal(r).Name)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reset", "recipe": name})
+}
+
+// handleRecipeReport returns the most recent report of a recipe, both the
+// run record and the parsed report plist.
+func (d *daemon) handleRecipeReport(w http.ResponseWriter, r *http.Request, name string) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	d.mu.Lock()
+	rec, ok := d.last[name]
+	d.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no report for "+name)
+		return
+	}
+	resp := struct {
+		Record runRecord      `json:"record"`
+		Report *autopkgReport `json:"report"`
+	}{Record: rec}
+	if report, err := readReportPlist(d.conf.lastReportFile(name, &rec)); err == nil {
+		resp.Report = &report
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleRecipeHistory returns the run records of a recipe, newest first,
+// paginated with the offset and limit query parameters.
+func (d *daemon) handleRecipeHistory(w http.ResponseWriter, r *http.Request, name string) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	offset, limit, err := pagination(r, 50)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var records []runRecord
+	if d.conf.HistoryFile != "" {
+		if records, err = readHistory(d.conf.HistoryFile, time.Time{}); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else {
+		d.mu.Lock()
+		records = append(records, d.recent...)
+		d.mu.Unlock()
+	}
+
+	var matching []runRecord
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Recipe == name {
+			matching = append(matching, records[i])
+		}
+	}
+	page := []runRecord{}
+	if offset < len(matching) {
+		end := offset + limit
+		if end > len(matching) {
+			end = len(matching)
+		}
+		page = matching[offset:end]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total":   len(matching),
+		"offset":  offset,
+		"limit":   limit,
+		"records": page,
+	})
+}
+
+// pagination parses the offset and limit query parameters.
+func pagination(r *http.Request, defaultLimit int) (offset, limit int, err error) {
+	limit = defaultLimit
+	q := r.URL.Query()
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			return 0, 0, errors.New("invalid limit")
+		}
+	}
+	if s := q.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+	return offset, limit, nil
+}
+
+// handleReports returns the most recent run records, newest first. The
+// number of records is set with the limit query parameter.
+func (d *daemon) handleReports(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	_, limit, err := pagination(r, 50)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	d.mu.Lock()
+	reports := make([]runRecord, 0, limit)
+	for i := len(d.recent) - 1; i >= 0 && len(reports) < limit; i-- {
+		reports = append(reports, d.recent[i])
+	}
+	d.mu.Unlock()
+	writeJSON(w, http.StatusOK, reports)
+}
+
+// handleProgress returns the progress of the running cycle.
+func (d *daemon) handleProgress(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	d.mu.Lock()
+	progress := d.progress
+	active := make(map[string]time.Time, len(progress.Active))
+	for recipe, start := range progress.Active {
+		active[recipe] = start
+	}
+	progress.Active = active
+	progress.Queued = append([]string{}, progress.Queued...)
+	skipped := make(map[string]string, len(progress.Skipped))
+	for recipe, reason := range progress.Skipped {
+		skipped[recipe] = reason
+	}
+	progress.Skipped = skipped
+	d.mu.Unlock()
+	writeJSON(w, http.StatusOK, progress)
+}
+
+type activeRun struct {
+	Recipe  string    `json:"recipe"`
+	Start   time.Time `json:"start"`
+	Seconds float64   `json:"seconds"`
+	// Expected is how long the last successful run took, if there was one.
+	Expected float64 `json:"expected_seconds,omitempty"`
+}
+
+type queueStatus struct {
+	Workers int          `json:"workers"`
+	Running []activeRun  `json:"running"`
+	Queued  []string     `json:"queued"`
+	Skipped []skippedRun `json:"skipped"`
+	// Pending are the cycles waiting for the current one to finish. A null
+	// entry is a full cycle.
+	Pending   [][]string `json:"pending"`
+	CheckOnly bool       `json:"check_only"`
+	// Paused is set when scheduled cycles are paused.
+	Paused bool `json:"paused"`
+}
+
+type skippedRun struct {
+	Recipe string `json:"recipe"`
+	Reason string `json:"reason"`
+}
+
+// handleQueue returns the state of the worker pool: running recipes and for
+// how long, recipes waiting for a worker, skipped recipes and queued cycles.
+func (d *daemon) handleQueue(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	now := time.Now()
+	d.mu.Lock()
+	q := queueStatus{
+		Workers: d.workers.size(),
+		Running: []activeRun{},
+		Queued:  []string{},
+		Skipped: []skippedRun{},
+		Pending: [][]string{},
+		Paused:  d.paused,
+	}
+	for _, c := range d.pending {
+		q.Pending = append(q.Pending, c.recipes)
+	}
+	if d.progress.Running {
+		q.Queued = append(q.Queued, d.progress.Queued...)
+		q.CheckOnly = d.progress.CheckOnly
+		for recipe, start := range d.progress.Active {
+			run := activeRun{Recipe: recipe, Start: start, Seconds: now.Sub(start).Seconds()}
+			if last, ok := d.last[recipe]; ok && len(last.Failures) == 0 {
+				run.Expected = last.Duration.Seconds()
+			}
+			q.Running = append(q.Running, run)
+		}
+	}
+	for recipe, reason := range d.progress.Skipped {
+		q.Skipped = append(q.Skipped, skippedRun{Recipe: recipe, Reason: reason})
+	}
+	d.mu.Unlock()
+	sort.Slice(q.Running, func(i, j int) bool { return q.Running[i].Start.Before(q.Running[j].Start) })
+	sort.Slice(q.Skipped, func(i, j int) bool { return q.Skipped[i].Recipe < q.Skipped[j].Recipe })
+	writeJSON(w, http.StatusOK, q)
+}
+
+func removeString(list []string, s string) []string {
+	for i, item := range list {
+		if item == s {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
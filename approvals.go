@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// approval is a gated action waiting for someone to approve or reject it
+// with the buttons of a slack message.
+type approval struct {
+	ID      string
+	Kind    string
+	Subject string
+	Text    string
+	Created time.Time
+	// run is passed a context whose commands are recorded as run for
+	// whoever approved the action.
+	run func(ctx context.Context) error
+	// rejected, if set, runs when the action is rejected.
+	rejected func() error
+}
+
+// approvalStore holds the pending approvals.
+type approvalStore struct {
+	mu      sync.Mutex
+	pending map[string]*approval
+}
+
+func newApprovalStore() *approvalStore {
+	return &approvalStore{pending: make(map[string]*approval)}
+}
+
+// add stores a, unless an approval of the same kind and subject is already
+// pending. It reports whether a was added.
+func (s *approvalStore) add(a *approval) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, p := range s.pending {
+		if time.Since(p.Created) > approvalTTL {
+			delete(s.pending, id)
+			continue
+		}
+		if p.Kind == a.Kind && p.Subject == a.Subject {
+			return false
+		}
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	a.ID = hex.EncodeToString(b)
+	a.Created = time.Now()
+	s.pending[a.ID] = a
+	return true
+}
+
+// approvalTTL is how long an approval request stays valid.
+const approvalTTL = 24 * time.Hour
+
+// take removes and returns the pending approval with id, unless it expired.
+func (s *approvalStore) take(id string) (*approval, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.pending[id]
+	delete(s.pending, id)
+	if ok && time.Since(a.Created) > approvalTTL {
+		return nil, false
+	}
+	return a, ok
+}
+
+// approvalsEnabled reports whether approvals are posted to slack, which
+// needs -slack and the signing secret to verify the button presses.
+func (d *daemon) approvalsEnabled() bool {
+	return d.slack && d.conf.Slack.SigningSecret != ""
+}
+
+// requestApproval posts a with approve and reject buttons. Slack calls back
+// the /slack/actions endpoint when a button is pressed. Without approvals it
+// does nothing.
+func (d *daemon) requestApproval(a *approval) {
+	if !d.approvalsEnabled() {
+		return
+	}
+	if !d.approvals.add(a) {
+		return
+	}
+	button := func(text, style, action string) map[string]interface{} {
+		return map[string]interface{}{
+			"type":      "button",
+			"text":      map[string]string{"type": "plain_text", "text": text},
+			"style":     style,
+			"action_id": action,
+			"value":     a.ID,
+		}
+	}
+	msg := slackMsg{
+		Channel:  d.conf.Slack.Channel,
+		Username: d.conf.Slack.Username,
+		Text:     a.Text,
+		IconURL:  d.conf.Slack.IconURL,
+		Blocks: []map[string]interface{}{
+			{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": a.Text}},
+			{"type": "actions", "elements": []interface{}{
+				button("Approve", "primary", "approve"),
+				button("Reject", "danger", "reject"),
+			}},
+		},
+	}
+	if err := msg.Post(d.conf.Slack.WebhookURL); err != nil {
+		log.Println(err)
+	}
+}
+
+// requestTrustUpdate asks for approval to run autopkg update-trust-info for
+// a recipe which failed trust verification, showing the diff.
+func (d *daemon) requestTrustUpdate(recipe, message, diff string) {
+	text := fmt.Sprintf("*%s* failed trust verification: %s", recipe, message)
+	if diff != "" {
+		text += "\n" + diff
+	}
+	d.requestApproval(&approval{
+		Kind:    "update_trust_info",
+		Subject: recipe,
+		Text:    text + "\nUpdate its trust info?",
+		run: func(ctx context.Context) error {
+			ctx, cancel := withExecTimeout(ctx, time.Second*d.conf.ExecTimeout)
+			defer cancel()
+			output := func(b []byte) { log.Println(string(b)) }
+			name, args := d.conf.runnerFor(recipe).autopkg("update-trust-info", recipe)
+			return runCommand(ctx, output, name, args...)
+		},
+	})
+}
+
+// trustFailurePhrases are in the messages autopkg fails a recipe with when
+// its parent recipes don't match their trust info, e.g. "Failed local trust
+// verification" and "Recipe has no trust info". Just "trust" would also match
+// download errors such as "untrusted certificate".
+var trustFailurePhrases = []string{"trust verification", "trust info", "parentrecipetrustinfo"}
+
+// isTrustFailure reports whether f is a trust verification failure.
+func isTrustFailure(f failure) bool {
+	msg := strings.ToLower(f.Message)
+	for _, phrase := range trustFailurePhrases {
+		if strings.Contains(msg, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySlackSignature checks the signature slack adds to callback requests.
+func verifySlackSignature(secret string, r *http.Request, body []byte) bool {
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > 5*time.Minute || age < -5*time.Minute {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(r.Header.Get("X-Slack-Signature")), []byte(expected))
+}
+
+type slackActionPayload struct {
+	Type string `json:"type"`
+	User struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+	Actions []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+	ResponseURL string `json:"response_url"`
+}
+
+// handleSlackActions receives button presses on approval messages.
+func (d *daemon) handleSlackActions(w http.ResponseWriter, r *http.Request) {
+	secret := d.conf.Slack.SigningSecret
+	if secret == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !verifySlackSignature(secret, r, body) {
+		writeError(w, http.StatusUnauthorized, "invalid signature")
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var payload slackActionPayload
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// slack expects an acknowledgement within three seconds, so the action
+	// runs in the background and the message is updated when it is done.
+	w.WriteHeader(http.StatusOK)
+	if payload.Type != "block_actions" || len(payload.Actions) == 0 {
+		return
+	}
+	action := payload.Actions[0]
+	user := payload.User.Username
+	go func() {
+		a, ok := d.approvals.take(action.Value)
+		if !ok {
+			respondSlack(payload.ResponseURL, "This request was already handled or has expired.")
+			return
+		}
+		if action.ActionID != "approve" {
+			log.Printf("%s rejected %s of %s", user, a.Kind, a.Subject)
+			result := fmt.Sprintf("%s\n_Rejected by %s_", a.Text, user)
+			if a.rejected != nil {
+				if err := a.rejected(); err != nil {
+					log.Println(err)
+					result += "\nFailed: " + err.Error()
+				}
+			}
+			respondSlack(payload.ResponseURL, result)
+			return
+		}
+		log.Printf("%s approved %s of %s", user, a.Kind, a.Subject)
+		result := fmt.Sprintf("%s\n_Approved by %s_", a.Text, user)
+		if err := a.run(withActor(d.ctx, "slack:"+user)); err != nil {
+			log.Println(err)
+			result += "\nFailed: " + err.Error()
+		}
+		respondSlack(payload.ResponseURL, result)
+	}()
+}
+
+// respondSlack replaces an interactive message with text.
+func respondSlack(responseURL, text string) {
+	b, err := json.Marshal(map[string]interface{}{"replace_original": true, "text": text})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	resp, err := http.Post(responseURL, "application/json", strings.NewReader(string(b)))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	resp.Body.Close()
+}
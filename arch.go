@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"sort"
+)
+
+// recipeArchitectures are the recipes which must run on a given
+// architecture, arm64 or x86_64, because they build arch-specific installers.
+// Members are recipe names or patterns.
+type recipeArchitectures map[string][]string
+
+// validate checks the architectures and the patterns of the members.
+func (a recipeArchitectures) validate() error {
+	for arch, members := range a {
+		if arch != "arm64" && arch != "x86_64" {
+			return fmt.Errorf("recipe_architectures: architecture must be arm64 or x86_64, not %q", arch)
+		}
+		for _, member := range members {
+			if _, err := path.Match(member, ""); err != nil {
+				return fmt.Errorf("recipe_architectures: %s: bad pattern %q", arch, member)
+			}
+		}
+	}
+	return nil
+}
+
+// of returns the architecture recipe must run on, empty if it may run on
+// any. When a recipe matches both, arm64 wins so the result doesn't depend
+// on map order.
+func (a recipeArchitectures) of(recipe string) string {
+	archs := make([]string, 0, len(a))
+	for arch := range a {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+	for _, arch := range archs {
+		for _, member := range a[arch] {
+			if ok, _ := path.Match(member, recipe); ok {
+				return arch
+			}
+		}
+	}
+	return ""
+}
+
+// archCommand returns the command which runs name with args as arch, through
+// arch(1), which lets a universal Mac run x86_64 code under Rosetta. Without
+// an arch it returns name and args as they are.
+func archCommand(arch, name string, args []string) (string, []string) {
+	if arch == "" {
+		return name, args
+	}
+	return "/usr/bin/arch", append([]string{"-" + arch, name}, args...)
+}
+
+// hostArch is the architecture of this Mac in the names arch(1) uses.
+func hostArch() string {
+	if runtime.GOARCH == "amd64" {
+		return "x86_64"
+	}
+	return runtime.GOARCH
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// artifact is a file which entered the cache or munki repo during a run.
+type artifact struct {
+	// Kind is download, pkg or pkginfo.
+	Kind   string `json:"kind"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// reportArtifacts hashes the downloaded installers and imported items named in
+// the report. Paths which cannot be read are skipped.
+func reportArtifacts(report autopkgReport, repoPath string) []artifact {
+	type candidate struct{ kind, path string }
+	var candidates []candidate
+	if summary, ok := report.SummaryResults["url_downloader_summary_result"]; ok {
+		for _, row := range summary.DataRows {
+			if path, ok := row["download_path"].(string); ok {
+				candidates = append(candidates, candidate{"download", path})
+			}
+		}
+	}
+	if summary, ok := report.SummaryResults["munki_importer_summary_result"]; ok {
+		for _, row := range summary.DataRows {
+			// munki importer paths are relative to the pkgs and pkgsinfo directories.
+			if path, ok := row["pkg_repo_path"].(string); ok && path != "" {
+				candidates = append(candidates, candidate{"pkg", filepath.Join(repoPath, "pkgs", path)})
+			}
+			if path, ok := row["pkginfo_path"].(string); ok && path != "" {
+				candidates = append(candidates, candidate{"pkginfo", filepath.Join(repoPath, "pkgsinfo", path)})
+			}
+		}
+	}
+
+	var artifacts []artifact
+	for _, c := range candidates {
+		sum, size, err := hashFile(c.path)
+		if err != nil {
+			continue
+		}
+		artifacts = append(artifacts, artifact{Kind: c.kind, Path: c.path, SHA256: sum, Size: size})
+	}
+	return artifacts
+}
+
+// artifactVerification configures re-hashing the installer items recorded
+// with hash_artifacts, to detect tampering or bit-rot on the repo share.
+type artifactVerification struct {
+	// Interval is how often, in seconds, the items are re-hashed. Zero
+	// disables verification.
+	Interval time.Duration `toml:"interval"`
+}
+
+// artifactMismatch is an installer item which no longer matches the hash it
+// was recorded with at import time.
+type artifactMismatch struct {
+	artifact
+	Recipe string    `json:"recipe"`
+	Start  time.Time `json:"start"`
+	// Actual are the hash and size the item has now.
+	ActualSHA256 string `json:"actual_sha256"`
+	ActualSize   int64  `json:"actual_size"`
+}
+
+func (m artifactMismatch) String() string {
+	return fmt.Sprintf("%s (imported by %s at %s): sha256 %s, size %d, expected %s, size %d",
+		m.Path, m.Recipe, m.Start.Format("2006-01-02 15:04"), m.ActualSHA256, m.ActualSize, m.SHA256, m.Size)
+}
+
+// verifyArtifacts re-hashes the installer items of the run history against
+// the hashes they were last imported with. Items which were since removed
+// from the repo are counted as missing.
+func verifyArtifacts(records []runRecord) (mismatches []artifactMismatch, checked, missing int) {
+	recorded := make(map[string]artifactMismatch)
+	var paths []string
+	for _, rec := range records {
+		for _, a := range rec.Artifacts {
+			if a.Kind != "pkg" {
+				continue
+			}
+			if _, ok := recorded[a.Path]; !ok {
+				paths = append(paths, a.Path)
+			}
+			recorded[a.Path] = artifactMismatch{artifact: a, Recipe: rec.Recipe, Start: rec.Start}
+		}
+	}
+	for _, path := range paths {
+		m := recorded[path]
+		sum, size, err := hashFile(path)
+		if os.IsNotExist(err) {
+			missing++
+			continue
+		}
+		checked++
+		if err != nil {
+			log.Printf("verifying %s: %v", path, err)
+			continue
+		}
+		if sum != m.SHA256 || size != m.Size {
+			m.ActualSHA256, m.ActualSize = sum, size
+			mismatches = append(mismatches, m)
+		}
+	}
+	return mismatches, checked, missing
+}
+
+// verifyArtifacts re-hashes the recorded installer items and alerts on the
+// ones which changed since they were imported.
+func (d *daemon) verifyArtifacts() {
+	records, err := readHistory(d.conf.HistoryFile, time.Time{})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	mismatches, checked, missing := verifyArtifacts(records)
+	log.Printf("verified %d installer items, %d changed, %d no longer in the repo", checked, len(mismatches), missing)
+	if len(mismatches) == 0 {
+		return
+	}
+	lines := []string{fmt.Sprintf(":warning: %d installer items no longer match the hashes recorded when they were imported:", len(mismatches))}
+	for _, m := range mismatches {
+		log.Println("artifact changed:", m)
+		lines = append(lines, "• "+m.String())
+	}
+	if d.slack {
+		if err := postSlack(d.conf.Slack, strings.Join(lines, "\n")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// runVerifyArtifacts implements `autopkgd verify-artifacts`, which re-hashes
+// the recorded installer items once and exits non-zero on a mismatch.
+func runVerifyArtifacts(args []string) int {
+	var (
+		flags   = flag.NewFlagSet("verify-artifacts", flag.ExitOnError)
+		fConfig = flags.String("config", "", "configuration file to load")
+		fJSON   = flags.Bool("json", false, "print the mismatches as JSON")
+	)
+	flags.Parse(args)
+
+	conf, err := loadConfig(*fConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.HistoryFile == "" || !conf.HashArtifacts {
+		fmt.Println("you must specify history_file and hash_artifacts in your config to verify artifacts")
+		return 1
+	}
+	records, err := readHistory(conf.HistoryFile, time.Time{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	mismatches, checked, missing := verifyArtifacts(records)
+	if *fJSON {
+		if mismatches == nil {
+			mismatches = []artifactMismatch{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(mismatches)
+	} else {
+		for _, m := range mismatches {
+			fmt.Println("CHANGED", m)
+		}
+		fmt.Printf("%d installer items verified, %d changed, %d no longer in the repo\n", checked, len(mismatches), missing)
+	}
+	if len(mismatches) > 0 {
+		return 1
+	}
+	return 0
+}
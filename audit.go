@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// auditEvent is an entry in the audit log, recording who changed what.
+type auditEvent struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Recipe string    `json:"recipe,omitempty"`
+	// Item is the pkginfo an action was taken on.
+	Item string `json:"item,omitempty"`
+	// Argv, End and ExitStatus describe a command autopkgd ran, Time is
+	// when it started. Error is why it failed, if it did.
+	Argv       []string   `json:"argv,omitempty"`
+	End        *time.Time `json:"end,omitempty"`
+	ExitStatus *int       `json:"exit_status,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// auditMu serializes appends to the audit log.
+var auditMu sync.Mutex
+
+// appendAudit adds an event to the JSON lines audit log at path.
+func appendAudit(path string, ev auditEvent) error {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	return appendLine(path, b, 0600)
+}
+
+// commandAuditLog is the audit log every command autopkgd runs is recorded
+// in, if one is configured. It is set once at startup from the config.
+var commandAuditLog string
+
+// Actors of the commands which aren't run on behalf of an API caller.
+const (
+	actorSchedule = "schedule"
+	actorResume   = "resume"
+	actorWebhook  = "webhook"
+	actorDaemon   = "autopkgd"
+)
+
+// cliActor is the actor of commands run from the command line: the user
+// who ran autopkgd, through sudo if they did.
+func cliActor() string {
+	name := os.Getenv("SUDO_USER")
+	if name == "" {
+		if u, err := user.Current(); err == nil {
+			name = u.Username
+		}
+	}
+	return "cli:" + name
+}
+
+type actorKey struct{}
+
+// withActor returns a context whose commands are recorded as run for actor.
+func withActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// cycleActor is who the running cycle was started by.
+var cycleActor struct {
+	sync.Mutex
+	name string
+}
+
+// setCycleActor records who started the cycle which is about to run, empty
+// once it is done.
+func setCycleActor(actor string) {
+	cycleActor.Lock()
+	cycleActor.name = actor
+	cycleActor.Unlock()
+}
+
+// actorOf returns who a command runs for: the actor of ctx, else the one
+// who started the running cycle.
+func actorOf(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+	cycleActor.Lock()
+	defer cycleActor.Unlock()
+	if cycleActor.name != "" {
+		return cycleActor.name
+	}
+	return actorDaemon
+}
+
+// sasSignature matches the signature of an Azure shared access signature
+// in a URL.
+var sasSignature = regexp.MustCompile(`([?&]sig=)[^&\s]*`)
+
+// redactArgv returns argv with the signatures of SAS URLs hidden, so the
+// audit log doesn't hold credentials.
+func redactArgv(argv []string) []string {
+	redacted := make([]string, len(argv))
+	for i, arg := range argv {
+		redacted[i] = sasSignature.ReplaceAllString(arg, "${1}REDACTED")
+	}
+	return redacted
+}
+
+// auditCommand records a command which ran from start until now, with the
+// error running it returned.
+func auditCommand(ctx context.Context, cmd *exec.Cmd, start time.Time, err error) {
+	if commandAuditLog == "" {
+		return
+	}
+	end := time.Now()
+	ev := auditEvent{Time: start, Actor: actorOf(ctx), Action: "command", Argv: redactArgv(cmd.Args), End: &end}
+	if cmd.ProcessState != nil {
+		status := cmd.ProcessState.ExitCode()
+		ev.ExitStatus = &status
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	if err := appendAudit(commandAuditLog, ev); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// API scopes. Read-only callers may use GET endpoints; trigger callers may
+// also queue runs and change state.
+const (
+	scopeRead    = "read"
+	scopeTrigger = "trigger"
+)
+
+// apiToken is a bearer token accepted by the API.
+type apiToken struct {
+	Name  string `toml:"name"`
+	Token string `toml:"token"`
+	Scope string `toml:"scope"`
+}
+
+// apiClient maps the common name of a verified TLS client certificate to a
+// scope, for mutual TLS authentication.
+type apiClient struct {
+	CommonName string `toml:"common_name"`
+	Scope      string `toml:"scope"`
+}
+
+// principal is the authenticated caller of an API request.
+type principal struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+func (p principal) allows(scope string) bool {
+	return p.Scope == scopeTrigger || p.Scope == scope
+}
+
+type principalKey struct{}
+
+// requestPrincipal returns the caller of the request. When authentication is
+// disabled the caller is anonymous with the trigger scope.
+func requestPrincipal(r *http.Request) principal {
+	if p, ok := r.Context().Value(principalKey{}).(principal); ok {
+		return p
+	}
+	return principal{Name: "anonymous", Scope: scopeTrigger}
+}
+
+func (c apiConfig) authEnabled() bool {
+	return len(c.Tokens) > 0 || len(c.Clients) > 0
+}
+
+func (c apiConfig) authenticate(r *http.Request) (principal, bool) {
+	auth := r.Header.Get("Authorization")
+	// EventSource can't set headers, so streams may pass the token as a
+	// query parameter instead.
+	if t := r.URL.Query().Get("access_token"); auth == "" && t != "" {
+		auth = "Bearer " + t
+	}
+	if strings.HasPrefix(auth, "Bearer ") {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for _, t := range c.Tokens {
+			if subtle.ConstantTimeCompare(token, []byte(t.Token)) == 1 {
+				return principal{Name: t.Name, Scope: t.Scope}, true
+			}
+		}
+		return principal{}, false
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, client := range c.Clients {
+			if client.CommonName == cn {
+				return principal{Name: cn, Scope: client.Scope}, true
+			}
+		}
+	}
+	return principal{}, false
+}
+
+// controlSocketPrincipal is the caller of requests on the control socket,
+// which is protected by file permissions instead of tokens.
+var controlSocketPrincipal = principal{Name: "control socket", Scope: scopeTrigger}
+
+// trusted serves requests as p without authentication.
+func trusted(p principal, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// requireAuth rejects requests without a valid token or client certificate,
+// and requests needing the trigger scope from read-only callers. GET and HEAD
+// requests need the read scope, everything else the trigger scope.
+func requireAuth(conf apiConfig, next http.Handler) http.Handler {
+	if !conf.authEnabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := conf.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="autopkgd"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		scope := scopeTrigger
+		if r.Method == "GET" || r.Method == "HEAD" {
+			scope = scopeRead
+		}
+		if !p.allows(scope) {
+			writeError(w, http.StatusForbidden, "the "+scope+" scope is required")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
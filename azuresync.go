@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// azureSync configures copying the munki repo to an Azure Blob Storage
+// container with azcopy, after the catalogs were rebuilt, for repos served
+// from Azure Storage or Azure CDN.
+type azureSync struct {
+	// Account and Container are the destination, with an optional Path in
+	// the container. Sync is disabled without an account.
+	Account    string `toml:"account"`
+	Container  string `toml:"container"`
+	Path       string `toml:"path"`
+	AzcopyPath string `toml:"azcopy_path"`
+	// SASToken authenticates with a shared access signature, which needs
+	// the read, write, list and, with Delete, delete permissions on the
+	// container. Without it azcopy logs in with the managed identity of the
+	// VM, or the user assigned one of IdentityClientID.
+	SASToken         string `toml:"sas_token"`
+	IdentityClientID string `toml:"identity_client_id"`
+	// syncOptions, whose Exclude are glob patterns of the file names.
+	syncOptions
+}
+
+// destination is the URL of the container and path, without the SAS token.
+func (c azureSync) destination() string {
+	u := url.URL{Scheme: "https", Host: c.Account + ".blob.core.windows.net", Path: "/" + c.Container}
+	if p := strings.Trim(c.Path, "/"); p != "" {
+		u.Path += "/" + p
+	}
+	return u.String()
+}
+
+// sync copies the files of the repo which changed to the container. azcopy
+// sync compares modification times, so only the new and changed files are
+// uploaded.
+func (c azureSync) sync(ctx context.Context, repoPath string, execTimeout time.Duration) error {
+	if c.Account == "" {
+		return nil
+	}
+	// the SAS token is only in the command line, not in the log.
+	s := syncCommand{tool: c.AzcopyPath, dest: c.destination()}
+	if s.tool == "" {
+		s.tool = "/usr/local/bin/azcopy"
+	}
+	dest := c.destination()
+	if c.SASToken != "" {
+		dest += "?" + strings.TrimPrefix(c.SASToken, "?")
+	} else {
+		s.env = append(s.env, "AZCOPY_AUTO_LOGIN_TYPE=MSI")
+		if c.IdentityClientID != "" {
+			s.env = append(s.env, "AZCOPY_MSI_CLIENT_ID="+c.IdentityClientID)
+		}
+	}
+
+	s.args = []string{"sync", strings.TrimSuffix(repoPath, "/"), dest, "--recursive", "--output-level=essential"}
+	s.args = c.flags(s.args, syncFlags{
+		delete: "--delete-destination=true",
+		exclude: func(patterns []string) []string {
+			return []string{"--exclude-pattern=" + strings.Join(patterns, ";")}
+		},
+		dryRun: "--dry-run",
+	})
+	return c.run(ctx, repoPath, execTimeout, s)
+}
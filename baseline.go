@@ -0,0 +1,31 @@
+package main
+
+import "log"
+
+// baselineConfig returns conf with the notifiers turned off, for a baseline
+// cycle. The history, status file, metrics and the catalogs are kept up to
+// date as usual, only nothing is announced.
+func baselineConfig(conf Config) Config {
+	conf.Slack.CycleSummary = false
+	conf.CodeSignature.WebhookURL = ""
+	conf.FailureAlarm = failureAlarm{}
+	conf.MunkiReport = munkiReport{}
+	conf.MDM = mdmHook{}
+	conf.Plugins = nil
+	return conf
+}
+
+// runBaseline runs the whole recipe list once without notifications, so a
+// daemon stood up against an existing repo doesn't announce everything
+// already in it as new. It returns false if the cycle was interrupted.
+func runBaseline(conf Config, check bool) bool {
+	recipes, err := readRecipes(conf.RecipesFile)
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+	log.Printf("running a baseline cycle of %d recipes without notifications", len(recipes))
+	d, _, interrupted := runOnce(baselineConfig(conf), recipes, false, check)
+	log.Println("baseline cycle finished:", d.lastCycle.summary())
+	return !interrupted
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// circuitBreakerConfig configures taking consistently failing recipes out of
+// the cycle until they are reset or their probation is over.
+type circuitBreakerConfig struct {
+	// Failures is the number of consecutive failures which open the circuit.
+	// Zero disables the circuit breaker.
+	Failures int `toml:"failures"`
+	// Probation is the number of seconds after which an open circuit lets a
+	// single run through. A success closes it, a failure keeps it open for
+	// another probation.
+	Probation time.Duration `toml:"probation"`
+}
+
+// probation defaults to a day.
+func (c circuitBreakerConfig) probation() time.Duration {
+	if c.Probation == 0 {
+		return 86400
+	}
+	return c.Probation
+}
+
+// openCircuit is a recipe which is not run because it keeps failing.
+type openCircuit struct {
+	Recipe   string    `json:"recipe"`
+	Failures int       `json:"failures"`
+	Opened   time.Time `json:"opened"`
+	// Retry is when the next probation run is allowed.
+	Retry time.Time `json:"retry"`
+}
+
+// circuitBreaker counts consecutive failures per recipe. A nil breaker
+// allows every run.
+type circuitBreaker struct {
+	conf circuitBreakerConfig
+
+	mu       sync.Mutex
+	failures map[string]int
+	opened   map[string]time.Time
+}
+
+// newCircuitBreaker returns a breaker seeded with the run history, or nil if
+// it is not configured.
+func newCircuitBreaker(conf circuitBreakerConfig, history []runRecord) *circuitBreaker {
+	if conf.Failures == 0 {
+		return nil
+	}
+	b := &circuitBreaker{
+		conf:     conf,
+		failures: make(map[string]int),
+		opened:   make(map[string]time.Time),
+	}
+	for _, rec := range history {
+		b.add(rec)
+	}
+	return b
+}
+
+func (b *circuitBreaker) add(rec runRecord) bool {
+	if len(rec.Failures) == 0 {
+		delete(b.failures, rec.Recipe)
+		delete(b.opened, rec.Recipe)
+		return false
+	}
+	b.failures[rec.Recipe]++
+	if b.failures[rec.Recipe] < b.conf.Failures {
+		return false
+	}
+	_, wasOpen := b.opened[rec.Recipe]
+	b.opened[rec.Recipe] = rec.Start
+	return !wasOpen
+}
+
+// observe records the outcome of a run. It returns true when the run opened
+// the circuit of the recipe.
+func (b *circuitBreaker) observe(rec runRecord) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.add(rec)
+}
+
+// allow reports whether the recipe may run. When not, reason says why.
+func (b *circuitBreaker) allow(recipe string) (ok bool, reason string) {
+	if b == nil {
+		return true, ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	opened, open := b.opened[recipe]
+	if !open {
+		return true, ""
+	}
+	retry := opened.Add(time.Second * b.conf.probation())
+	if time.Now().After(retry) {
+		return true, ""
+	}
+	return false, fmt.Sprintf("circuit open after %d failures, retrying %s", b.failures[recipe], retry.Format("2006-01-02 15:04"))
+}
+
+// reset closes the circuit of a recipe. It returns false if it wasn't open.
+func (b *circuitBreaker) reset(recipe string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, open := b.opened[recipe]
+	delete(b.failures, recipe)
+	delete(b.opened, recipe)
+	return open
+}
+
+// open returns the open circuits, by recipe name.
+func (b *circuitBreaker) open() []openCircuit {
+	circuits := []openCircuit{}
+	if b == nil {
+		return circuits
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for recipe, opened := range b.opened {
+		circuits = append(circuits, openCircuit{
+			Recipe:   recipe,
+			Failures: b.failures[recipe],
+			Opened:   opened,
+			Retry:    opened.Add(time.Second * b.conf.probation()),
+		})
+	}
+	sort.Slice(circuits, func(i, j int) bool { return circuits[i].Recipe < circuits[j].Recipe })
+	return circuits
+}
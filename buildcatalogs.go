@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/groob/plist"
+)
+
+// buildCatalogs is a native replacement for munki's makecatalogs. It reads
+// every pkginfo file under pkgsinfo and writes the all catalog plus one per
+// catalog name the items list, removing catalogs which are no longer used.
+// Items whose installer is missing from pkgs are left out unless
+// skipPkgCheck is set.
+func buildCatalogs(repoPath string, skipPkgCheck bool) error {
+	catalogs := map[string][]map[string]interface{}{"all": {}}
+	var problems int
+	err := walkPkginfos(repoPath, func(rel string, fi os.FileInfo, item map[string]interface{}, err error) error {
+		if err != nil {
+			log.Printf("makecatalogs: skipping %s: %v", rel, err)
+			problems++
+			return nil
+		}
+		if _, ok := item["name"].(string); !ok {
+			log.Printf("makecatalogs: skipping %s: no name", rel)
+			problems++
+			return nil
+		}
+		if !skipPkgCheck {
+			if missing := missingItems(repoPath, item); len(missing) > 0 {
+				log.Printf("makecatalogs: skipping %s: missing %s", rel, strings.Join(missing, ", "))
+				problems++
+				return nil
+			}
+		}
+		// admin notes stay out of the catalogs clients download.
+		delete(item, "notes")
+		catalogs["all"] = append(catalogs["all"], item)
+		names, _ := item["catalogs"].([]interface{})
+		if len(names) == 0 {
+			log.Printf("makecatalogs: %s is in no catalog", rel)
+		}
+		for _, name := range names {
+			if name, ok := name.(string); ok && name != "" {
+				catalogs[name] = append(catalogs[name], item)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(repoPath, "catalogs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, items := range catalogs {
+		b, err := plist.MarshalIndent(items, "\t")
+		if err != nil {
+			return fmt.Errorf("encoding catalog %s: %v", name, err)
+		}
+		if err := writeFileAtomic(filepath.Join(dir, name), b, 0644); err != nil {
+			return err
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if _, ok := catalogs[fi.Name()]; ok || fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		log.Printf("makecatalogs: removing unused catalog %s", fi.Name())
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	log.Printf("makecatalogs: %d items in %d catalogs, %d skipped", len(catalogs["all"]), len(catalogs)-1, problems)
+	return nil
+}
+
+// walkPkginfos calls fn with every pkginfo file of the repo, in lexical
+// order and skipping hidden files. rel is the path relative to pkgsinfo. A
+// file which can't be read is passed with the error.
+func walkPkginfos(repoPath string, fn func(rel string, fi os.FileInfo, item map[string]interface{}, err error) error) error {
+	pkgsinfo := filepath.Join(repoPath, "pkgsinfo")
+	return filepath.Walk(pkgsinfo, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() && path != pkgsinfo {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(pkgsinfo, path)
+		item, err := readPkginfo(path)
+		return fn(rel, fi, item, err)
+	})
+}
+
+func readPkginfo(path string) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var item map[string]interface{}
+	return item, plist.NewDecoder(f).Decode(&item)
+}
+
+// missingItems returns the installer and uninstaller items of a pkginfo which
+// are not in the pkgs directory of the repo.
+func missingItems(repoPath string, item map[string]interface{}) []string {
+	var missing []string
+	for _, key := range []string{"installer_item_location", "uninstaller_item_location"} {
+		location, ok := item[key].(string)
+		if !ok || location == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(repoPath, "pkgs", location)); err != nil {
+			missing = append(missing, location)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// runner runs autopkg, on this Mac or on a remote builder.
+type runner interface {
+	// autopkg returns the command which runs autopkg with args.
+	autopkg(args ...string) (string, []string)
+	// reportPath is where a run of recipe writes its report, which is read
+	// from local.
+	reportPath(recipe, local string) string
+	// fetchReport copies the report a run of recipe wrote to local, so it
+	// is read like a report of a local run.
+	fetchReport(ctx context.Context, recipe, local string) error
+	// String is the name of the builder, empty for this Mac.
+	String() string
+	// architecture is the architecture autopkg runs as, empty if unknown.
+	architecture() string
+}
+
+// localRunner runs autopkg on this Mac.
+type localRunner struct {
+	cmdPath string
+	// arch is the architecture the recipe must run as, if any.
+	arch string
+}
+
+func (r localRunner) autopkg(args ...string) (string, []string) {
+	return archCommand(r.arch, r.cmdPath, args)
+}
+
+func (r localRunner) reportPath(recipe, local string) string {
+	return local
+}
+
+func (r localRunner) fetchReport(context.Context, string, string) error { return nil }
+
+func (r localRunner) String() string { return "" }
+
+func (r localRunner) architecture() string {
+	if r.arch != "" {
+		return r.arch
+	}
+	return hostArch()
+}
+
+// builder is a remote Mac with autopkg installed, which runs the recipes
+// matching Recipes over SSH, and with an Arch, the recipes which must run on
+// it. Munki recipes import into the repo the builder
+// has mounted, which must be the munki_repo of this Mac.
+type builder struct {
+	Name string `toml:"name"`
+	// Host is the SSH host, with User and Port if they aren't the SSH
+	// defaults.
+	Host         string `toml:"host"`
+	User         string `toml:"user"`
+	Port         int    `toml:"port"`
+	IdentityFile string `toml:"identity_file"`
+	// SSHOptions are passed to ssh as -o options, e.g.
+	// StrictHostKeyChecking=yes.
+	SSHOptions []string `toml:"ssh_options"`
+	// AutopkgPath is autopkg on the builder, /usr/local/bin/autopkg by
+	// default.
+	AutopkgPath string `toml:"autopkg_path"`
+	// ReportsPath is the directory on the builder reports are written to.
+	ReportsPath string `toml:"reports_path"`
+	// Recipes are the names or patterns of the recipes the builder runs.
+	Recipes []string `toml:"recipes"`
+	// Arch is the architecture of the builder, arm64 or x86_64. Leave it
+	// empty for a universal builder, which runs recipes as the architecture
+	// they require.
+	Arch string `toml:"arch"`
+
+	// arch is the architecture the recipe being run must run as, if any.
+	arch string
+}
+
+type builders []builder
+
+func (b builders) validate() error {
+	names := make(map[string]bool)
+	for _, builder := range b {
+		if builder.Name == "" || builder.Host == "" || builder.ReportsPath == "" {
+			return fmt.Errorf("builders: name, host and reports_path are required")
+		}
+		if names[builder.Name] {
+			return fmt.Errorf("builders: %s is configured twice", builder.Name)
+		}
+		names[builder.Name] = true
+		if builder.Arch != "" && builder.Arch != "arm64" && builder.Arch != "x86_64" {
+			return fmt.Errorf("builders: %s: arch must be arm64 or x86_64, not %q", builder.Name, builder.Arch)
+		}
+		if len(builder.Recipes) == 0 && builder.Arch == "" {
+			return fmt.Errorf("builders: %s has no recipes and no arch", builder.Name)
+		}
+		for _, pattern := range builder.Recipes {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("builders: %s: invalid recipe pattern %q", builder.Name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// runnerFor returns the runner of a recipe: the mock runner with -mock, else
+// the first builder it matches whose architecture suits it, else the first
+// builder of the architecture it requires, else this Mac.
+func (conf Config) runnerFor(recipe string) runner {
+	if conf.Mock != "" {
+		return mockRunner{dir: conf.Mock}
+	}
+	arch := conf.RecipeArchitectures.of(recipe)
+	for _, b := range conf.Builders {
+		if len(b.Recipes) > 0 && matchAny(b.Recipes, recipe) && (arch == "" || b.Arch == "" || b.Arch == arch) {
+			b.arch = arch
+			return b
+		}
+	}
+	if arch != "" {
+		for _, b := range conf.Builders {
+			if b.Arch == arch {
+				b.arch = arch
+				return b
+			}
+		}
+	}
+	return localRunner{cmdPath: conf.AutopkgCmdPath, arch: arch}
+}
+
+// ssh returns the ssh command which runs the command line remote on the
+// builder.
+func (b builder) ssh(remote string) (string, []string) {
+	args := []string{"-o", "BatchMode=yes"}
+	for _, option := range b.SSHOptions {
+		args = append(args, "-o", option)
+	}
+	if b.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(b.Port))
+	}
+	if b.IdentityFile != "" {
+		args = append(args, "-i", b.IdentityFile)
+	}
+	host := b.Host
+	if b.User != "" {
+		host = b.User + "@" + host
+	}
+	return "ssh", append(args, host, remote)
+}
+
+func (b builder) autopkg(args ...string) (string, []string) {
+	cmdPath := b.AutopkgPath
+	if cmdPath == "" {
+		cmdPath = "/usr/local/bin/autopkg"
+	}
+	return b.ssh(shellQuote(archCommand(b.arch, cmdPath, args)))
+}
+
+// reportPath is always the recipe name in the builder's reports_path, the
+// report is copied to local after the run.
+func (b builder) reportPath(recipe, local string) string {
+	return path.Join(b.ReportsPath, recipe)
+}
+
+// fetchReport copies the report with ssh and removes it from the builder,
+// so a later run which dies before writing one doesn't leave a stale one
+// behind.
+func (b builder) fetchReport(ctx context.Context, recipe, local string) error {
+	remote := shellQuote(b.reportPath(recipe, local), nil)
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	f, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	name, args := b.ssh("cat " + remote + " && rm -f " + remote)
+	cmd := newCommand(ctx, name, args...)
+	cmd.Stdout = f
+	stderr := &limitedBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+	start := time.Now()
+	err = cmd.Run()
+	auditCommand(ctx, cmd, start, err)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// an empty file would be taken for a corrupt report.
+		os.Remove(local)
+		if stderr.Len() > 0 {
+			return fmt.Errorf("copying the report of %s from %s: %v: %s", recipe, b.Name, err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return fmt.Errorf("copying the report of %s from %s: %v", recipe, b.Name, err)
+	}
+	return nil
+}
+
+func (b builder) String() string { return b.Name }
+
+func (b builder) architecture() string {
+	if b.arch != "" {
+		return b.arch
+	}
+	return b.Arch
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/groob/plist"
+)
+
+// catalogChange is a pkginfo entry which was added to, removed from or
+// changed in a catalog by makecatalogs.
+type catalogChange struct {
+	Catalog string `json:"catalog"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Change  string `json:"change"`
+}
+
+func (c catalogChange) String() string {
+	return c.Change + " " + c.Name + " " + c.Version + " in " + c.Catalog
+}
+
+// catalogSnapshot maps catalog name to the pkginfo entries it contains, keyed
+// by name and version and holding the JSON form of the entry for comparison.
+type catalogSnapshot map[string]map[[2]string]string
+
+// readCatalogs reads all catalogs in the munki repo at repoPath.
+func readCatalogs(repoPath string) (catalogSnapshot, error) {
+	snapshot := make(catalogSnapshot)
+	dir := filepath.Join(repoPath, "catalogs")
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		items, err := readCatalog(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		entries := make(map[[2]string]string, len(items))
+		for _, item := range items {
+			name, _ := item["name"].(string)
+			version, _ := item["version"].(string)
+			b, err := json.Marshal(item)
+			if err != nil {
+				return nil, err
+			}
+			entries[[2]string{name, version}] = string(b)
+		}
+		snapshot[fi.Name()] = entries
+	}
+	return snapshot, nil
+}
+
+func readCatalog(path string) ([]map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var items []map[string]interface{}
+	return items, plist.NewDecoder(f).Decode(&items)
+}
+
+// changedCatalogs reports whether any of the pkginfo files, relative to the
+// pkgsinfo directory of the repo, changed since the catalogs were last built,
+// and lists the catalogs the changed ones are in.
+func changedCatalogs(repoPath string, pkginfos []string) (bool, []string, error) {
+	var built time.Time
+	if fi, err := os.Stat(filepath.Join(repoPath, "catalogs", "all")); err == nil {
+		built = fi.ModTime()
+	} else if !os.IsNotExist(err) {
+		return false, nil, err
+	}
+	changed := false
+	touched := make(map[string]bool)
+	for _, pkginfo := range pkginfos {
+		path := filepath.Join(repoPath, "pkgsinfo", pkginfo)
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, nil, err
+		}
+		if !fi.ModTime().After(built) {
+			continue
+		}
+		changed = true
+		f, err := os.Open(path)
+		if err != nil {
+			return false, nil, err
+		}
+		var info struct {
+			Catalogs []string `plist:"catalogs"`
+		}
+		err = plist.NewDecoder(f).Decode(&info)
+		f.Close()
+		if err != nil {
+			return false, nil, err
+		}
+		for _, catalog := range info.Catalogs {
+			touched[catalog] = true
+		}
+	}
+	catalogs := []string{}
+	for catalog := range touched {
+		catalogs = append(catalogs, catalog)
+	}
+	sort.Strings(catalogs)
+	return changed, catalogs, nil
+}
+
+// diffCatalogs returns the changes between two catalog snapshots, sorted by
+// catalog, name and version.
+func diffCatalogs(before, after catalogSnapshot) []catalogChange {
+	var changes []catalogChange
+	for catalog, entries := range after {
+		old := before[catalog]
+		for key, entry := range entries {
+			prev, ok := old[key]
+			switch {
+			case !ok:
+				changes = append(changes, catalogChange{Catalog: catalog, Name: key[0], Version: key[1], Change: "added"})
+			case prev != entry:
+				changes = append(changes, catalogChange{Catalog: catalog, Name: key[0], Version: key[1], Change: "changed"})
+			}
+		}
+	}
+	for catalog, entries := range before {
+		for key := range entries {
+			if _, ok := after[catalog][key]; !ok {
+				changes = append(changes, catalogChange{Catalog: catalog, Name: key[0], Version: key[1], Change: "removed"})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Catalog != b.Catalog {
+			return a.Catalog < b.Catalog
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Version < b.Version
+	})
+	return changes
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// retentionConfig configures removing old versions of items from the munki
+// repo after imports.
+type retentionConfig struct {
+	// Keep is the number of versions of each item which are kept in each
+	// catalog. Zero keeps everything.
+	Keep int `toml:"keep"`
+	// ArchiveDir, if set, is where old pkginfo files and installers are
+	// moved instead of being deleted. It must be on the repo's volume.
+	ArchiveDir string `toml:"archive_dir"`
+	// Exclude are item names or patterns which keep every version.
+	Exclude []string `toml:"exclude"`
+	// DryRun only reports what would be removed.
+	DryRun bool `toml:"dry_run"`
+}
+
+// oldVersion is a pkginfo beyond the versions kept, with the installer
+// items only it refers to.
+type oldVersion struct {
+	pkginfo string   // relative to pkgsinfo
+	pkgs    []string // relative to pkgs
+	name    string
+	version string
+}
+
+// oldVersions returns the pkginfo files of the repo beyond the newest Keep
+// versions of each item in each of its catalogs, so a new import into
+// testing doesn't push out the version in production. An installer is only
+// removed with the last pkginfo referring to it. Any pkginfo which can't be
+// read fails the whole pass, as the installers it refers to would otherwise
+// look unreferenced.
+func (c retentionConfig) oldVersions(repoPath string) ([]oldVersion, error) {
+	type entry struct {
+		oldVersion
+		refs     []string
+		catalogs []string
+		keep     bool
+	}
+	var entries []*entry
+	// byCatalog are the entries of each name and catalog.
+	byCatalog := make(map[[2]string][]*entry)
+	err := walkPkginfos(repoPath, func(rel string, fi os.FileInfo, item map[string]interface{}, err error) error {
+		if err != nil {
+			return fmt.Errorf("retention: %s: %v", rel, err)
+		}
+		name, _ := item["name"].(string)
+		version, _ := item["version"].(string)
+		if name == "" {
+			return fmt.Errorf("retention: %s has no name", rel)
+		}
+		e := &entry{oldVersion: oldVersion{pkginfo: rel, name: name, version: version}}
+		for _, key := range []string{"installer_item_location", "uninstaller_item_location"} {
+			if location, ok := item[key].(string); ok && location != "" {
+				e.refs = append(e.refs, location)
+			}
+		}
+		catalogs, _ := item["catalogs"].([]interface{})
+		for _, catalog := range catalogs {
+			if s, ok := catalog.(string); ok {
+				e.catalogs = append(e.catalogs, s)
+			}
+		}
+		if len(e.catalogs) == 0 {
+			e.catalogs = []string{""}
+		}
+		e.keep = len(c.Exclude) > 0 && matchAny(c.Exclude, name)
+		entries = append(entries, e)
+		// held items neither count towards the versions kept nor are
+		// removed, so their predecessor is still there when they are
+		// released.
+		metadata, _ := item["_metadata"].(map[string]interface{})
+		if _, held := metadata[heldCatalogsKey]; held {
+			e.keep = true
+			return nil
+		}
+		for _, catalog := range e.catalogs {
+			key := [2]string{name, catalog}
+			byCatalog[key] = append(byCatalog[key], e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, list := range byCatalog {
+		sort.SliceStable(list, func(i, j int) bool {
+			return compareVersions(list[i].version, list[j].version) > 0
+		})
+		for i := 0; i < c.Keep && i < len(list); i++ {
+			list[i].keep = true
+		}
+	}
+	kept := make(map[string]bool)
+	var old []*entry
+	for _, e := range entries {
+		if !e.keep {
+			old = append(old, e)
+			continue
+		}
+		for _, ref := range e.refs {
+			kept[ref] = true
+		}
+	}
+	var versions []oldVersion
+	for _, e := range old {
+		for _, ref := range e.refs {
+			if !kept[ref] {
+				e.pkgs = append(e.pkgs, ref)
+				kept[ref] = true // don't remove it twice
+			}
+		}
+		versions = append(versions, e.oldVersion)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].pkginfo < versions[j].pkginfo })
+	return versions, nil
+}
+
+// remove deletes or archives an old version.
+func (c retentionConfig) remove(repoPath string, v oldVersion) error {
+	files := []string{filepath.Join("pkgsinfo", v.pkginfo)}
+	for _, pkg := range v.pkgs {
+		files = append(files, filepath.Join("pkgs", pkg))
+	}
+	for _, file := range files {
+		src := filepath.Join(repoPath, file)
+		if c.ArchiveDir == "" {
+			if err := os.Remove(src); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		dst := filepath.Join(c.ArchiveDir, file)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOldVersions applies the retention policy and reports whether the
+// catalogs need to be rebuilt. A dry run only reports what would be removed.
+func (d *daemon) removeOldVersions() bool {
+	conf := d.conf.Retention
+	if conf.Keep == 0 {
+		return false
+	}
+	repo := d.conf.MunkiRepoPath
+	// recipe runs and makecatalogs mustn't see the repo half cleaned up.
+	unlock, err := d.lockRepo(d.ctx, false, true)
+	if err != nil {
+		log.Println("not removing old versions, waiting for the repo lock:", err)
+		return false
+	}
+	defer unlock()
+	versions, err := conf.oldVersions(repo)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if len(versions) == 0 {
+		return false
+	}
+	verb := "removed"
+	switch {
+	case conf.DryRun:
+		verb = "would remove"
+	case conf.ArchiveDir != "":
+		verb = "archived"
+	}
+	var lines []string
+	for _, v := range versions {
+		if !conf.DryRun {
+			if err := conf.remove(repo, v); err != nil {
+				log.Println(err)
+				continue
+			}
+		}
+		line := fmt.Sprintf("%s %s (%s", v.name, v.version, v.pkginfo)
+		if len(v.pkgs) > 0 {
+			line += ", " + strings.Join(v.pkgs, ", ")
+		}
+		line += ")"
+		log.Printf("retention: %s %s", verb, line)
+		lines = append(lines, "- "+line)
+	}
+	if len(lines) > 0 && d.slack {
+		text := fmt.Sprintf("Old versions %s, keeping the newest %d per catalog:\n%s", verb, conf.Keep, strings.Join(lines, "\n"))
+		if err := postSlack(d.conf.Slack, text); err != nil {
+			log.Println(err)
+		}
+	}
+	return !conf.DryRun && len(lines) > 0
+}
+
+// compareVersions compares two version strings the way munki does, by
+// their numeric and alphabetic components: 1.10 is newer than 1.9. It
+// returns 1 if a is newer than b, -1 if it is older and 0 if they are equal.
+func compareVersions(a, b string) int {
+	ca, cb := versionComponents(a), versionComponents(b)
+	for i := 0; i < len(ca) || i < len(cb); i++ {
+		// missing components count as zero, so 1.0 equals 1.0.0.
+		x, y := "0", "0"
+		if i < len(ca) {
+			x = ca[i]
+		}
+		if i < len(cb) {
+			y = cb[i]
+		}
+		nx, errx := strconv.ParseUint(x, 10, 64)
+		ny, erry := strconv.ParseUint(y, 10, 64)
+		switch {
+		case errx == nil && erry == nil:
+			if nx != ny {
+				if nx > ny {
+					return 1
+				}
+				return -1
+			}
+		case errx == nil:
+			// a number is newer than a suffix such as b1.
+			return 1
+		case erry == nil:
+			return -1
+		case x != y:
+			if x > y {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
+
+// versionComponents splits a version into runs of digits and runs of
+// letters, dropping separators.
+func versionComponents(v string) []string {
+	var components []string
+	var current []rune
+	flush := func() {
+		if len(current) > 0 {
+			components = append(components, string(current))
+			current = current[:0]
+		}
+	}
+	for _, r := range v {
+		switch {
+		case unicode.IsDigit(r):
+			if len(current) > 0 && !unicode.IsDigit(current[0]) {
+				flush()
+			}
+			current = append(current, r)
+		case unicode.IsLetter(r):
+			if len(current) > 0 && unicode.IsDigit(current[0]) {
+				flush()
+			}
+			current = append(current, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return components
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/groob/plist"
+)
+
+// testRepo is a munki repo in a temporary directory.
+type testRepo struct {
+	t    *testing.T
+	path string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	dir, err := ioutil.TempDir("", "autopkgd-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &testRepo{t: t, path: dir}
+}
+
+func (r *testRepo) write(file string, b []byte) {
+	r.t.Helper()
+	path := filepath.Join(r.path, file)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// add writes a pkginfo and its installer item, pkg, if it isn't empty.
+func (r *testRepo) add(pkginfo, name, version, pkg string, catalogs ...string) {
+	r.t.Helper()
+	item := map[string]interface{}{"name": name, "version": version, "catalogs": catalogs}
+	if pkg != "" {
+		item["installer_item_location"] = pkg
+		r.write(filepath.Join("pkgs", pkg), []byte(pkg))
+	}
+	b, err := plist.Marshal(item)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.write(filepath.Join("pkgsinfo", pkginfo), b)
+}
+
+func (r *testRepo) exists(file string) bool {
+	_, err := os.Stat(filepath.Join(r.path, file))
+	return err == nil
+}
+
+func oldPkginfos(versions []oldVersion) []string {
+	var files []string
+	for _, v := range versions {
+		files = append(files, v.pkginfo)
+	}
+	return files
+}
+
+func TestOldVersionsKeepsNewestPerCatalog(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.add("Firefox-1.0.plist", "Firefox", "1.0", "Firefox-1.0.dmg", "production")
+	repo.add("Firefox-1.5.plist", "Firefox", "1.5", "Firefox-1.5.dmg", "testing")
+	repo.add("Firefox-1.10.plist", "Firefox", "1.10", "Firefox-1.10.dmg", "testing")
+	repo.add("Firefox-0.9.plist", "Firefox", "0.9", "Firefox-0.9.dmg", "production")
+
+	versions, err := retentionConfig{Keep: 1}.oldVersions(repo.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Firefox-0.9.plist", "Firefox-1.5.plist"}
+	if got := oldPkginfos(versions); !reflect.DeepEqual(got, want) {
+		t.Errorf("old versions = %v, want %v", got, want)
+	}
+}
+
+func TestOldVersionsKeepsSharedInstallers(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.add("Tool-1.0.plist", "Tool", "1.0", "Tool.pkg", "testing")
+	repo.add("Tool-1.1.plist", "Tool", "1.1", "Tool.pkg", "testing")
+	repo.add("Tool-0.9.plist", "Tool", "0.9", "Tool-0.9.pkg", "testing")
+
+	versions, err := retentionConfig{Keep: 1}.oldVersions(repo.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs := make(map[string][]string)
+	for _, v := range versions {
+		pkgs[v.pkginfo] = v.pkgs
+	}
+	want := map[string][]string{"Tool-0.9.plist": {"Tool-0.9.pkg"}, "Tool-1.0.plist": nil}
+	if !reflect.DeepEqual(pkgs, want) {
+		t.Errorf("old versions = %v, want %v", pkgs, want)
+	}
+}
+
+func TestOldVersionsExclude(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.add("macOS-13.plist", "macOSVentura", "13.0", "", "production")
+	repo.add("macOS-13.1.plist", "macOSVentura", "13.1", "", "production")
+	repo.add("Zoom-1.plist", "Zoom", "1", "", "production")
+	repo.add("Zoom-2.plist", "Zoom", "2", "", "production")
+
+	versions, err := retentionConfig{Keep: 1, Exclude: []string{"macOS*"}}.oldVersions(repo.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Zoom-1.plist"}
+	if got := oldPkginfos(versions); !reflect.DeepEqual(got, want) {
+		t.Errorf("old versions = %v, want %v", got, want)
+	}
+}
+
+func TestOldVersionsFailsOnUnreadablePkginfo(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.add("Zoom-1.plist", "Zoom", "1", "Zoom-1.pkg", "production")
+	repo.add("Zoom-2.plist", "Zoom", "2", "Zoom-2.pkg", "production")
+	// a pkginfo of Zoom 2 which refers to Zoom-1.pkg, but can't be parsed.
+	repo.write("pkgsinfo/Zoom-2-fix.plist", []byte("<plist><dict><key>name</key>"))
+
+	versions, err := retentionConfig{Keep: 1}.oldVersions(repo.path)
+	if err == nil {
+		t.Errorf("no error with an unreadable pkginfo, old versions = %v", oldPkginfos(versions))
+	}
+	if len(versions) != 0 {
+		t.Errorf("old versions = %v, want none", oldPkginfos(versions))
+	}
+}
+
+func TestRetentionRemove(t *testing.T) {
+	for _, archive := range []bool{false, true} {
+		repo := newTestRepo(t)
+		repo.add("Zoom-1.plist", "Zoom", "1", "apps/Zoom-1.pkg", "production")
+		repo.add("Zoom-2.plist", "Zoom", "2", "apps/Zoom-2.pkg", "production")
+		conf := retentionConfig{Keep: 1}
+		if archive {
+			conf.ArchiveDir = filepath.Join(repo.path, "archive")
+		}
+		versions, err := conf.oldVersions(repo.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range versions {
+			if err := conf.remove(repo.path, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, file := range []string{"pkgsinfo/Zoom-1.plist", "pkgs/apps/Zoom-1.pkg"} {
+			if repo.exists(file) {
+				t.Errorf("archive %v: %s is still in the repo", archive, file)
+			}
+			if archived := repo.exists(filepath.Join("archive", file)); archived != archive {
+				t.Errorf("archive %v: %s archived = %v", archive, file, archived)
+			}
+		}
+		for _, file := range []string{"pkgsinfo/Zoom-2.plist", "pkgs/apps/Zoom-2.pkg"} {
+			if !repo.exists(file) {
+				t.Errorf("archive %v: %s was removed", archive, file)
+			}
+		}
+	}
+}
+
+func TestOldVersionsIgnoresHeldItems(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.add("Zoom-1.plist", "Zoom", "1", "Zoom-1.pkg", "production")
+	repo.add("Zoom-2.plist", "Zoom", "2", "Zoom-2.pkg", "production")
+	if _, err := (importGate{}).hold(repo.path, importedItem{Name: "Zoom", Version: "2", Pkginfo: "Zoom-2.plist"}); err != nil {
+		t.Fatal(err)
+	}
+	repo.add("Zoom-0.plist", "Zoom", "0", "Zoom-0.pkg", "production")
+
+	versions, err := retentionConfig{Keep: 1}.oldVersions(repo.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Zoom-0.plist"}
+	if got := oldPkginfos(versions); !reflect.DeepEqual(got, want) {
+		t.Errorf("old versions = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// command is a subcommand of the autopkgd binary.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	control := func(name string) func([]string) int {
+		return func(args []string) int { return runControl(name, args) }
+	}
+	commands = []command{
+		{"daemon", "run the recipes every check interval (the default)", runDaemon},
+		{"run", "run recipes, on the running daemon if there is one", runRecipes},
+		{"plan", "check which recipes would import and store the plan", runPlan},
+		{"apply", "run the recipes of a stored plan", runApply},
+		{"status", "show the state of the running daemon", control("status")},
+		{"top", "live terminal monitor of the running daemon", runTop},
+		{"validate", "check the config and recipe list", runValidate},
+		{"doctor", "check the environment and print a checklist", runDoctor},
+		{"list", "list the recipes the daemon runs", runList},
+		{"cancel", "cancel running or queued recipes", control("cancel")},
+		{"reset", "reset the circuit breaker of recipes", control("reset")},
+		{"pause", "pause scheduled cycles or recipes", control("pause")},
+		{"resume", "resume scheduled cycles or recipes", control("resume")},
+		{"set", "change settings of the running daemon", control("set")},
+		{"held", "list the imports held in the quarantine catalog", control("held")},
+		{"release", "release held imports into their catalogs", control("release")},
+		{"reject", "reject held imports", control("reject")},
+		{"logs", "show or follow the output of a recipe's latest run", runLogs},
+		{"report", "show the last report and runs of a recipe", runReport},
+		{"check-health", "Nagios check of the last cycle", runCheckHealth},
+		{"export", "export the run history as CSV or JSON", runExport},
+		{"verify-artifacts", "re-hash the installer items against the recorded hashes", runVerifyArtifacts},
+		{"lock", "run a command with the repo lock held", runLock},
+		{"server", "collect reports from multiple build machines", runServer},
+		{"version", "print the version", runVersion},
+		{"completion", "print a bash, zsh or fish completion script", runCompletion},
+		{"help", "show this help", func([]string) int { printUsage(); return 0 }},
+		{"__complete", "", runComplete},
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: autopkgd <command> [-config file] [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, c := range commands {
+		if c.usage != "" {
+			fmt.Fprintf(w, "  %s\t%s\n", c.name, c.usage)
+		}
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr, "\nrun `autopkgd <command> -h` for the flags of a command")
+}
+
+func runVersion(args []string) int {
+	fmt.Printf("autopkgd - version %s\n", Version)
+	return 0
+}
+
+// runValidate implements `autopkgd validate`, which checks the config the
+// way the daemon does when it starts, and that the recipe list is readable
+// and in the allowlist.
+func runValidate(args []string) int {
+	var (
+		flags   = flag.NewFlagSet("validate", flag.ExitOnError)
+		fConfig = flags.String("config", "", "configuration file to load")
+	)
+	flags.Parse(args)
+
+	conf, err := loadConfig(*fConfig)
+	if err != nil {
+		fmt.Printf("%s: %v\n", *fConfig, err)
+		return 1
+	}
+	if err := checkDaemonConfig(conf); err != nil {
+		fmt.Printf("%s: %v\n", *fConfig, err)
+		return 1
+	}
+	recipes, err := readRecipes(conf.RecipesFile)
+	if err != nil {
+		fmt.Printf("%s: recipes_file: %v\n", *fConfig, err)
+		return 1
+	}
+	var refused []string
+	for _, recipe := range recipes {
+		if !conf.RecipeAllowlist.allows(recipe) {
+			refused = append(refused, recipe)
+		}
+	}
+	if len(refused) > 0 {
+		fmt.Printf("%s: recipes_file: not in the recipe allowlist: %s\n", *fConfig, strings.Join(refused, ", "))
+		return 1
+	}
+	fmt.Printf("%s: ok, %d recipes\n", *fConfig, len(recipes))
+	return 0
+}
+
+// runList implements `autopkgd list`, which prints the recipe list in the
+// order the daemon runs it.
+func runList(args []string) int {
+	var (
+		flags     = flag.NewFlagSet("list", flag.ExitOnError)
+		fConfig   = flags.String("config", "", "configuration file to load")
+		fDisabled = flags.Bool("disabled", false, "also list the disabled recipes")
+	)
+	flags.Parse(args)
+
+	conf, err := loadConfig(*fConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	recipes, err := readRecipes(conf.RecipesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, recipe := range recipes {
+		fmt.Println(recipe)
+	}
+	if *fDisabled {
+		disabled, err := readDisabledRecipes(conf.RecipesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, recipe := range disabled {
+			fmt.Println(recipe, "(disabled)")
+		}
+	}
+	return 0
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// codeSignatureConfig configures the handling of code signature verification
+// failures. A download whose signature doesn't verify may have been tampered
+// with, so the failures are alerted on separately from other failures.
+type codeSignatureConfig struct {
+	// WebhookURL and Channel are where the alerts are posted, they default
+	// to the slack config, e.g. to send possible tampering to the security
+	// team, who hear of it whether -slack is set or not.
+	WebhookURL string `toml:"webhook_url"`
+	Channel    string `toml:"channel"`
+	// Mention is added to the alerts, e.g. <!channel> or <@U024BE7LH>.
+	Mention string `toml:"mention"`
+	// Quarantine moves the items a run imported despite a verification
+	// failure out of the repo, to QuarantineDir.
+	Quarantine    bool   `toml:"quarantine"`
+	QuarantineDir string `toml:"quarantine_dir"`
+}
+
+func (c codeSignatureConfig) validate() error {
+	if c.Quarantine && c.QuarantineDir == "" {
+		return errors.New("code_signature: quarantine requires quarantine_dir")
+	}
+	return nil
+}
+
+// signatureFailures returns the code signature verification failures of a
+// report: the failures raised by CodeSignatureVerifier and the rows of its
+// summary result which didn't verify.
+func signatureFailures(report autopkgReport) []string {
+	var problems []string
+	for _, f := range report.Failures {
+		if isSignatureFailure(f) {
+			problems = append(problems, f.Message)
+		}
+	}
+	summary, ok := report.SummaryResults["code_signature_verifier_summary_result"]
+	if !ok {
+		return problems
+	}
+	for _, row := range summary.DataRows {
+		path, _ := row["input_path"].(string)
+		if verified, ok := row["verified"].(bool); ok && !verified {
+			problems = append(problems, path+": not verified")
+			continue
+		}
+		for _, key := range []string{"result", "status"} {
+			result, _ := row[key].(string)
+			lower := strings.ToLower(result)
+			if strings.Contains(lower, "fail") || strings.Contains(lower, "invalid") || strings.Contains(lower, "mismatch") {
+				problems = append(problems, path+": "+result)
+				break
+			}
+		}
+	}
+	return problems
+}
+
+func isSignatureFailure(f failure) bool {
+	msg := strings.ToLower(f.Message)
+	return strings.Contains(msg, "codesignatureverifier") || strings.Contains(msg, "code signature")
+}
+
+// quarantine moves a pkginfo and its installer to dir, keeping their paths
+// relative to the repo. dir must be on the repo's volume.
+func quarantine(repoPath, dir string, item importedItem, pkg string) error {
+	files := []string{filepath.Join("pkgsinfo", item.Pkginfo)}
+	if pkg != "" {
+		files = append(files, filepath.Join("pkgs", pkg))
+	}
+	for _, file := range files {
+		dst := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(repoPath, file), dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSignatures records the code signature verification failures of a
+// run on its report, as a failure of the run even if autopkg carried on.
+// The items the run imported are quarantined when configured, and an alert
+// is posted.
+func (d *daemon) checkSignatures(recipe string, report *autopkgReport) {
+	problems := signatureFailures(*report)
+	if len(problems) == 0 {
+		return
+	}
+	conf := d.conf.CodeSignature
+	report.SignatureFailures = problems
+	failed := false
+	for _, f := range report.Failures {
+		failed = failed || isSignatureFailure(f)
+	}
+	if !failed {
+		report.Failures = append(report.Failures, failure{Recipe: recipe, Message: "code signature verification failed: " + strings.Join(problems, "; ")})
+	}
+	log.Printf("code signature verification failed for %s: %s", recipe, strings.Join(problems, "; "))
+
+	dir := filepath.Join(conf.QuarantineDir, recipe, time.Now().Format("20060102-150405"))
+	summary, ok := report.SummaryResults["munki_importer_summary_result"]
+	if conf.Quarantine && ok && len(summary.DataRows) > 0 {
+		var rows []map[string]interface{}
+		for _, row := range summary.DataRows {
+			name, _ := row["name"].(string)
+			version, _ := row["version"].(string)
+			pkginfo, _ := row["pkginfo_path"].(string)
+			pkg, _ := row["pkg_repo_path"].(string)
+			item := importedItem{Name: name, Version: version, Pkginfo: pkginfo}
+			if err := quarantine(d.conf.MunkiRepoPath, dir, item, pkg); err != nil {
+				log.Printf("quarantining %s %s: %v", name, version, err)
+				rows = append(rows, row)
+				continue
+			}
+			log.Printf("quarantined %s %s in %s", name, version, dir)
+			report.Quarantined = append(report.Quarantined, item)
+		}
+		summary.DataRows = rows
+		report.SummaryResults["munki_importer_summary_result"] = summary
+	}
+	d.signatureAlert(recipe, *report, dir)
+}
+
+// signatureAlert posts a code signature verification failure to the
+// code_signature webhook, or to slack when it is enabled, with the items
+// moved to quarantineDir.
+func (d *daemon) signatureAlert(recipe string, report autopkgReport, quarantineDir string) {
+	conf := d.conf.CodeSignature
+	to := d.conf.Slack
+	switch {
+	case conf.WebhookURL != "":
+		to.WebhookURL = conf.WebhookURL
+	case !d.slack || to.WebhookURL == "":
+		return
+	}
+	if conf.Channel != "" {
+		to.Channel = conf.Channel
+	}
+	text := fmt.Sprintf(":rotating_light: *Code signature verification failed* for %s:\n- %s", recipe, strings.Join(report.SignatureFailures, "\n- "))
+	if conf.Mention != "" {
+		text = conf.Mention + " " + text
+	}
+	for _, item := range report.Quarantined {
+		text += fmt.Sprintf("\nQuarantined %s %s in %s", item.Name, item.Version, quarantineDir)
+	}
+	if err := postSlack(to, text); err != nil {
+		log.Println(err)
+	}
+}
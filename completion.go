@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The completion scripts call `autopkgd __complete word...` with the words
+// of the command line after autopkgd, the last one being completed. It
+// prints the candidates, or filesCompletion when the shell should complete
+// file names.
+const filesCompletion = ":files"
+
+var completionScripts = map[string]string{
+	"bash": `_autopkgd() {
+    local IFS=$'\n' cur=${COMP_WORDS[COMP_CWORD]}
+    local out=$(autopkgd __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)
+    if [[ $out == ` + filesCompletion + ` ]]; then
+        COMPREPLY=($(compgen -f -- "$cur"))
+    else
+        COMPREPLY=($(compgen -W "$out" -- "$cur"))
+    fi
+}
+complete -F _autopkgd autopkgd
+`,
+	"zsh": `#compdef autopkgd
+_autopkgd() {
+    local -a out
+    out=("${(@f)$(autopkgd __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    if [[ ${out[1]} == ` + filesCompletion + ` ]]; then
+        _files
+    else
+        compadd -a out
+    fi
+}
+compdef _autopkgd autopkgd
+`,
+	"fish": `function __autopkgd_complete
+    set -l out (autopkgd __complete (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)
+    if test "$out" = ` + filesCompletion + `
+        __fish_complete_path (commandline -ct)
+    else
+        printf '%s\n' $out
+    end
+end
+complete -c autopkgd -f -a '(__autopkgd_complete)'
+`,
+}
+
+// recipeCommands take recipe names as arguments.
+var recipeCommands = map[string]bool{
+	"run": true, "cancel": true, "reset": true, "pause": true, "resume": true, "report": true, "logs": true, "plan": true,
+}
+
+// runCompletion implements `autopkgd completion bash|zsh|fish`.
+func runCompletion(args []string) int {
+	if len(args) != 1 || completionScripts[args[0]] == "" {
+		fmt.Println("usage: autopkgd completion bash|zsh|fish")
+		return 1
+	}
+	fmt.Print(completionScripts[args[0]])
+	return 0
+}
+
+// runComplete prints the completions of the last of args.
+func runComplete(args []string) int {
+	if len(args) == 0 {
+		return 0
+	}
+	current := args[len(args)-1]
+	var candidates []string
+	switch {
+	case len(args) == 1:
+		for _, c := range commands {
+			if !strings.HasPrefix(c.name, "_") {
+				candidates = append(candidates, c.name)
+			}
+		}
+	case strings.HasPrefix(current, "-"):
+		for name := range commandFlags(args[0]) {
+			candidates = append(candidates, "-"+name)
+		}
+		sort.Strings(candidates)
+	case args[0] == "completion":
+		for shell := range completionScripts {
+			candidates = append(candidates, shell)
+		}
+		sort.Strings(candidates)
+	default:
+		flags := commandFlags(args[0])
+		if prev := strings.TrimLeft(args[len(args)-2], "-"); strings.HasPrefix(args[len(args)-2], "-") && flags[prev] {
+			fmt.Println(filesCompletion)
+			return 0
+		}
+		if !recipeCommands[args[0]] {
+			fmt.Println(filesCompletion)
+			return 0
+		}
+		candidates = completeRecipes(args)
+	}
+	for _, c := range candidates {
+		if strings.HasPrefix(c, current) {
+			fmt.Println(c)
+		}
+	}
+	return 0
+}
+
+// flagUsage matches the flag lines of the usage the flag package prints,
+// e.g. "  -config string". Flags followed by a type take a value.
+var flagUsage = regexp.MustCompile(`(?m)^  -(\S+)( \S+)?$`)
+
+// commandFlags returns the flags of a subcommand and whether they take a
+// value, from its -h output.
+func commandFlags(command string) map[string]bool {
+	self, err := os.Executable()
+	if err != nil {
+		return nil
+	}
+	var usage bytes.Buffer
+	cmd := exec.Command(self, command, "-h")
+	cmd.Stdout, cmd.Stderr = &usage, &usage
+	cmd.Run()
+	flags := make(map[string]bool)
+	for _, m := range flagUsage.FindAllStringSubmatch(usage.String(), -1) {
+		flags[m[1]] = m[2] != ""
+	}
+	return flags
+}
+
+// completeRecipes returns the recipes in the recipe list of the config given
+// with -config on the command line.
+func completeRecipes(args []string) []string {
+	var path string
+	for i, arg := range args[:len(args)-1] {
+		switch {
+		case (arg == "-config" || arg == "--config") && i+1 < len(args)-1:
+			path = args[i+1]
+		case strings.HasPrefix(arg, "-config="), strings.HasPrefix(arg, "--config="):
+			path = arg[strings.Index(arg, "=")+1:]
+		}
+	}
+	if path == "" {
+		return nil
+	}
+	conf, err := loadConfig(path)
+	if err != nil {
+		return nil
+	}
+	recipes, _ := readRecipes(conf.RecipesFile)
+	disabled, _ := readDisabledRecipes(conf.RecipesFile)
+	return append(recipes, disabled...)
+}
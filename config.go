@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config autopkgd config
+type Config struct {
+	AutopkgCmdPath      string        `toml:"autopkg_path,omitempty"`
+	MakecatalogsCmdPath string        `toml:"makecatalogs_path,omitempty"`
+	MakecatalogsFlags   []string      `toml:"makecatalogs_flags"`
+	IncrementalCatalogs bool          `toml:"incremental_catalogs"`
+	BuiltinMakecatalogs bool          `toml:"builtin_makecatalogs"`
+	RecipesFile         string        `toml:"recipes_file"`
+	MunkiRepoPath       string        `toml:"munki_repo"`
+	ReportsPath         string        `toml:"reports_path"`
+	ReportFilename      string        `toml:"report_filename"`
+	MaxProcesses        int           `toml:"max_processes"`
+	ExecTimeout         time.Duration `toml:"autopkg_exec_timeout"`
+	CheckTimeout        time.Duration `toml:"autopkg_check_timeout"`
+	CheckPhaseTimeout   time.Duration `toml:"check_phase_timeout"`
+	ImportPhaseTimeout  time.Duration `toml:"import_phase_timeout"`
+	CheckInterval       time.Duration `toml:"autopkg_check_interval"`
+	HistoryFile         string        `toml:"history_file"`
+	StatusFile          string        `toml:"status_file"`
+	HashArtifacts       bool          `toml:"hash_artifacts"`
+	ControlSocket       string        `toml:"control_socket"`
+	AuditLog            string        `toml:"audit_log"`
+	SerializeImports    bool          `toml:"serialize_imports"`
+	RepoLock            string        `toml:"repo_lock"`
+	MaxOutputMB         int64         `toml:"max_output_mb"`
+	CycleStateFile      string        `toml:"cycle_state_file"`
+	ChildrenFile        string        `toml:"children_file"`
+	Orphans             string        `toml:"orphans"`
+	CheckToolReleases   bool          `toml:"check_tool_releases"`
+	AutopkgVerbosity    int           `toml:"autopkg_verbosity"`
+	QuietUnchanged      bool          `toml:"quiet_unchanged"`
+	ReportPushURL       string        `toml:"report_push_url"`
+	ReportPushToken     string        `toml:"report_push_token"`
+
+	// Mock is the directory of canned reports recipe runs are simulated
+	// with, set by -mock.
+	Mock string `toml:"-"`
+	// reportFilename is ReportFilename parsed when the config is loaded.
+	reportFilename *template.Template
+
+	// Recipes autopkgd may run, whatever the recipe list says
+	RecipeAllowlist recipeAllowlist `toml:"recipe_allowlist"`
+
+	// HTTP API config
+	API apiConfig `toml:"api"`
+
+	// Multi-node aggregation config, for workers and for `autopkgd server`
+	Aggregator aggregator   `toml:"aggregator"`
+	Server     serverConfig `toml:"server"`
+
+	// Priority and resource limits of child processes
+	Resources resourceConfig `toml:"resources"`
+
+	// Remote Macs recipes run on over SSH
+	Builders builders `toml:"builders"`
+
+	// autopkg verbosity of recipes, overriding autopkg_verbosity
+	RecipeVerbosity recipeVerbosity `toml:"recipe_verbosity"`
+
+	// Recipes which must run on arm64 or x86_64, by architecture
+	RecipeArchitectures recipeArchitectures `toml:"recipe_architectures"`
+
+	// Account child processes run as
+	RunAs runAsConfig `toml:"run_as"`
+
+	// External executables run after each recipe and cycle
+	Plugins plugins `toml:"plugins"`
+
+	// Edits of newly imported pkginfo files
+	PkginfoEdits []pkginfoEdit `toml:"pkginfo_edits"`
+
+	// Code signature verification failure config
+	CodeSignature codeSignatureConfig `toml:"code_signature"`
+
+	// Alert for cycles in which most recipes failed
+	FailureAlarm failureAlarm `toml:"failure_alarm"`
+
+	// VirusTotalAnalyzer result reporting config
+	VirusTotal virusTotalConfig `toml:"virustotal"`
+
+	// Validation of newly imported pkginfo files
+	PkginfoValidation pkginfoValidation `toml:"pkginfo_validation"`
+
+	// Manifests newly imported items are added to
+	ManifestUpdates []manifestUpdate `toml:"manifest_updates"`
+
+	// Quarantine catalog new imports are held in until they are released
+	ImportGate importGate `toml:"import_gate"`
+
+	// Testing to production promotion config
+	Promotion promotionConfig `toml:"promotion"`
+
+	// Old version retention config
+	Retention retentionConfig `toml:"retention"`
+
+	// S3 repo sync config
+	RepoSync repoSync `toml:"repo_sync"`
+
+	// Google Cloud Storage repo sync config
+	GCSSync gcsSync `toml:"gcs_sync"`
+
+	// Azure Blob Storage repo sync config
+	AzureSync azureSync `toml:"azure_sync"`
+
+	// Per host download limit config
+	DownloadLimit downloadLimitConfig `toml:"download_limit"`
+
+	// Sets of recipes run together with `autopkgd run -tag`, by tag
+	RecipeTags recipeTags `toml:"recipe_tags"`
+
+	// Recipes which must not run at the same time, by group name
+	ConcurrencyGroups concurrencyGroups `toml:"concurrency_groups"`
+
+	// Circuit breaker config for consistently failing recipes
+	CircuitBreaker circuitBreakerConfig `toml:"circuit_breaker"`
+
+	// Recipe overrides repository webhook config
+	Webhook webhookConfig `toml:"webhook"`
+
+	// Slow recipe detection config
+	SlowRecipes slowRecipes `toml:"slow_recipes"`
+
+	// Alerts on recipes which haven't succeeded for a while
+	StaleRecipes staleRecipes `toml:"stale_recipes"`
+
+	// Test Macs checked for new imports after the catalogs are rebuilt
+	TestClients testClients `toml:"test_clients"`
+
+	// MDM new imports are pushed to a pilot group with
+	MDM mdmHook `toml:"mdm"`
+
+	// Git commit of the repo metadata after each cycle config
+	RepoGit repoGit `toml:"repo_git"`
+
+	// Repo snapshot before each cycle config
+	RepoSnapshot snapshotConfig `toml:"repo_snapshot"`
+
+	// Network share the munki repo is mounted from
+	RepoMount mountConfig `toml:"repo_mount"`
+
+	// Disk space monitoring config
+	Disk diskConfig `toml:"disk"`
+
+	// Rotated log file config
+	LogFile logFileConfig `toml:"log_file"`
+
+	// Syslog config
+	Syslog syslogConfig `toml:"syslog"`
+
+	// macOS unified log config
+	OSLog osLogConfig `toml:"oslog"`
+
+	// Host and environment labels attached to every output
+	Labels labels `toml:"labels"`
+
+	// Slack config
+	Slack slack `toml:"slack"`
+
+	// Scripts which filter, rewrite or route the events posted to slack
+	ReportScripts reportScripts `toml:"report_scripts"`
+
+	// Healthcheck ping config
+	Healthcheck healthcheck `toml:"healthcheck"`
+
+	// InfluxDB config
+	InfluxDB influxDB `toml:"influxdb"`
+
+	// MunkiReport or Sal event config
+	MunkiReport munkiReport `toml:"munkireport"`
+
+	// Elasticsearch/OpenSearch config
+	Elasticsearch elasticsearch `toml:"elasticsearch"`
+
+	// Digest config
+	Digest digestConfig `toml:"digest"`
+
+	// Re-verification of the recorded installer item hashes
+	ArtifactVerification artifactVerification `toml:"artifact_verification"`
+}
+
+// maxProcessesLimit is the most autopkg processes allowed at once. Beyond it
+// the runs mostly contend for the network and the repo.
+const maxProcessesLimit = 32
+
+// defaultMaxProcesses runs one autopkg process per CPU, up to 8. Recipe runs
+// spend most of their time downloading, but unpacking and hashing the
+// downloads keeps a CPU busy.
+func defaultMaxProcesses() int {
+	n := runtime.NumCPU()
+	if n > 8 {
+		n = 8
+	}
+	return n
+}
+
+// loadConfig decodes the config file at path and fills in defaults.
+func loadConfig(path string) (Config, error) {
+	var conf Config
+	if _, err := toml.DecodeFile(path, &conf); err != nil {
+		return conf, err
+	}
+
+	if conf.AutopkgCmdPath == "" {
+		conf.AutopkgCmdPath = "/usr/local/bin/autopkg"
+	}
+
+	if conf.MakecatalogsCmdPath == "" {
+		conf.MakecatalogsCmdPath = "/usr/local/munki/makecatalogs"
+	}
+
+	if conf.MaxProcesses == 0 {
+		conf.MaxProcesses = defaultMaxProcesses()
+	}
+	if conf.MaxProcesses < 1 || conf.MaxProcesses > maxProcessesLimit {
+		return conf, fmt.Errorf("max_processes must be between 1 and %d", maxProcessesLimit)
+	}
+
+	if conf.Promotion.To != "" && conf.Promotion.From == "" {
+		conf.Promotion.From = "testing"
+	}
+	// approvals are only ever posted with the signing secret, without it
+	// nothing would be promoted.
+	if conf.Promotion.To != "" && conf.Promotion.Approve && conf.Slack.SigningSecret == "" {
+		return conf, fmt.Errorf("promotion: approve needs signing_secret in [slack]")
+	}
+
+	if err := validateVerbosity(conf.AutopkgVerbosity, conf.RecipeVerbosity); err != nil {
+		return conf, err
+	}
+
+	if err := conf.ConcurrencyGroups.validate(); err != nil {
+		return conf, err
+	}
+
+	if err := conf.RecipeTags.validate(); err != nil {
+		return conf, err
+	}
+
+	if err := conf.RecipeAllowlist.validate(); err != nil {
+		return conf, err
+	}
+
+	if err := conf.StaleRecipes.validate(); err != nil {
+		return conf, err
+	}
+
+	tmpl, err := parseReportFilename(conf.ReportFilename)
+	if err != nil {
+		return conf, err
+	}
+	conf.reportFilename = tmpl
+
+	if err := conf.Builders.validate(); err != nil {
+		return conf, err
+	}
+
+	if err := conf.RecipeArchitectures.validate(); err != nil {
+		return conf, err
+	}
+
+	if err := validateReportPush(conf.ReportPushURL); err != nil {
+		return conf, err
+	}
+
+	if err := conf.ReportScripts.validate(); err != nil {
+		return conf, err
+	}
+
+	if err := conf.Plugins.validate(); err != nil {
+		return conf, err
+	}
+
+	if err := conf.MDM.validate(); err != nil {
+		return conf, err
+	}
+
+	if err := conf.RepoSnapshot.validate(); err != nil {
+		return conf, err
+	}
+
+	if err := conf.CodeSignature.validate(); err != nil {
+		return conf, err
+	}
+
+	if err := conf.FailureAlarm.validate(); err != nil {
+		return conf, err
+	}
+
+	switch conf.Orphans {
+	case "":
+		conf.Orphans = "kill"
+	case "kill", "wait":
+	default:
+		return conf, fmt.Errorf("orphans must be kill or wait, not %q", conf.Orphans)
+	}
+
+	if conf.ExecTimeout == 0 {
+		conf.ExecTimeout = 600
+	}
+
+	// --check runs only look for new versions, they shouldn't take as long
+	// as downloading and importing one.
+	if conf.CheckTimeout == 0 {
+		conf.CheckTimeout = 300
+		if conf.ExecTimeout < conf.CheckTimeout {
+			conf.CheckTimeout = conf.ExecTimeout
+		}
+	}
+
+	if conf.CheckInterval == 0 {
+		conf.CheckInterval = 1
+	}
+	return conf, nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// serveControlSocket serves the API on a unix domain socket, for the status,
+// run, pause and resume subcommands. Access is limited by the socket's file
+// permissions rather than API tokens.
+func serveControlSocket(path string, d *daemon) error {
+	if _, err := os.Stat(path); err == nil {
+		// a socket nobody listens on is left over from an unclean shutdown.
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("control socket %s is in use by another autopkgd", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	l, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, newAPIHandler(d, false))
+}
+
+// listenPrivate listens on a unix socket at path which only this user can
+// connect to. The socket is created in a private directory and moved into
+// place once its permissions are set, as it would otherwise be open to
+// everyone the umask allows until the chmod.
+func listenPrivate(path string) (net.Listener, error) {
+	// the names are short, socket paths are limited to about 100 bytes.
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".s")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed at shutdown by its final path.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// controlClient talks HTTP to the daemon over its control socket.
+type controlClient struct {
+	http *http.Client
+}
+
+func newControlClient(socket string) *controlClient {
+	return &controlClient{http: &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+// do sends a request to the daemon and decodes the JSON response into v.
+func (c *controlClient) do(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, "http://autopkgd"+path, nil)
+	if err != nil {
+		return err
+	}
+	return c.send(req, v)
+}
+
+// post sends body as JSON to the daemon and decodes the JSON response into v.
+func (c *controlClient) post(path string, body, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", "http://autopkgd"+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.send(req, v)
+}
+
+func (c *controlClient) send(req *http.Request, v interface{}) error {
+	method, path := req.Method, req.URL.Path
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("is autopkgd running? %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s %s: %s", method, path, e.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+// runControl implements the subcommands which talk to the running daemon.
+func runControl(command string, args []string) int {
+	var (
+		flags   = flag.NewFlagSet(command, flag.ExitOnError)
+		fConfig = flags.String("config", "", "configuration file to load")
+		fSocket = flags.String("socket", "", "control socket of the daemon (default control_socket from the config)")
+	)
+	flags.Parse(args)
+
+	socket := *fSocket
+	if socket == "" {
+		conf, err := loadConfig(*fConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		socket = conf.ControlSocket
+	}
+	if socket == "" {
+		fmt.Println("you must specify control_socket in your config or pass -socket")
+		return 1
+	}
+	if command == "status" && !daemonListening(socket) {
+		fmt.Printf("autopkgd is not running, nothing listens on %s\n", socket)
+		return 1
+	}
+	c := newControlClient(socket)
+
+	var err error
+	switch command {
+	case "status":
+		err = c.printStatus()
+	case "cancel", "reset":
+		if flags.NArg() == 0 {
+			fmt.Printf("usage: autopkgd %s [-config file] recipe...\n", command)
+			return 1
+		}
+		for _, recipe := range flags.Args() {
+			if err = c.do("POST", "/recipes/"+url.PathEscape(recipe)+"/"+command, nil); err != nil {
+				break
+			}
+			if command == "cancel" {
+				fmt.Printf("cancelled %s\n", recipe)
+			} else {
+				fmt.Printf("reset the circuit of %s\n", recipe)
+			}
+		}
+	case "pause", "resume":
+		if flags.NArg() > 0 {
+			var u settingsUpdate
+			if command == "pause" {
+				u.PauseRecipes = flags.Args()
+			} else {
+				u.ResumeRecipes = flags.Args()
+			}
+			if err = c.post("/settings", u, nil); err == nil {
+				fmt.Printf("%sd %s\n", command, strings.Join(flags.Args(), ", "))
+			}
+			break
+		}
+		if err = c.do("POST", "/"+command, nil); err == nil {
+			fmt.Printf("scheduled cycles %sd\n", command)
+		}
+	case "held":
+		var items []heldItem
+		if err = c.do("GET", "/held", &items); err == nil {
+			printHeld(items)
+		}
+	case "release", "reject":
+		if flags.NArg() == 0 {
+			fmt.Printf("usage: autopkgd %s [-config file] pkginfo...\n", command)
+			return 1
+		}
+		for _, pkginfo := range flags.Args() {
+			if err = c.post("/held/"+command, map[string]string{"pkginfo": pkginfo}, nil); err != nil {
+				break
+			}
+			fmt.Printf("%sed %s\n", strings.TrimSuffix(command, "e"), pkginfo)
+		}
+	case "set":
+		var u settingsUpdate
+		if u, err = parseSettings(flags.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Println("usage: autopkgd set [-config file] [max_processes=N] [check_interval=SECONDS]")
+			return 1
+		}
+		var s settings
+		if err = c.post("/settings", u, &s); err == nil {
+			fmt.Printf("max_processes=%d check_interval=%d\n", s.MaxProcesses, s.CheckInterval)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func printHeld(items []heldItem) {
+	if len(items) == 0 {
+		fmt.Println("no imports are held")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PKGINFO\tITEM\tRELEASED INTO\tREJECTED")
+	for _, h := range items {
+		rejected := ""
+		if h.Rejected != nil {
+			rejected = h.Rejected.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", h.Pkginfo, h, strings.Join(h.Catalogs, ", "), rejected)
+	}
+	w.Flush()
+}
+
+// parseSettings parses the key=value arguments of the set subcommand.
+func parseSettings(args []string) (settingsUpdate, error) {
+	var u settingsUpdate
+	if len(args) == 0 {
+		return u, errors.New("no settings given")
+	}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return u, fmt.Errorf("invalid setting %q", arg)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return u, fmt.Errorf("invalid value for %s: %q", parts[0], parts[1])
+		}
+		switch parts[0] {
+		case "max_processes":
+			u.MaxProcesses = &n
+		case "check_interval":
+			u.CheckInterval = &n
+		default:
+			return u, fmt.Errorf("unknown setting %q", parts[0])
+		}
+	}
+	return u, u.validate()
+}
+
+func (c *controlClient) printStatus() error {
+	var (
+		queue   queueStatus
+		status  cycleStatus
+		recipes []recipeStatus
+	)
+	if err := c.do("GET", "/queue", &queue); err != nil {
+		return err
+	}
+	if err := c.do("GET", "/status", &status); err != nil {
+		return err
+	}
+	if err := c.do("GET", "/recipes", &recipes); err != nil {
+		return err
+	}
+
+	state := "running"
+	if queue.Paused {
+		state = "running, scheduled cycles paused"
+	}
+	fmt.Printf("autopkgd is %s\n", state)
+	for _, run := range queue.Running {
+		fmt.Printf("  running  %s (%v)\n", run.Recipe, time.Duration(run.Seconds*float64(time.Second)).Round(time.Second))
+	}
+	if len(queue.Queued) > 0 {
+		fmt.Printf("  waiting  %s\n", strings.Join(queue.Queued, ", "))
+	}
+	for _, skipped := range queue.Skipped {
+		fmt.Printf("  skipped  %s: %s\n", skipped.Recipe, skipped.Reason)
+	}
+	if len(queue.Pending) > 0 {
+		fmt.Printf("  %d cycle(s) queued\n", len(queue.Pending))
+	}
+	if status.End.IsZero() {
+		fmt.Println("no cycle has finished yet")
+	} else {
+		fmt.Printf("last cycle finished %s: %s\n", status.End.Local().Format("2006-01-02 15:04:05"), status.summary())
+	}
+	if len(recipes) == 0 {
+		return nil
+	}
+
+	when := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.Local().Format("2006-01-02 15:04")
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RECIPE\tLAST RUN\tRESULT\tLAST SUCCESS\tLAST FAILURE")
+	for _, r := range recipes {
+		name, last, result := r.Recipe, "-", "never run"
+		if !r.Enabled {
+			name += " (disabled)"
+		}
+		if r.LastRun != nil {
+			last, result = when(&r.LastRun.Start), r.LastRun.result()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, last, result, when(r.LastSuccess), when(r.LastFailure))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,916 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recentRuns is the number of run records the daemon keeps in memory.
+const recentRuns = 500
+
+// daemon runs cycles over the recipe list and keeps the state shared with the
+// HTTP API.
+type daemon struct {
+	// ctx is cancelled on shutdown, terminating every running command.
+	ctx       context.Context
+	conf      Config
+	slack     bool
+	check     bool
+	durations *durationTracker
+	breaker   *circuitBreaker
+	hosts     *hostLimiter
+	groups    *groupLimiter
+	disk      *diskWatcher
+	logs      *logBroker
+	approvals *approvalStore
+	workers   *workerPool
+	started   time.Time
+
+	// trigger wakes the run loop when a cycle is added to pending.
+	trigger chan struct{}
+
+	mu        sync.Mutex
+	last      map[string]runRecord
+	recent    []runRecord
+	lastCycle cycleStatus
+	progress  cycleProgress
+	// lastDigest is when the digest was last sent, or the clock of the
+	// first one started.
+	lastDigest time.Time
+	// lastSuccess and lastFailure are when each recipe last succeeded and
+	// failed.
+	lastSuccess map[string]time.Time
+	lastFailure map[string]time.Time
+	// staleAlerted are the stale recipes already alerted on, until they
+	// succeed again.
+	staleAlerted map[string]bool
+	// pending are queued cycles.
+	pending []queuedCycle
+	paused  bool
+	// checkInterval and pausedRecipes are runtime settings, ticker is the
+	// schedule of the run loop.
+	checkInterval time.Duration
+	ticker        *time.Ticker
+	pausedRecipes map[string]bool
+	// cancels cancel the running recipes.
+	cancels map[string]context.CancelFunc
+	// trustDiffs are the trust diffs of the recipes which last failed trust
+	// verification.
+	trustDiffs map[string]string
+	// pkginfos indexes the repo's pkginfo files for the running cycle.
+	pkginfos *pkginfoIndex
+	// catalogMu serializes rebuilding the catalogs, which approvals and
+	// releases do outside of cycles, whether or not repo_lock is set.
+	catalogMu sync.Mutex
+
+	// resume is the state of a cycle which was interrupted before the daemon
+	// started. It is only used by the run loop.
+	resume *cycleState
+	// repoDown is set while the repo share is unavailable, so it is only
+	// alerted on once. It is only used by the run loop.
+	repoDown bool
+	// refused are the recipes last refused by the allowlist, so they are
+	// only alerted on once. It is only used by the run loop.
+	refused string
+}
+
+// maxPending is the number of cycles which may be queued.
+const maxPending = 16
+
+// queuedCycle is a cycle waiting for the current one to finish. A nil
+// recipes slice runs the full recipe list. actor is who queued it.
+type queuedCycle struct {
+	recipes []string
+	actor   string
+	// check runs the recipes with --check, even if the daemon doesn't.
+	check bool
+}
+
+// cycleProgress describes the cycle which is currently running.
+type cycleProgress struct {
+	Running   bool                 `json:"running"`
+	Start     time.Time            `json:"start,omitempty"`
+	Total     int                  `json:"total"`
+	Completed int                  `json:"completed"`
+	Active    map[string]time.Time `json:"active"`
+	// Queued are the recipes of this cycle which have not started yet.
+	Queued []string `json:"queued"`
+	// CheckOnly is set when recipes run with --check only, e.g. because
+	// disk space is low.
+	CheckOnly bool `json:"check_only"`
+	// Skipped maps recipes which were not run this cycle to the reason.
+	Skipped map[string]string `json:"skipped"`
+}
+
+func newDaemon(ctx context.Context, conf Config, slackReport, check bool) *daemon {
+	var history []runRecord
+	if conf.HistoryFile != "" {
+		var err error
+		if history, err = readHistory(conf.HistoryFile, time.Time{}); err != nil {
+			log.Println(err)
+		}
+	}
+	d := &daemon{
+		ctx:       ctx,
+		conf:      conf,
+		slack:     slackReport,
+		check:     check,
+		durations: newDurationTracker(conf.SlowRecipes, history),
+		breaker:   newCircuitBreaker(conf.CircuitBreaker, history),
+		hosts:     newHostLimiter(conf.DownloadLimit),
+		groups:    newGroupLimiter(conf.ConcurrencyGroups),
+		disk:      newDiskWatcher(conf),
+		logs:      newLogBroker(),
+		approvals: newApprovalStore(),
+		started:   time.Now(),
+		trigger:   make(chan struct{}, 1),
+		last:      make(map[string]runRecord),
+
+		lastSuccess: make(map[string]time.Time),
+		lastFailure: make(map[string]time.Time),
+
+		staleAlerted: make(map[string]bool),
+
+		checkInterval: time.Second * conf.CheckInterval,
+		pausedRecipes: make(map[string]bool),
+		cancels:       make(map[string]context.CancelFunc),
+		trustDiffs:    make(map[string]string),
+	}
+	for _, rec := range history {
+		d.noteRun(rec)
+	}
+	if len(history) > recentRuns {
+		history = history[len(history)-recentRuns:]
+	}
+	d.recent = history
+	d.workers = newWorkerPool(conf.MaxProcesses, d.runRecipe)
+	if conf.Promotion.To != "" && conf.Promotion.Approve && !slackReport {
+		log.Println("promotion: approve is set but -slack is not, no approvals will be requested and nothing will be promoted")
+	}
+	if conf.CycleStateFile != "" {
+		var err error
+		if d.resume, err = readCycleState(conf.CycleStateFile); err != nil {
+			log.Println(err)
+		}
+	}
+	if conf.StatusFile != "" {
+		status, err := readStatus(conf.StatusFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		d.lastDigest = status.LastDigest
+	}
+	if d.lastDigest.IsZero() {
+		d.lastDigest = time.Now()
+	}
+	return d
+}
+
+// enqueue asks the run loop to run the recipes for actor once the current
+// cycle is done. It returns false if too many runs are already queued.
+func (d *daemon) enqueue(recipes []string, actor string, check bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.pending) >= maxPending {
+		return false
+	}
+	d.pending = append(d.pending, queuedCycle{recipes: recipes, actor: actor, check: check})
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// dequeue removes the next queued cycle.
+func (d *daemon) dequeue() (queuedCycle, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.pending) == 0 {
+		return queuedCycle{}, false
+	}
+	next := d.pending[0]
+	d.pending = d.pending[1:]
+	return next, true
+}
+
+// run loops through all the recipes at an interval, running queued
+// cycles in between, until the daemon's context is cancelled. Scheduled
+// cycles are skipped while the daemon is paused.
+func (d *daemon) run() {
+	d.mu.Lock()
+	d.ticker = time.NewTicker(d.checkInterval)
+	ticker := d.ticker.C
+	d.mu.Unlock()
+	lastVerify := time.Now()
+	next := queuedCycle{actor: actorSchedule}
+	if d.resume != nil {
+		log.Printf("resuming the cycle interrupted at %s with %d recipes", d.resume.Start.Format("2006-01-02 15:04"), len(d.resume.Remaining))
+		next = queuedCycle{recipes: append([]string{}, d.resume.Remaining...), actor: actorResume}
+	}
+	for {
+		recipes := next.recipes
+		if next.actor == actorSchedule && d.isPaused() {
+			log.Println("paused, skipping scheduled cycle")
+		} else {
+			if recipes == nil {
+				var err error
+				if recipes, err = readRecipes(d.conf.RecipesFile); err != nil {
+					log.Println(err)
+				}
+			}
+			d.cycle(recipes, next.actor, next.check)
+		}
+
+		d.sendDigestIfDue()
+		if interval := d.conf.ArtifactVerification.Interval * time.Second; interval != 0 && time.Since(lastVerify) >= interval {
+			lastVerify = time.Now()
+			d.verifyArtifacts()
+		}
+
+		var ok bool
+		if next, ok = d.next(ticker); !ok {
+			return
+		}
+	}
+}
+
+// next blocks until a cycle is queued or the ticker fires, and returns the
+// cycle to run next, with actorSchedule for a scheduled one. ok is false
+// once the daemon is shutting down.
+func (d *daemon) next(ticker <-chan time.Time) (cycle queuedCycle, ok bool) {
+	for {
+		if d.ctx.Err() != nil {
+			return queuedCycle{}, false
+		}
+		if cycle, ok := d.dequeue(); ok {
+			return cycle, true
+		}
+		select {
+		case <-ticker:
+			return queuedCycle{actor: actorSchedule}, true
+		case <-d.trigger:
+		case <-d.ctx.Done():
+		}
+	}
+}
+
+// cancelRecipe terminates a running recipe. It returns false if the recipe
+// is not running.
+func (d *daemon) cancelRecipe(recipe string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cancel, ok := d.cancels[recipe]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// setPaused pauses or resumes scheduled cycles.
+func (d *daemon) setPaused(paused bool) {
+	d.mu.Lock()
+	d.paused = paused
+	d.mu.Unlock()
+}
+
+func (d *daemon) isPaused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+// cycle runs the recipes for actor and reports the outcome to the
+// configured sinks. With check, or -check, the recipes run with --check.
+func (d *daemon) cycle(recipes []string, actor string, check bool) {
+	conf := d.conf
+	check = check || d.check
+	setCycleActor(actor)
+	defer setCycleActor("")
+	if !check && !d.repoAvailable() {
+		return
+	}
+	if err := conf.Healthcheck.start(); err != nil {
+		log.Println(err)
+	}
+	warnings, checkOnly := d.disk.check()
+	for _, warning := range warnings {
+		log.Println(warning)
+		if d.slack {
+			if err := postSlack(conf.Slack, warning); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	if checkOnly && !check {
+		log.Println("free disk space below check_only_free_mb, running recipes with --check only")
+	}
+	if !check && !checkOnly {
+		d.snapshotRepo()
+	}
+
+	// done blocks untill process finishes
+	done := make(chan cycleStatus)
+	go d.process(done, recipes, check || checkOnly)
+	status := <-done
+
+	d.mu.Lock()
+	status.LastDigest = d.lastDigest
+	d.lastCycle = status
+	d.mu.Unlock()
+
+	status.StaleRecipes = d.checkStale()
+	log.Println("cycle finished:", status.summary())
+	quiet := conf.QuietUnchanged && status.nothingNew()
+	if d.slack && conf.Slack.CycleSummary && !quiet {
+		if err := postSlack(conf.Slack, "Cycle finished: "+status.summary()); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := conf.Healthcheck.finish(status); err != nil {
+		log.Println(err)
+	}
+	if err := conf.InfluxDB.writeCycle(status); err != nil {
+		log.Println(err)
+	}
+	if conf.StatusFile != "" {
+		if err := writeStatus(conf.StatusFile, status); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := pushCycle(conf.ReportPushURL, conf.ReportPushToken, conf.Aggregator.node(), status); err != nil {
+		log.Println(err)
+	}
+	if !quiet {
+		conf.Plugins.cycleEnd(d.ctx, status)
+	}
+}
+
+// circuitOpened alerts that a recipe will no longer run until it is reset or
+// its probation is over.
+func (d *daemon) circuitOpened(rec runRecord) {
+	msg := fmt.Sprintf(":rotating_light: *%s* failed %d times in a row and will not run again until it is reset with `autopkgd reset %s` or %v have passed.",
+		rec.Recipe, d.conf.CircuitBreaker.Failures, rec.Recipe, time.Second*d.conf.CircuitBreaker.probation())
+	if len(rec.Failures) > 0 {
+		msg += "\nLast failure: " + rec.Failures[0].Message
+	}
+	log.Println(msg)
+	if d.slack {
+		if err := postSlack(d.conf.Slack, msg); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// noteRun updates the last runs of the recipe. d.mu must be held.
+func (d *daemon) noteRun(rec runRecord) {
+	d.last[rec.Recipe] = rec
+	switch rec.result() {
+	case "failed", "unreadable":
+		d.lastFailure[rec.Recipe] = rec.Start
+	default:
+		d.lastSuccess[rec.Recipe] = rec.Start
+		delete(d.staleAlerted, rec.Recipe)
+	}
+}
+
+// recordRun stores the outcome of a single recipe run in the configured sinks.
+func (d *daemon) recordRun(rec runRecord) {
+	conf := d.conf
+	d.mu.Lock()
+	d.noteRun(rec)
+	d.recent = append(d.recent, rec)
+	if len(d.recent) > recentRuns {
+		d.recent = d.recent[len(d.recent)-recentRuns:]
+	}
+	d.mu.Unlock()
+
+	if conf.HistoryFile != "" {
+		if err := appendHistory(conf.HistoryFile, rec); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := conf.InfluxDB.writeRun(rec); err != nil {
+		log.Println(err)
+	}
+	if err := conf.Elasticsearch.indexRun(rec); err != nil {
+		log.Println(err)
+	}
+	if err := conf.Aggregator.pushRun(rec); err != nil {
+		log.Println(err)
+	}
+}
+
+// process runs the recipes and rebuilds the catalogs if anything was imported.
+func (d *daemon) process(done chan<- cycleStatus, recipeList []string, check bool) {
+	conf, slackReport := d.conf, d.slack
+	status := cycleStatus{Start: time.Now(), Labels: outputLabels}
+
+	d.mu.Lock()
+	d.pkginfos = newPkginfoIndex(conf.MunkiRepoPath)
+	d.progress = cycleProgress{
+		Running:   true,
+		Start:     status.Start,
+		Active:    make(map[string]time.Time),
+		CheckOnly: check,
+		Skipped:   make(map[string]string),
+	}
+	var unpaused, refused []string
+	for _, recipe := range recipeList {
+		if !conf.RecipeAllowlist.allows(recipe) {
+			d.progress.Skipped[recipe] = "not in the recipe allowlist"
+			refused = append(refused, recipe)
+			continue
+		}
+		if d.pausedRecipes[recipe] {
+			d.progress.Skipped[recipe] = "paused"
+			continue
+		}
+		if ok, reason := d.breaker.allow(recipe); !ok {
+			d.progress.Skipped[recipe] = reason
+			continue
+		}
+		unpaused = append(unpaused, recipe)
+	}
+	recipeList = unpaused
+	d.progress.Total = len(recipeList)
+	d.progress.Queued = append([]string(nil), recipeList...)
+	failedBefore := make(map[string]bool)
+	for recipe, rec := range d.last {
+		failedBefore[recipe] = len(rec.Failures) > 0
+	}
+	d.mu.Unlock()
+	d.refuseRecipes(refused)
+
+	// persist the recipes which haven't finished, so an interrupted cycle
+	// can resume. Recipes cut short by a shutdown count as not finished.
+	state := cycleState{Start: status.Start, Remaining: append([]string(nil), recipeList...)}
+	resumedImports := d.resume != nil && d.resume.Imported
+	if d.resume != nil {
+		state.Imported = d.resume.Imported
+		d.resume = nil
+	}
+	d.saveCycleState(state)
+	finished := func(rec runRecord) {
+		if d.ctx.Err() != nil {
+			return
+		}
+		state.Remaining = removeString(state.Remaining, rec.Recipe)
+		state.Imported = state.Imported || len(rec.Imports) > 0 || len(rec.Duplicates) > 0
+		d.saveCycleState(state)
+	}
+	defer func() {
+		d.mu.Lock()
+		d.progress.Running = false
+		d.mu.Unlock()
+	}()
+
+	// with serialize_imports the pool only runs the check phase, which
+	// downloads in parallel. Recipes which downloaded something, or failed
+	// last time, then run one at a time to import into the repo.
+	importPhase := conf.SerializeImports && !check
+	var imports []string
+
+	// the check runs and the full runs of a cycle each have a deadline.
+	checkPhase, cancelCheck := withExecTimeout(d.ctx, time.Second*conf.CheckPhaseTimeout)
+	defer cancelCheck()
+	runPhase, cancelRun := withExecTimeout(d.ctx, time.Second*conf.ImportPhaseTimeout)
+	defer cancelRun()
+	poolPhase := runPhase
+	if check || importPhase {
+		poolPhase = checkPhase
+	}
+
+	// queue every recipe on the worker pool and collect the outcome of each
+	// run, so the decision to rebuild the catalogs is made on complete
+	// results. The feeder reports how many recipes it queued once done.
+	results := make(chan runResult, len(recipeList))
+	queued := make(chan int, 1)
+	go func() {
+		n := 0
+		for _, recipe := range recipeList {
+			if d.ctx.Err() != nil {
+				d.mu.Lock()
+				d.progress.Skipped[recipe] = "shutting down"
+				d.progress.Queued = removeString(d.progress.Queued, recipe)
+				d.mu.Unlock()
+				continue
+			}
+			d.workers.submit(job{ctx: poolPhase, recipe: recipe, check: check || importPhase, results: results})
+			n++
+		}
+		queued <- n
+	}()
+
+	// Send reports to slack if flag is enabled. The channel has room for
+	// every report, so a slow or failing webhook can't hold up the cycle.
+	var slackReports chan autopkgReport
+	if slackReport {
+		slackReports = make(chan autopkgReport, 2*len(recipeList))
+		go notifySlack(slackReports, conf.Slack, conf.ReportScripts)
+	}
+	// With the failure alarm, failed reports are held until the end of the
+	// cycle, when they are either posted or replaced by a single alert.
+	// With serialize_imports only the last run of a recipe is notified, so
+	// a new version isn't announced by both its download and its import.
+	var heldFailures []autopkgReport
+	notify := func(result runResult) {
+		rec := result.rec
+		if err := conf.MunkiReport.pushEvents(rec); err != nil {
+			log.Println(err)
+		}
+		if !conf.QuietUnchanged || rec.result() != "unchanged" {
+			conf.Plugins.runRecord(d.ctx, rec)
+		}
+		report := result.report
+		if conf.FailureAlarm.Percent > 0 && len(report.Failures) > 0 {
+			heldFailures = append(heldFailures, report)
+		} else if slackReports != nil {
+			slackReports <- report
+		}
+	}
+	for received, total := 0, -1; total < 0 || received < total; {
+		select {
+		case total = <-queued:
+		case result := <-results:
+			received++
+			if result.skipped {
+				continue
+			}
+			rec := result.rec
+			if importPhase && len(rec.Failures) == 0 && (len(rec.Downloads) > 0 || failedBefore[rec.Recipe]) {
+				imports = append(imports, rec.Recipe)
+				continue
+			}
+			notify(result)
+			status.add(rec)
+			finished(rec)
+		}
+	}
+
+	d.mu.Lock()
+	d.progress.Total += len(imports)
+	d.progress.Queued = append(d.progress.Queued, imports...)
+	d.mu.Unlock()
+	for _, recipe := range imports {
+		result := d.runRecipe(runPhase, recipe, false)
+		if result.skipped {
+			continue
+		}
+		status.add(result.rec)
+		finished(result.rec)
+		notify(result)
+	}
+	if conf.FailureAlarm.fires(status) {
+		d.systemicFailureAlert(status, heldFailures)
+		// the alert replaces the failure messages, what the runs
+		// downloaded and imported is still posted.
+		for i := range heldFailures {
+			heldFailures[i].Failures = nil
+		}
+	}
+	if slackReports != nil {
+		for _, report := range heldFailures {
+			slackReports <- report
+		}
+		close(slackReports)
+	}
+
+	// Jamf recipes don't import into the munki repo.
+	rebuild := state.Imported || status.munkiImports > 0
+	// an interrupted cycle doesn't know which pkginfo files it wrote, so
+	// it always rebuilds.
+	if rebuild && conf.IncrementalCatalogs && !resumedImports {
+		changed, catalogs, err := changedCatalogs(conf.MunkiRepoPath, status.pkginfos)
+		switch {
+		case err != nil:
+			log.Println(err)
+		case !changed:
+			log.Println("skipping makecatalogs, the imports changed no pkginfo files")
+			rebuild = false
+		default:
+			log.Printf("rebuilding catalogs, imports changed %s", strings.Join(catalogs, ", "))
+		}
+	}
+	if !check && d.ctx.Err() == nil && d.promoteItems() {
+		rebuild = true
+	}
+	if !check && d.ctx.Err() == nil && status.munkiImports > 0 && d.removeOldVersions() {
+		rebuild = true
+	}
+	if rebuild && conf.PkginfoValidation.Block && status.invalid > 0 {
+		log.Printf("not running makecatalogs, %d imported pkginfo files are invalid", status.invalid)
+		rebuild = false
+	}
+	if rebuild {
+		changes, err := d.rebuildCatalogs(d.ctx)
+		if err != nil {
+			log.Println(err)
+		}
+		status.CatalogChanges = changes
+		if err == nil {
+			d.checkTestClients(status.imports)
+			if err := conf.MDM.push(status.imports); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	if !check {
+		d.commitRepo(status)
+	}
+	if d.ctx.Err() == nil {
+		d.clearCycleState()
+	}
+
+	status.End = time.Now()
+	done <- status
+}
+
+// repoAvailable checks that the repo share is mounted and writable, alerting
+// when it becomes unavailable and again when it is back.
+func (d *daemon) repoAvailable() bool {
+	err := d.conf.RepoMount.checkMount(d.ctx, d.conf.MunkiRepoPath)
+	var alert string
+	switch {
+	case err != nil:
+		log.Println("skipping cycle:", err)
+		if !d.repoDown {
+			alert = ":warning: Skipping autopkg cycles, the munki repo is unavailable: " + err.Error()
+		}
+	case d.repoDown:
+		log.Println("munki repo available again")
+		alert = "The munki repo is available again"
+	}
+	d.repoDown = err != nil
+	if alert != "" && d.slack {
+		if err := postSlack(d.conf.Slack, alert); err != nil {
+			log.Println(err)
+		}
+	}
+	return err == nil
+}
+
+// rebuildCatalogs runs makecatalogs with the repo locked, one rebuild at a
+// time, syncs the repo and posts the catalog changes.
+func (d *daemon) rebuildCatalogs(ctx context.Context) ([]catalogChange, error) {
+	d.catalogMu.Lock()
+	defer d.catalogMu.Unlock()
+	unlock, err := d.lockRepo(ctx, false, true)
+	if err != nil {
+		return nil, fmt.Errorf("not running makecatalogs, waiting for the repo lock: %v", err)
+	}
+	defer unlock()
+	if d.conf.Mock != "" {
+		return nil, fmt.Errorf("mock mode, not running makecatalogs or syncing the repo")
+	}
+	changes, err := d.makeCatalogs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.conf.RepoSync.sync(ctx, d.conf.MunkiRepoPath, d.conf.ExecTimeout); err != nil {
+		log.Println("syncing the repo:", err)
+	}
+	if err := d.conf.GCSSync.sync(ctx, d.conf.MunkiRepoPath, d.conf.ExecTimeout); err != nil {
+		log.Println("syncing the repo to GCS:", err)
+	}
+	if err := d.conf.AzureSync.sync(ctx, d.conf.MunkiRepoPath, d.conf.ExecTimeout); err != nil {
+		log.Println("syncing the repo to Azure:", err)
+	}
+	notifyCatalogChanges(changes, d.slack, d.conf.Slack)
+	return changes, nil
+}
+
+// makeCatalogs rebuilds the catalogs and returns what changed in them, or why
+// the rebuild failed.
+func (d *daemon) makeCatalogs(ctx context.Context) ([]catalogChange, error) {
+	conf := d.conf
+	before, err := readCatalogs(conf.MunkiRepoPath)
+	if err != nil {
+		log.Println(err)
+	}
+	if conf.BuiltinMakecatalogs {
+		skipPkgCheck := false
+		for _, flag := range conf.MakecatalogsFlags {
+			skipPkgCheck = skipPkgCheck || flag == "--skip-pkg-check" || flag == "-s"
+		}
+		err = buildCatalogs(conf.MunkiRepoPath, skipPkgCheck)
+	} else {
+		err = makeCatalogs(ctx, conf.MakecatalogsCmdPath, conf.MunkiRepoPath, conf.MakecatalogsFlags, conf.ExecTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if before == nil {
+		return nil, nil
+	}
+	after, err := readCatalogs(conf.MunkiRepoPath)
+	if err != nil {
+		log.Println(err)
+		return nil, nil
+	}
+	return diffCatalogs(before, after), nil
+}
+
+// lockRepo takes the repo lock, if one is configured, for a recipe run or
+// exclusively for makecatalogs. Check only runs don't touch the repo and
+// take no lock.
+func (d *daemon) lockRepo(ctx context.Context, check, exclusive bool) (func(), error) {
+	if d.conf.RepoLock == "" || check {
+		return func() {}, nil
+	}
+	return lockRepo(ctx, d.conf.RepoLock, exclusive)
+}
+
+// runResult is the outcome of a single recipe run in a cycle.
+type runResult struct {
+	rec    runRecord
+	report autopkgReport
+	// skipped is set when the recipe was not run because the daemon is
+	// shutting down.
+	skipped bool
+}
+
+// runRecipe runs a single recipe and records the outcome. It runs on the
+// worker pool, until the phase of the cycle it belongs to is done. A panic is
+// recovered and recorded as a failure of the recipe, so the rest of the
+// cycle keeps running.
+func (d *daemon) runRecipe(phase context.Context, recipe string, check bool) (result runResult) {
+	conf := d.conf
+	if phase.Err() != nil {
+		reason := "shutting down"
+		if d.ctx.Err() == nil {
+			reason = "phase deadline passed"
+		}
+		d.mu.Lock()
+		d.progress.Skipped[recipe] = reason
+		d.progress.Queued = removeString(d.progress.Queued, recipe)
+		d.mu.Unlock()
+		return runResult{skipped: true}
+	}
+	start := time.Now()
+	ctx, cancel := context.WithCancel(phase)
+	defer cancel()
+	d.mu.Lock()
+	d.progress.Active[recipe] = start
+	d.progress.Queued = removeString(d.progress.Queued, recipe)
+	d.cancels[recipe] = cancel
+	d.mu.Unlock()
+
+	recorded := false
+	defer func() {
+		if r := recover(); r != nil {
+			stack := string(debug.Stack())
+			log.Printf("panic running %s: %v\n%s", recipe, r, stack)
+			if !recorded {
+				report := autopkgReport{Failures: []failure{{
+					Recipe:    recipe,
+					Message:   fmt.Sprintf("autopkgd panicked while running the recipe: %v", r),
+					Traceback: stack,
+				}}}
+				rec := newRunRecord(recipe, start, report)
+				d.recordRun(rec)
+				result = runResult{rec: rec, report: report}
+			}
+		}
+		d.mu.Lock()
+		delete(d.cancels, recipe)
+		delete(d.progress.Active, recipe)
+		d.progress.Completed++
+		d.mu.Unlock()
+	}()
+
+	d.logs.start(recipe)
+	report := func() autopkgReport {
+		defer d.logs.finish(recipe)
+		return d.autopkg(ctx, recipe, check)
+	}()
+
+	rec := newRunRecord(recipe, start, report)
+	rec.Check = check
+	if conf.HashArtifacts {
+		rec.Artifacts = reportArtifacts(report, conf.MunkiRepoPath)
+	}
+	rec.Slow = d.durations.observe(rec)
+	d.recordRun(rec)
+	recorded = true
+	result = runResult{rec: rec, report: report}
+	if d.breaker.observe(rec) {
+		d.circuitOpened(rec)
+	}
+	for _, f := range rec.Failures {
+		if isTrustFailure(f) {
+			d.requestTrustUpdate(recipe, f.Message, trustDiffSnippet(report.TrustDiff, report.TrustDiffURL))
+		}
+	}
+	return result
+}
+
+// autopkg runs a recipe with the repo lock held.
+func (d *daemon) autopkg(ctx context.Context, recipe string, check bool) autopkgReport {
+	conf := d.conf
+	leave, err := d.groups.acquire(ctx, recipe)
+	if err != nil {
+		log.Println(err)
+		return autopkgReport{Failures: []failure{{Recipe: recipe, Message: "waiting for its concurrency group: " + err.Error()}}}
+	}
+	defer leave()
+	release, err := d.hosts.acquire(ctx, recipe)
+	if err != nil {
+		log.Println(err)
+		return autopkgReport{Failures: []failure{{Recipe: recipe, Message: "waiting for a download slot: " + err.Error()}}}
+	}
+	defer release()
+	// Jamf recipes upload to Jamf Pro and leave the munki repo alone.
+	unlock, err := d.lockRepo(ctx, check || isJamfRecipe(recipe), false)
+	if err != nil {
+		log.Println(err)
+		return autopkgReport{Failures: []failure{{Recipe: recipe, Message: "waiting for the repo lock: " + err.Error()}}}
+	}
+	defer unlock()
+	timeout := conf.ExecTimeout
+	if check {
+		timeout = conf.CheckTimeout
+	}
+	r := conf.runnerFor(recipe)
+	verbosity := conf.verbosityOf(recipe)
+	output := func(b []byte) {
+		log.Print(string(b))
+		d.logs.publish(recipe, string(b))
+	}
+	reportPath := conf.reportFile(recipe, time.Now())
+	// verbose output would drown the daemon log, it goes to the run's own
+	// log next to its report instead.
+	if verbosity > 0 {
+		logPath := verboseLogFile(reportPath)
+		if err := mkdirAllForChild(filepath.Dir(logPath)); err != nil {
+			log.Println(err)
+		}
+		f, err := os.Create(logPath)
+		if err != nil {
+			log.Println(err)
+		} else {
+			defer f.Close()
+			log.Printf("%s: verbose autopkg output in %s", recipe, logPath)
+		}
+		output = func(b []byte) {
+			// b belongs to the caller, so the newline is written on its own
+			// rather than appended to it.
+			if f != nil {
+				f.Write(b)
+				f.Write([]byte{'\n'})
+			}
+			d.logs.publish(recipe, string(b))
+		}
+	}
+	report := runAutopkg(ctx, r, recipe, reportPath, check, verbosity, timeout, output)
+	report.Recipe = recipe
+	report.Path = reportPath
+	report.Builder = r.String()
+	report.Arch = r.architecture()
+	d.hosts.learn(recipe)
+	d.checkSignatures(recipe, &report)
+	for _, f := range report.Failures {
+		if isTrustFailure(f) {
+			report.TrustDiff = d.captureTrustDiff(ctx, recipe)
+			report.TrustDiffURL = conf.API.trustDiffURL(recipe)
+			break
+		}
+	}
+	report.VirusTotal = virusTotalResults(report, conf.VirusTotal.Threshold)
+	for _, r := range virusTotalWarnings(report.VirusTotal) {
+		log.Printf("%s: VirusTotal flagged %s: %s", recipe, r.Name, r.Ratio)
+	}
+	if !check {
+		// re-released versions are dropped before anything acts on the
+		// imports.
+		d.mu.Lock()
+		pkginfos := d.pkginfos
+		d.mu.Unlock()
+		if pkginfos == nil {
+			pkginfos = newPkginfoIndex(conf.MunkiRepoPath)
+		}
+		pkginfos.dropDuplicateImports(&report)
+		resolveIcons(conf.MunkiRepoPath, report)
+		imports := importedItems(report)
+		if len(conf.PkginfoEdits) > 0 {
+			editPkginfos(conf.PkginfoEdits, conf.MunkiRepoPath, recipe, imports)
+		}
+		if len(conf.ManifestUpdates) > 0 {
+			updateManifests(conf.ManifestUpdates, conf.MunkiRepoPath, recipe, imports)
+		}
+		if conf.PkginfoValidation.Enabled {
+			validatePkginfos(conf.MunkiRepoPath, recipe, &report)
+		}
+		if conf.ImportGate.Enabled {
+			d.holdImports(recipe, imports)
+		}
+	}
+	return report
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed web
+var webAssets embed.FS
+
+// dashboardHandler serves the embedded web UI under /ui/.
+func dashboardHandler() http.Handler {
+	sub, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(sub)))
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/template"
+	"time"
+)
+
+// digestConfig configures the periodic digest report.
+type digestConfig struct {
+	// Period is either "daily" or "weekly". An empty period disables the digest.
+	Period    string `toml:"period"`
+	Format    string `toml:"format"`
+	OutputDir string `toml:"output_dir"`
+	Slack     bool   `toml:"slack"`
+}
+
+func (c digestConfig) interval() time.Duration {
+	switch c.Period {
+	case "daily":
+		return 24 * time.Hour
+	case "weekly":
+		return 7 * 24 * time.Hour
+	}
+	return 0
+}
+
+type digestImport struct {
+	Recipe string
+	importedItem
+	Time time.Time
+}
+
+type digestFailure struct {
+	failure
+	Time time.Time
+}
+
+type digestRun struct {
+	Recipe   string
+	Duration time.Duration
+}
+
+// digest summarizes the run history over a period.
+type digest struct {
+	From     time.Time
+	To       time.Time
+	Runs     int
+	Imports  []digestImport
+	NewApps  []string
+	Failures []digestFailure
+	Slowest  []digestRun
+	// SlowRuns are runs flagged as taking much longer than usual.
+	SlowRuns []digestRun
+}
+
+const digestSlowest = 5
+
+func buildDigest(records []runRecord, from, to time.Time) digest {
+	d := digest{From: from, To: to}
+	seen := make(map[string]bool)
+	newApps := make(map[string]bool)
+	slowest := make(map[string]time.Duration)
+	for _, rec := range records {
+		if rec.Start.Before(from) {
+			for _, item := range rec.Imports {
+				seen[item.Name] = true
+			}
+			continue
+		}
+		if rec.Start.After(to) {
+			continue
+		}
+		d.Runs++
+		for _, item := range rec.Imports {
+			d.Imports = append(d.Imports, digestImport{Recipe: rec.Recipe, importedItem: item, Time: rec.Start})
+			if !seen[item.Name] {
+				newApps[item.Name] = true
+			}
+		}
+		for _, f := range rec.Failures {
+			d.Failures = append(d.Failures, digestFailure{failure: f, Time: rec.Start})
+		}
+		if rec.Slow {
+			d.SlowRuns = append(d.SlowRuns, digestRun{Recipe: rec.Recipe, Duration: rec.Duration})
+		}
+		if rec.Duration > slowest[rec.Recipe] {
+			slowest[rec.Recipe] = rec.Duration
+		}
+	}
+	for name := range newApps {
+		d.NewApps = append(d.NewApps, name)
+	}
+	sort.Strings(d.NewApps)
+	for recipe, duration := range slowest {
+		d.Slowest = append(d.Slowest, digestRun{Recipe: recipe, Duration: duration})
+	}
+	sort.Slice(d.Slowest, func(i, j int) bool { return d.Slowest[i].Duration > d.Slowest[j].Duration })
+	if len(d.Slowest) > digestSlowest {
+		d.Slowest = d.Slowest[:digestSlowest]
+	}
+	return d
+}
+
+var digestFuncs = map[string]interface{}{
+	"date": func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+}
+
+const markdownDigest = `# autopkgd digest {{date .From}} - {{date .To}}
+
+{{.Runs}} recipe runs, {{len .Imports}} imports, {{len .Failures}} failures.
+
+## Imports
+{{range .Imports}}- {{.Name}} {{.Version}} ({{.Recipe}}, {{date .Time}})
+{{else}}None.
+{{end}}
+## New apps
+{{range .NewApps}}- {{.}}
+{{else}}None.
+{{end}}
+## Failures
+{{range .Failures}}- {{.Recipe}}: {{.Message}} ({{date .Time}})
+{{else}}None.
+{{end}}
+## Slowest recipes
+{{range .Slowest}}- {{.Recipe}}: {{.Duration}}
+{{end}}{{if .SlowRuns}}
+## Unusually slow runs
+{{range .SlowRuns}}- {{.Recipe}}: {{.Duration}}
+{{end}}{{end}}`
+
+const htmlDigest = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>autopkgd digest {{date .From}} - {{date .To}}</title></head>
+<body>
+<h1>autopkgd digest {{date .From}} - {{date .To}}</h1>
+<p>{{.Runs}} recipe runs, {{len .Imports}} imports, {{len .Failures}} failures.</p>
+<h2>Imports</h2>
+<ul>{{range .Imports}}<li>{{.Name}} {{.Version}} ({{.Recipe}}, {{date .Time}})</li>{{else}}<li>None.</li>{{end}}</ul>
+<h2>New apps</h2>
+<ul>{{range .NewApps}}<li>{{.}}</li>{{else}}<li>None.</li>{{end}}</ul>
+<h2>Failures</h2>
+<ul>{{range .Failures}}<li>{{.Recipe}}: {{.Message}} ({{date .Time}})</li>{{else}}<li>None.</li>{{end}}</ul>
+<h2>Slowest recipes</h2>
+<ul>{{range .Slowest}}<li>{{.Recipe}}: {{.Duration}}</li>{{end}}</ul>
+{{if .SlowRuns}}<h2>Unusually slow runs</h2>
+<ul>{{range .SlowRuns}}<li>{{.Recipe}}: {{.Duration}}</li>{{end}}</ul>
+{{end}}</body>
+</html>
+`
+
+var (
+	markdownDigestTmpl = template.Must(template.New("digest").Funcs(digestFuncs).Parse(markdownDigest))
+	htmlDigestTmpl     = htmltemplate.Must(htmltemplate.New("digest").Funcs(digestFuncs).Parse(htmlDigest))
+)
+
+func (d digest) markdown() (string, error) {
+	var buf bytes.Buffer
+	err := markdownDigestTmpl.Execute(&buf, d)
+	return buf.String(), err
+}
+
+func (d digest) html() (string, error) {
+	var buf bytes.Buffer
+	err := htmlDigestTmpl.Execute(&buf, d)
+	return buf.String(), err
+}
+
+// sendDigestIfDue sends the digest once a period has passed since the last
+// one, and records when in the status file.
+func (d *daemon) sendDigestIfDue() {
+	period := d.conf.Digest.interval()
+	d.mu.Lock()
+	last := d.lastDigest
+	d.mu.Unlock()
+	if period == 0 || time.Since(last) < period {
+		return
+	}
+	now := time.Now()
+	if err := sendDigest(d.conf.Digest, d.conf.HistoryFile, d.slack, d.conf.Slack, now); err != nil {
+		log.Println(err)
+	}
+	d.mu.Lock()
+	d.lastDigest = now
+	d.lastCycle.LastDigest = now
+	status := d.lastCycle
+	d.mu.Unlock()
+	if d.conf.StatusFile != "" {
+		if err := writeStatus(d.conf.StatusFile, status); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// sendDigest builds the digest for the period ending at to, writes it to the
+// output directory and, with -slack, posts it to slack, depending on the
+// configuration.
+func sendDigest(conf digestConfig, historyFile string, slackReport bool, slackConfig slack, to time.Time) error {
+	records, err := readHistory(historyFile, time.Time{})
+	if err != nil {
+		return err
+	}
+	d := buildDigest(records, to.Add(-conf.interval()), to)
+
+	if conf.OutputDir != "" {
+		text, ext := "", ".md"
+		if conf.Format == "html" {
+			text, err = d.html()
+			ext = ".html"
+		} else {
+			text, err = d.markdown()
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(conf.OutputDir, 0755); err != nil {
+			return err
+		}
+		name := filepath.Join(conf.OutputDir, "digest-"+to.Format("2006-01-02")+ext)
+		if err := writeFileAtomic(name, []byte(text), 0644); err != nil {
+			return err
+		}
+	}
+
+	if conf.Slack && slackReport {
+		text, err := d.markdown()
+		if err != nil {
+			return err
+		}
+		if err := postSlack(slackConfig, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
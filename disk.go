@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// diskConfig configures free space monitoring of the volumes autopkgd writes to.
+type diskConfig struct {
+	// AutopkgCachePath defaults to ~/Library/AutoPkg/Cache.
+	AutopkgCachePath string `toml:"autopkg_cache_path"`
+	// WarnFreeMB warns when a volume has less free space than this.
+	WarnFreeMB uint64 `toml:"warn_free_mb"`
+	// CheckOnlyFreeMB runs recipes with --check only, skipping downloads and
+	// imports, when a volume has less free space than this.
+	CheckOnlyFreeMB uint64 `toml:"check_only_free_mb"`
+}
+
+// autopkgCachePath returns path, or the default AutoPkg cache if it is empty.
+func autopkgCachePath(path string) string {
+	if path != "" {
+		return path
+	}
+	if childAccount != nil {
+		return filepath.Join(childAccount.home, "Library", "AutoPkg", "Cache")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, "Library", "AutoPkg", "Cache")
+	}
+	return ""
+}
+
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// diskWatcher remembers which volumes were low on space so warnings are only
+// sent when the state changes.
+type diskWatcher struct {
+	conf  diskConfig
+	paths []string
+	low   map[string]bool
+}
+
+func newDiskWatcher(conf Config) *diskWatcher {
+	if conf.Disk.WarnFreeMB == 0 && conf.Disk.CheckOnlyFreeMB == 0 {
+		return nil
+	}
+	cache := autopkgCachePath(conf.Disk.AutopkgCachePath)
+	w := &diskWatcher{conf: conf.Disk, low: make(map[string]bool)}
+	for _, path := range []string{conf.MunkiRepoPath, cache, conf.ReportsPath} {
+		if path != "" {
+			w.paths = append(w.paths, path)
+		}
+	}
+	return w
+}
+
+// check returns warnings for volumes which newly dropped below the warning
+// threshold, and whether downloads should be skipped this cycle.
+func (w *diskWatcher) check() (warnings []string, checkOnly bool) {
+	if w == nil {
+		return nil, false
+	}
+	const mb = 1024 * 1024
+	for _, path := range w.paths {
+		free, err := freeSpace(path)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if w.conf.CheckOnlyFreeMB != 0 && free < w.conf.CheckOnlyFreeMB*mb {
+			checkOnly = true
+		}
+		low := w.conf.WarnFreeMB != 0 && free < w.conf.WarnFreeMB*mb
+		if low && !w.low[path] {
+			warnings = append(warnings, fmt.Sprintf("Low disk space: %s has %d MB free", path, free/mb))
+		}
+		w.low[path] = low
+	}
+	return warnings, checkOnly
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recipeRepoMaxAge is how long a recipe repo may go without a pull before
+// doctor warns about it.
+const recipeRepoMaxAge = 30 * 24 * time.Hour
+
+// doctorCheck is one line of the doctor's checklist.
+type doctorCheck struct {
+	name   string
+	status string // PASS, WARN or FAIL
+	detail string
+}
+
+// runDoctor implements `autopkgd doctor`, which checks the environment the
+// daemon needs and prints a pass/fail checklist.
+func runDoctor(args []string) int {
+	var (
+		flags   = flag.NewFlagSet("doctor", flag.ExitOnError)
+		fConfig = flags.String("config", "", "configuration file to load")
+	)
+	flags.Parse(args)
+
+	var checks []doctorCheck
+	check := func(name, status, format string, args ...interface{}) {
+		checks = append(checks, doctorCheck{name: name, status: status, detail: fmt.Sprintf(format, args...)})
+	}
+	result := func(name string, err error, ok string) {
+		if err != nil {
+			check(name, "FAIL", "%v", err)
+		} else {
+			check(name, "PASS", "%s", ok)
+		}
+	}
+
+	conf, err := loadConfig(*fConfig)
+	if err == nil {
+		err = checkDaemonConfig(conf)
+	}
+	result("config", err, *fConfig)
+	if err != nil {
+		return printDoctor(checks)
+	}
+	if conf.RunAs.User != "" {
+		account, err := conf.RunAs.lookup()
+		childAccount = account
+		var errs []error
+		if err == nil {
+			errs = checkChildAccess(conf.childPaths()...)
+		}
+		for _, err := range errs {
+			check("run as", "FAIL", "%v", err)
+		}
+		if len(errs) == 0 {
+			result("run as", err, "commands run as "+conf.RunAs.User)
+		}
+	}
+	recipes, err := readRecipes(conf.RecipesFile)
+	result("recipe list", err, fmt.Sprintf("%d recipes in %s", len(recipes), conf.RecipesFile))
+
+	version, err := commandOutput(conf.AutopkgCmdPath, "version")
+	result("autopkg", err, "version "+version)
+	if conf.BuiltinMakecatalogs {
+		check("munki tools", "PASS", "built-in makecatalogs")
+	} else {
+		version, err := commandOutput(conf.MakecatalogsCmdPath, "--version")
+		result("munki tools", err, "makecatalogs version "+version)
+	}
+	for _, warning := range detectTools(conf).warnings(true) {
+		check("tool versions", "WARN", "%s", warning)
+	}
+	needGit := conf.RepoGit.Commit || conf.RepoSnapshot.Method == "git"
+	if version, err := commandOutput("git", "--version"); err == nil {
+		check("git", "PASS", "%s", version)
+	} else if needGit {
+		check("git", "FAIL", "%v, needed by the repo_git or repo_snapshot config", err)
+	} else {
+		check("git", "WARN", "%v, recipe repos can't be updated", err)
+	}
+	checks = append(checks, recipeRepoChecks(conf.AutopkgCmdPath)...)
+
+	if conf.RepoMount.MountPoint != "" {
+		mounted, err := isMountPoint(conf.RepoMount.MountPoint)
+		if err == nil && !mounted {
+			err = fmt.Errorf("%s is not mounted", conf.RepoMount.MountPoint)
+		}
+		result("repo mount", err, conf.RepoMount.MountPoint+" is mounted")
+	}
+	err = checkRepoWritable(conf.MunkiRepoPath)
+	result("munki repo", err, conf.MunkiRepoPath+" is writable")
+
+	const mb = 1024 * 1024
+	for _, path := range []string{conf.MunkiRepoPath, autopkgCachePath(conf.Disk.AutopkgCachePath), conf.ReportsPath} {
+		free, err := freeSpace(path)
+		switch {
+		case err != nil:
+			check("disk space", "WARN", "%s: %v", path, err)
+		case conf.Disk.CheckOnlyFreeMB > 0 && free < conf.Disk.CheckOnlyFreeMB*mb:
+			check("disk space", "FAIL", "%s: %d MB free, below check_only_free_mb", path, free/mb)
+		case conf.Disk.WarnFreeMB > 0 && free < conf.Disk.WarnFreeMB*mb:
+			check("disk space", "WARN", "%s: %d MB free, below warn_free_mb", path, free/mb)
+		default:
+			check("disk space", "PASS", "%s: %d MB free", path, free/mb)
+		}
+	}
+
+	for _, n := range []struct{ name, url string }{
+		{"slack", conf.Slack.WebhookURL},
+		{"healthcheck", conf.Healthcheck.URL},
+		{"influxdb", conf.InfluxDB.URL},
+		{"munkireport", conf.MunkiReport.URL},
+		{"elasticsearch", conf.Elasticsearch.URL},
+		{"aggregation server", conf.Aggregator.URL},
+	} {
+		if n.url == "" {
+			continue
+		}
+		addr, err := dialURL(n.url)
+		result(n.name, err, addr+" is reachable")
+	}
+	return printDoctor(checks)
+}
+
+// printDoctor prints the checklist and returns 1 if any check failed.
+func printDoctor(checks []doctorCheck) int {
+	code := 0
+	for _, c := range checks {
+		fmt.Printf("[%s] %-18s %s\n", c.status, c.name, c.detail)
+		if c.status == "FAIL" {
+			code = 1
+		}
+	}
+	return code
+}
+
+// recipeRepoChecks warns about recipe repos which weren't updated recently,
+// as listed by autopkg repo-list.
+func recipeRepoChecks(autopkg string) []doctorCheck {
+	out, err := commandOutput(autopkg, "repo-list")
+	if err != nil {
+		return []doctorCheck{{"recipe repos", "WARN", err.Error()}}
+	}
+	var checks []doctorCheck
+	for _, line := range strings.Split(out, "\n") {
+		// lines look like "/path/to/repo (https://github.com/autopkg/recipes)".
+		dir := strings.TrimSpace(line)
+		if i := strings.Index(dir, " ("); i >= 0 {
+			dir = dir[:i]
+		}
+		if !strings.HasPrefix(dir, "/") {
+			continue
+		}
+		last, err := commandOutput("git", "-C", dir, "log", "-1", "--format=%ct")
+		var updated time.Time
+		if err == nil {
+			var sec int64
+			if sec, err = strconv.ParseInt(last, 10, 64); err == nil {
+				updated = time.Unix(sec, 0)
+			}
+		}
+		// a fetch is more recent than the last commit of a quiet repo.
+		if fi, err := os.Stat(dir + "/.git/FETCH_HEAD"); err == nil && fi.ModTime().After(updated) {
+			updated = fi.ModTime()
+		}
+		switch {
+		case updated.IsZero():
+			checks = append(checks, doctorCheck{"recipe repo", "WARN", fmt.Sprintf("%s: %v", dir, err)})
+		case time.Since(updated) > recipeRepoMaxAge:
+			checks = append(checks, doctorCheck{"recipe repo", "WARN", fmt.Sprintf("%s: not updated since %s", dir, updated.Format("2006-01-02"))})
+		default:
+			checks = append(checks, doctorCheck{"recipe repo", "PASS", fmt.Sprintf("%s: updated %s", dir, updated.Format("2006-01-02"))})
+		}
+	}
+	if len(checks) == 0 {
+		checks = append(checks, doctorCheck{"recipe repos", "WARN", "autopkg lists no recipe repos"})
+	}
+	return checks
+}
+
+// commandOutput runs a command and returns its trimmed output.
+func commandOutput(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := newCommand(ctx, name, args...)
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	auditCommand(ctx, cmd, start, err)
+	if err != nil {
+		if len(out) > 0 {
+			return "", fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(string(out)))
+		}
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// dialURL opens a TCP connection to the host of a URL.
+func dialURL(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+	return addr, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dryRun prints what a cycle of recipes, or of the recipe list if recipes is
+// nil, would do: the exact commands, their timeouts and what they wait for,
+// the work after the cycle and the notifiers which would fire. Nothing is
+// run or changed.
+func dryRun(conf Config, recipes []string, slackReport, check bool) int {
+	childResources = conf.Resources
+	if err := checkDaemonConfig(conf); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if recipes == nil {
+		var err error
+		if recipes, err = readRecipes(conf.RecipesFile); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	var history []runRecord
+	if conf.HistoryFile != "" {
+		history, _ = readHistory(conf.HistoryFile, time.Time{})
+	}
+	breaker := newCircuitBreaker(conf.CircuitBreaker, history)
+	groups := newGroupLimiter(conf.ConcurrencyGroups)
+	warnings, checkOnly := newDiskWatcher(conf).check()
+	for _, warning := range warnings {
+		fmt.Println("warning:", warning)
+	}
+	if checkOnly && !check {
+		fmt.Println("free disk space is below check_only_free_mb, recipes would run with --check only")
+		check = true
+	}
+
+	fmt.Printf("%d recipes, %d at a time:\n", len(recipes), conf.MaxProcesses)
+	timeout := conf.ExecTimeout
+	if check {
+		timeout = conf.CheckTimeout
+	}
+	for _, recipe := range recipes {
+		if !conf.RecipeAllowlist.allows(recipe) {
+			fmt.Printf("\n%s: refused, not in the recipe allowlist\n", recipe)
+			continue
+		}
+		if ok, reason := breaker.allow(recipe); !ok {
+			fmt.Printf("\n%s: skipped, %s\n", recipe, reason)
+			continue
+		}
+		r := conf.runnerFor(recipe)
+		name, args := childResources.wrap(r.autopkg(autopkgArgs(recipe, r.reportPath(recipe, conf.reportFile(recipe, time.Now())), check, conf.verbosityOf(recipe))...))
+		fmt.Printf("\n%s:\n  %s\n  timeout %v", recipe, shellQuote(name, args), time.Second*timeout)
+		if r.String() != "" {
+			fmt.Printf(", on builder %s", r)
+		}
+		if arch := conf.RecipeArchitectures.of(recipe); arch != "" {
+			fmt.Printf(", as %s", arch)
+		}
+		var g []string
+		if groups != nil {
+			g = groups.groupsOf(recipe)
+		}
+		if len(g) > 0 {
+			fmt.Printf(", concurrency groups %s", strings.Join(g, ", "))
+		}
+		if conf.RepoLock != "" && !check && !isJamfRecipe(recipe) {
+			fmt.Printf(", shared lock on %s", conf.RepoLock)
+		}
+		fmt.Println()
+		if !check {
+			var after []string
+			if len(conf.PkginfoEdits) > 0 {
+				after = append(after, "edit pkginfo")
+			}
+			if len(conf.ManifestUpdates) > 0 {
+				after = append(after, "update manifests")
+			}
+			if conf.PkginfoValidation.Enabled {
+				after = append(after, "validate pkginfo")
+			}
+			if len(after) > 0 {
+				fmt.Printf("  after an import: %s\n", strings.Join(after, ", "))
+			}
+		}
+	}
+
+	var before, after []string
+	if conf.RepoMount.MountPoint != "" {
+		before = append(before, fmt.Sprintf("check %s is mounted and the repo writable", conf.RepoMount.MountPoint))
+	}
+	if conf.RepoSnapshot.Method != "" && !check {
+		before = append(before, fmt.Sprintf("snapshot the repo metadata (%s)", conf.RepoSnapshot.Method))
+	}
+	if conf.BuiltinMakecatalogs {
+		after = append(after, "build the catalogs of "+conf.MunkiRepoPath)
+	} else {
+		name, args := childResources.wrap(conf.MakecatalogsCmdPath, makecatalogsArgs(conf.MunkiRepoPath, conf.MakecatalogsFlags))
+		after = append(after, shellQuote(name, args))
+	}
+	if conf.RepoSync.Bucket != "" {
+		after = append(after, "sync the repo to "+conf.RepoSync.Bucket)
+	}
+	if conf.GCSSync.Bucket != "" {
+		after = append(after, "sync the repo to "+conf.GCSSync.Bucket)
+	}
+	if conf.AzureSync.Account != "" {
+		after = append(after, "sync the repo to "+conf.AzureSync.destination())
+	}
+	if conf.MDM.MicroMDMURL != "" {
+		after = append(after, fmt.Sprintf("send InstallApplication of new imports to %d devices with %s", len(conf.MDM.UDIDs), conf.MDM.MicroMDMURL))
+	}
+	if conf.MDM.WebhookURL != "" {
+		after = append(after, "post new imports to "+conf.MDM.WebhookURL)
+	}
+	for _, host := range conf.TestClients.Hosts {
+		after = append(after, "check test client "+host)
+	}
+	if conf.Promotion.To != "" {
+		after = append(after, fmt.Sprintf("promote items from %s to %s after %v", conf.Promotion.From, conf.Promotion.To, time.Second*conf.Promotion.Soak))
+	}
+	if conf.Retention.Keep > 0 {
+		after = append(after, fmt.Sprintf("keep the newest %d versions of each item", conf.Retention.Keep))
+	}
+	if conf.RepoGit.Commit {
+		after = append(after, "commit the repo metadata to git")
+	}
+	printSection("\nbefore the cycle:", before)
+	if !check {
+		printSection("\nafter the cycle, if anything was imported:", after)
+	}
+
+	notifiers := dryRunNotifiers(conf, slackReport)
+	if len(notifiers) == 0 {
+		notifiers = []string{"none"}
+	}
+	printSection("\nnotifiers:", notifiers)
+	return 0
+}
+
+func printSection(title string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	fmt.Println(title)
+	for _, line := range lines {
+		fmt.Println("  " + line)
+	}
+}
+
+// dryRunNotifiers describes the configured notifiers and when they fire.
+func dryRunNotifiers(conf Config, slackReport bool) []string {
+	var notifiers []string
+	add := func(enabled bool, format string, args ...interface{}) {
+		if enabled {
+			notifiers = append(notifiers, fmt.Sprintf(format, args...))
+		}
+	}
+	add(slackReport && conf.Slack.WebhookURL != "", "slack %s: failures, downloads, imports and catalog changes", conf.Slack.Channel)
+	add(!slackReport && conf.Slack.WebhookURL != "", "slack is configured but -slack is not set")
+	add(conf.CodeSignature.WebhookURL != "", "code signature alerts to %s", conf.CodeSignature.WebhookURL)
+	add(conf.FailureAlarm.Percent > 0, "systemic failure alert when more than %d%% of the recipes fail", conf.FailureAlarm.Percent)
+	add(conf.Healthcheck.URL != "" || conf.Healthcheck.StartURL != "", "healthcheck ping at the start and end of the cycle")
+	add(conf.InfluxDB.URL != "", "InfluxDB %s: every run and cycle", conf.InfluxDB.URL)
+	add(conf.MunkiReport.URL != "", "MunkiReport %s: imports and failures", conf.MunkiReport.URL)
+	add(conf.Elasticsearch.URL != "", "Elasticsearch %s: every run", conf.Elasticsearch.URL)
+	add(conf.Aggregator.URL != "", "aggregation server %s: every run", conf.Aggregator.URL)
+	add(conf.ReportPushURL != "", "report collector %s: every cycle", conf.ReportPushURL)
+	add(conf.HistoryFile != "", "history file %s", conf.HistoryFile)
+	add(conf.StatusFile != "", "status file %s", conf.StatusFile)
+	for _, p := range conf.Plugins {
+		events := p.Events
+		if len(events) == 0 {
+			events = []string{"run", "cycle"}
+		}
+		add(true, "plugin %s %s: %s", p.Name, p.Path, strings.Join(events, ", "))
+	}
+	add(conf.Syslog.Enabled, "syslog")
+	add(conf.OSLog.Enabled, "unified log")
+	return notifiers
+}
+
+// shellSafe matches arguments which need no quoting.
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote returns the command line as it could be typed in a shell.
+func shellQuote(name string, args []string) string {
+	words := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{name}, args...) {
+		if !shellSafe.MatchString(arg) {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		words = append(words, arg)
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// pkginfoIndex maps the name and version of every pkginfo in the repo to its
+// files, relative to pkgsinfo. It is built from the repo the first time a
+// cycle needs it, and the imports of the cycle are added as they are made,
+// so the repo is walked once per cycle rather than once per recipe.
+type pkginfoIndex struct {
+	repoPath string
+
+	mu    sync.Mutex
+	built bool
+	items map[[2]string][]string
+}
+
+func newPkginfoIndex(repoPath string) *pkginfoIndex {
+	return &pkginfoIndex{repoPath: repoPath}
+}
+
+// build walks the repo unless that was done already. x.mu must be held.
+func (x *pkginfoIndex) build() error {
+	if x.built {
+		return nil
+	}
+	items := make(map[[2]string][]string)
+	err := walkPkginfos(x.repoPath, func(rel string, fi os.FileInfo, item map[string]interface{}, err error) error {
+		if err != nil {
+			return nil
+		}
+		name, _ := item["name"].(string)
+		version, _ := item["version"].(string)
+		key := [2]string{name, version}
+		items[key] = append(items[key], rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	x.items, x.built = items, true
+	return nil
+}
+
+// dropDuplicateImports removes from the report the imports of a name and
+// version which were already in the repo, such as a vendor re-releasing an
+// installer under the same version, so they aren't announced, edited or held
+// as new. The pkginfo files stay in the repo; the duplicates are kept on the
+// report.
+func (x *pkginfoIndex) dropDuplicateImports(report *autopkgReport) {
+	summary, ok := report.SummaryResults["munki_importer_summary_result"]
+	if !ok || len(summary.DataRows) == 0 {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.build(); err != nil {
+		log.Println(err)
+		return
+	}
+	imported := make(map[string]bool)
+	for _, item := range importedItems(*report) {
+		imported[item.Pkginfo] = true
+	}
+	// existing reports whether a pkginfo of name and version other than the
+	// ones this run wrote is in the repo.
+	existing := func(key [2]string) bool {
+		for _, rel := range x.items[key] {
+			if !imported[rel] {
+				return true
+			}
+		}
+		return false
+	}
+	var rows []map[string]interface{}
+	for _, row := range summary.DataRows {
+		name, _ := row["name"].(string)
+		version, _ := row["version"].(string)
+		pkginfo, _ := row["pkginfo_path"].(string)
+		key := [2]string{name, version}
+		if !existing(key) {
+			rows = append(rows, row)
+			x.items[key] = append(x.items[key], pkginfo)
+			continue
+		}
+		log.Printf("%s %s was already in the repo, not reporting %s as a new import", name, version, pkginfo)
+		report.Duplicates = append(report.Duplicates, importedItem{Name: name, Version: version, Pkginfo: pkginfo})
+	}
+	summary.DataRows = rows
+	report.SummaryResults["munki_importer_summary_result"] = summary
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// elasticsearch configures indexing every run record into an Elasticsearch or
+// OpenSearch cluster. Index is a text/template executed against the run
+// record, e.g. autopkgd-{{.Start.Format "2006.01"}}.
+type elasticsearch struct {
+	URL      string `toml:"url"`
+	Index    string `toml:"index"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	APIKey   string `toml:"api_key"`
+}
+
+var esClient = &http.Client{Timeout: 10 * time.Second}
+
+// esDocument is a run record with the fields Kibana dashboards expect.
+type esDocument struct {
+	Timestamp time.Time `json:"@timestamp"`
+	runRecord
+	Result          string  `json:"result"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+func (c elasticsearch) indexName(rec runRecord) (string, error) {
+	if c.Index == "" {
+		return "autopkgd", nil
+	}
+	tmpl, err := template.New("index").Parse(c.Index)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, rec); err != nil {
+		return "", err
+	}
+	return strings.ToLower(buf.String()), nil
+}
+
+func (c elasticsearch) indexRun(rec runRecord) error {
+	if c.URL == "" {
+		return nil
+	}
+	index, err := c.indexName(rec)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(esDocument{
+		Timestamp:       rec.Start,
+		runRecord:       rec,
+		Result:          rec.result(),
+		DurationSeconds: rec.Duration.Seconds(),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.URL, "/")+"/"+index+"/_doc", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	switch {
+	case c.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+c.APIKey)
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := esClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("elasticsearch index %s: %s: %s", index, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// killDelay is how long a cancelled command gets to exit after SIGTERM
+// before it is killed.
+const killDelay = 10 * time.Second
+
+// newCommand returns a command which runs in its own process group, with the
+// configured priority and resource limits and as the run_as account if there
+// is one. When ctx is done the whole group is sent SIGTERM, so children of
+// autopkg such as curl or installer don't outlive it.
+func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	name, args = childResources.wrap(name, args)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if childAccount != nil {
+		cmd.SysProcAttr.Credential = childAccount.credential()
+		cmd.Env = append(os.Environ(), childAccount.env()...)
+	}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = killDelay
+	return cmd
+}
+
+// withExecTimeout returns a context which is cancelled after timeout, or
+// never if timeout is 0.
+func withExecTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// runCommand runs a command until it exits or ctx is done, passing each line
+// it writes to stdout to output, asynchronously and up to maxOutputBytes. If
+// the command fails, the error includes what it wrote to stderr. The command
+// is recorded in the audit log.
+func runCommand(ctx context.Context, output func([]byte), name string, args ...string) error {
+	return runCommandEnv(ctx, nil, output, name, args...)
+}
+
+// runCommandEnv is runCommand with extra environment variables.
+func runCommandEnv(ctx context.Context, env []string, output func([]byte), name string, args ...string) error {
+	cmd := newCommand(ctx, name, args...)
+	if len(env) > 0 {
+		cmd.Env = append(cmd.Environ(), env...)
+	}
+	stderr := &limitedBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		auditCommand(ctx, cmd, start, err)
+		return err
+	}
+	children.add(cmd.Process.Pid, name)
+	defer children.remove(cmd.Process.Pid)
+
+	if output == nil {
+		output = func([]byte) {}
+	}
+	capture := newOutputCapture(output)
+	readLines(stdout, capture.add)
+	capture.close()
+
+	err = cmd.Wait()
+	auditCommand(ctx, cmd, start, err)
+	if err != nil {
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			return fmt.Errorf("%s timed out", name)
+		case context.Canceled:
+			return fmt.Errorf("%s cancelled", name)
+		}
+	}
+	if err != nil && stderr.Len() > 0 {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runExport implements the export subcommand, which writes the run history
+// in a spreadsheet friendly format.
+func runExport(args []string) int {
+	var (
+		flags   = flag.NewFlagSet("export", flag.ExitOnError)
+		fConfig = flags.String("config", "", "configuration file to load")
+		fFormat = flags.String("format", "csv", "output format: csv or json")
+		fSince  = flags.String("since", "30d", "export runs newer than this age, e.g. 12h, 30d or 4w")
+		fOutput = flags.String("o", "", "output file (default stdout)")
+	)
+	flags.Parse(args)
+
+	conf, err := loadConfig(*fConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if conf.HistoryFile == "" {
+		fmt.Fprintln(os.Stderr, "you must specify history_file in your config to export run history")
+		return 1
+	}
+
+	age, err := parseAge(*fSince)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	records, err := readHistory(conf.HistoryFile, time.Now().Add(-age))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	out := io.Writer(os.Stdout)
+	if *fOutput != "" {
+		f, err := os.Create(*fOutput)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	switch *fFormat {
+	case "csv":
+		err = exportCSV(out, records)
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(records)
+	default:
+		err = fmt.Errorf("unknown export format %q", *fFormat)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func exportCSV(w io.Writer, records []runRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"recipe", "timestamp", "result", "version", "duration_seconds"})
+	for _, rec := range records {
+		var versions []string
+		for _, item := range rec.Imports {
+			versions = append(versions, item.Version)
+		}
+		cw.Write([]string{
+			rec.Recipe,
+			rec.Start.Format(time.RFC3339),
+			rec.result(),
+			strings.Join(versions, " "),
+			strconv.FormatFloat(rec.Duration.Seconds(), 'f', 1, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// parseAge parses a duration, additionally accepting d (days) and w (weeks) units.
+func parseAge(s string) (time.Duration, error) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		return time.ParseDuration(s)
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(s, "d"), "w"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// failureAlarm configures a single alert for a cycle in which so many
+// recipes failed that the cause is likely systemic, such as an expired proxy
+// certificate or a full disk. The failure messages of the single recipes are
+// then not posted.
+type failureAlarm struct {
+	// Percent is the share of failed recipes above which the alarm fires.
+	// The alarm is disabled without it.
+	Percent int `toml:"percent"`
+	// MinRecipes is the number of recipes a cycle must have run for the
+	// alarm to fire, 5 by default, so a single failing recipe run on its
+	// own isn't systemic.
+	MinRecipes int `toml:"min_recipes"`
+	// WebhookURL and Channel are where the alert is posted, they default
+	// to the slack config. An on-call webhook gets the alert on hosts run
+	// without -slack too.
+	WebhookURL string `toml:"webhook_url"`
+	Channel    string `toml:"channel"`
+	// Mention is added to the alert, e.g. <!channel>.
+	Mention string `toml:"mention"`
+}
+
+func (a failureAlarm) validate() error {
+	if a.Percent < 0 || a.Percent > 100 {
+		return fmt.Errorf("failure_alarm: percent must be between 0 and 100")
+	}
+	if a.MinRecipes < 0 {
+		return fmt.Errorf("failure_alarm: min_recipes can't be negative")
+	}
+	return nil
+}
+
+// fires reports whether the failures of a cycle exceed the threshold.
+func (a failureAlarm) fires(status cycleStatus) bool {
+	min := a.MinRecipes
+	if min == 0 {
+		min = 5
+	}
+	if a.Percent == 0 || status.Recipes < min {
+		return false
+	}
+	return status.Failed*100 > a.Percent*status.Recipes
+}
+
+// systemicFailureAlert posts one alert for the failures of a cycle, with
+// the most common failure messages, which usually name the cause.
+func (d *daemon) systemicFailureAlert(status cycleStatus, failed []autopkgReport) {
+	conf := d.conf.FailureAlarm
+	counts := make(map[string]int)
+	for _, report := range failed {
+		for _, f := range report.Failures {
+			counts[f.Message]++
+		}
+	}
+	messages := make([]string, 0, len(counts))
+	for msg := range counts {
+		messages = append(messages, msg)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if counts[messages[i]] != counts[messages[j]] {
+			return counts[messages[i]] > counts[messages[j]]
+		}
+		return messages[i] < messages[j]
+	})
+	if len(messages) > 3 {
+		messages = messages[:3]
+	}
+	text := fmt.Sprintf(":rotating_light: *Systemic failure*: %d of %d recipes failed this cycle: %s",
+		status.Failed, status.Recipes, strings.Join(status.FailedRecipes, ", "))
+	for _, msg := range messages {
+		text += fmt.Sprintf("\n- %s (%d)", msg, counts[msg])
+	}
+	log.Println(text)
+
+	to := d.conf.Slack
+	switch {
+	case conf.WebhookURL != "":
+		to.WebhookURL = conf.WebhookURL
+	case !d.slack || to.WebhookURL == "":
+		return
+	}
+	if conf.Channel != "" {
+		to.Channel = conf.Channel
+	}
+	if conf.Mention != "" {
+		text = conf.Mention + " " + text
+	}
+	if err := postSlack(to, text); err != nil {
+		log.Println(err)
+	}
+}
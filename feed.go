@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// feedEntries is the number of entries in the Atom feed.
+const feedEntries = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    atomLink    `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title    string       `xml:"title"`
+	ID       string       `xml:"id"`
+	Updated  string       `xml:"updated"`
+	Category atomCategory `xml:"category"`
+	Content  string       `xml:"content"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// feedEntry returns the feed entry for a run which imported something or
+// failed. Other runs are not interesting to subscribers.
+func feedEntry(self string, rec runRecord) (atomEntry, bool) {
+	var title string
+	var lines []string
+	switch rec.result() {
+	case "imported":
+		var items []string
+		for _, item := range rec.Imports {
+			items = append(items, item.Name+" "+item.Version)
+		}
+		if len(items) > 0 {
+			lines = append(lines, rec.Recipe+" imported "+strings.Join(items, ", ")+" into munki.")
+		}
+		for _, r := range rec.VirusTotal {
+			line := r.Name + ": " + r.String()
+			if r.Warning {
+				line = "Warning: " + line
+			}
+			lines = append(lines, line)
+		}
+		for _, u := range rec.JamfUpdates {
+			items = append(items, u.String())
+			lines = append(lines, rec.Recipe+" updated Jamf Pro "+u.String()+".")
+		}
+		title = "Imported " + strings.Join(items, ", ")
+	case "failed", "unreadable":
+		title = "Failed: " + rec.Recipe
+		for _, f := range rec.Failures {
+			lines = append(lines, f.Message)
+		}
+	default:
+		return atomEntry{}, false
+	}
+	updated := rec.Start.Add(rec.Duration).UTC().Format(time.RFC3339)
+	return atomEntry{
+		Title:    title,
+		ID:       fmt.Sprintf("%s#%s-%d", self, rec.Recipe, rec.Start.UnixNano()),
+		Updated:  updated,
+		Category: atomCategory{Term: rec.result()},
+		Content:  strings.Join(lines, "\n"),
+	}, true
+}
+
+// handleFeed serves an Atom feed of recent imports and failures.
+func (d *daemon) handleFeed(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	d.mu.Lock()
+	recent := append([]runRecord(nil), d.recent...)
+	d.mu.Unlock()
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	self := scheme + "://" + r.Host + "/feed.atom"
+	feed := atomFeed{
+		Title:   "autopkgd imports and failures",
+		ID:      self,
+		Link:    atomLink{Href: self, Rel: "self"},
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: "autopkgd"},
+	}
+	for i := len(recent) - 1; i >= 0 && len(feed.Entries) < feedEntries; i-- {
+		if entry, ok := feedEntry(self, recent[i]); ok {
+			feed.Entries = append(feed.Entries, entry)
+		}
+	}
+	if len(feed.Entries) > 0 {
+		feed.Updated = feed.Entries[0].Updated
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(feed)
+}
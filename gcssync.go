@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// gcsSync configures copying the munki repo to a Google Cloud Storage bucket
+// with the gcloud command line tool, after the catalogs were rebuilt, for
+// repos served from GCS or Cloud CDN.
+type gcsSync struct {
+	// Bucket is the destination, e.g. gs://munki-repo or gs://bucket/repo.
+	// Sync is disabled without it.
+	Bucket     string `toml:"bucket"`
+	GcloudPath string `toml:"gcloud_path"`
+	// CredentialsFile is a service account key. Without it gcloud uses its
+	// active account, e.g. the service account of the VM.
+	CredentialsFile string `toml:"credentials_file"`
+	Project         string `toml:"project"`
+	// syncOptions, whose Exclude are regular expressions of the paths,
+	// relative to the repo.
+	syncOptions
+	// CDNURLMap is the URL map of the load balancer of a Cloud CDN whose
+	// cache is invalidated after the sync, so clients see the new catalogs at
+	// once.
+	CDNURLMap string `toml:"cdn_url_map"`
+}
+
+// sync copies the files of the repo which changed to the bucket. gcloud
+// storage rsync compares sizes and modification times, so only the new and
+// changed files are uploaded.
+func (c gcsSync) sync(ctx context.Context, repoPath string, execTimeout time.Duration) error {
+	if c.Bucket == "" {
+		return nil
+	}
+	s := syncCommand{tool: c.GcloudPath, dest: c.Bucket}
+	if s.tool == "" {
+		s.tool = "/usr/local/bin/gcloud"
+	}
+	if c.CredentialsFile != "" {
+		s.env = append(s.env, "CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE="+c.CredentialsFile)
+	}
+	var global []string
+	if c.Project != "" {
+		global = append(global, "--project", c.Project)
+	}
+
+	s.args = append([]string{"storage", "rsync", strings.TrimSuffix(repoPath, "/"), c.Bucket, "--recursive", "--no-user-output-enabled"}, global...)
+	s.args = c.flags(s.args, syncFlags{
+		delete:  "--delete-unmatched-destination-objects",
+		exclude: repeatedFlag("--exclude"),
+		dryRun:  "--dry-run",
+	})
+	if c.CDNURLMap != "" {
+		s.cdn = "the Cloud CDN cache of " + c.CDNURLMap
+		// invalidate-cdn-cache takes a single path.
+		for _, p := range invalidatedPaths {
+			args := []string{"compute", "url-maps", "invalidate-cdn-cache", c.CDNURLMap, "--path", p, "--async"}
+			s.invalidate = append(s.invalidate, append(args, global...))
+		}
+	}
+	return c.run(ctx, repoPath, execTimeout, s)
+}
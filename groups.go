@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+)
+
+// concurrencyGroups are named sets of recipes of which only one runs at a
+// time, e.g. recipes sharing a large cache. Members are recipe names or
+// patterns such as "Adobe*.munki".
+type concurrencyGroups map[string][]string
+
+// validate checks the patterns of the members.
+func (g concurrencyGroups) validate() error {
+	for name, members := range g {
+		for _, member := range members {
+			if _, err := path.Match(member, ""); err != nil {
+				return fmt.Errorf("concurrency group %s: bad pattern %q", name, member)
+			}
+		}
+	}
+	return nil
+}
+
+// groupLimiter lets a single member of each concurrency group run at once.
+// A nil limiter doesn't limit.
+type groupLimiter struct {
+	groups concurrencyGroups
+	locks  map[string]chan struct{}
+}
+
+func newGroupLimiter(groups concurrencyGroups) *groupLimiter {
+	if len(groups) == 0 {
+		return nil
+	}
+	l := &groupLimiter{groups: groups, locks: make(map[string]chan struct{})}
+	for name := range groups {
+		l.locks[name] = make(chan struct{}, 1)
+	}
+	return l
+}
+
+// groupsOf returns the groups recipe belongs to, sorted so they are always
+// taken in the same order.
+func (l *groupLimiter) groupsOf(recipe string) []string {
+	var names []string
+	for name, members := range l.groups {
+		for _, member := range members {
+			if ok, _ := path.Match(member, recipe); ok {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// acquire waits until no other member of the groups of recipe is running.
+// The returned function releases the groups.
+func (l *groupLimiter) acquire(ctx context.Context, recipe string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	var held []chan struct{}
+	release := func() {
+		for _, lock := range held {
+			<-lock
+		}
+	}
+	for _, name := range l.groupsOf(recipe) {
+		lock := l.locks[name]
+		select {
+		case lock <- struct{}{}:
+		default:
+			log.Printf("%s waiting for another recipe of concurrency group %s", recipe, name)
+			select {
+			case lock <- struct{}{}:
+			case <-ctx.Done():
+				release()
+				return nil, ctx.Err()
+			}
+		}
+		held = append(held, lock)
+	}
+	return release, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// probeTimeout bounds each health probe, so a hung network mount or a
+// deadlock fails the probe instead of hanging the load balancer.
+const probeTimeout = 5 * time.Second
+
+// withTimeout runs probe, giving up after probeTimeout.
+func withTimeout(probe func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- probe() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(probeTimeout):
+		return errors.New("timed out")
+	}
+}
+
+// handleHealthz is the liveness probe. It fails if the daemon state is
+// locked up.
+func (d *daemon) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	err := withTimeout(func() error {
+		d.mu.Lock()
+		d.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "daemon state locked: " + err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz is the readiness probe. It fails unless a cycle finished
+// within two check intervals plus the exec timeout, or the daemon started
+// less than that long ago, and the munki repo is reachable.
+func (d *daemon) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	window := 2*d.checkInterval + time.Second*d.conf.ExecTimeout
+	end := d.lastCycle.End
+	d.mu.Unlock()
+
+	checks := map[string]string{"cycle": "ok", "munki_repo": "ok"}
+	ready := true
+	switch {
+	case !end.IsZero() && time.Since(end) > window:
+		checks["cycle"] = fmt.Sprintf("last cycle finished %v ago", time.Since(end).Round(time.Second))
+		ready = false
+	case end.IsZero() && time.Since(d.started) > window:
+		checks["cycle"] = "no cycle finished since start"
+		ready = false
+	}
+	if err := withTimeout(func() error { return repoReachable(d.conf.MunkiRepoPath) }); err != nil {
+		checks["munki_repo"] = err.Error()
+		ready = false
+	}
+
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, checks)
+}
+
+func repoReachable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(path + " is not a directory")
+	}
+	return nil
+}
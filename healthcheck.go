@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthcheck configures dead man's switch pings in the style of
+// healthchecks.io. If only URL is set, the start and failure URLs are derived
+// from it by appending /start and /fail.
+type healthcheck struct {
+	URL        string `toml:"url"`
+	StartURL   string `toml:"start_url"`
+	SuccessURL string `toml:"success_url"`
+	FailureURL string `toml:"failure_url"`
+}
+
+var healthcheckClient = &http.Client{Timeout: 10 * time.Second}
+
+func (h healthcheck) endpoint(explicit, suffix string) string {
+	if explicit != "" {
+		return explicit
+	}
+	if h.URL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(h.URL, "/") + suffix
+}
+
+// start is sent when a cycle begins.
+func (h healthcheck) start() error {
+	return h.ping(h.endpoint(h.StartURL, "/start"), "")
+}
+
+// finish is sent when a cycle ends, to the failure URL if any recipe failed.
+func (h healthcheck) finish(status cycleStatus) error {
+	body := status.summary() + "\n"
+	for _, recipe := range status.FailedRecipes {
+		body += "failed: " + recipe + "\n"
+	}
+	for _, recipe := range status.SlowRecipes {
+		body += "slow: " + recipe + "\n"
+	}
+	for _, recipe := range status.StaleRecipes {
+		body += "stale: " + recipe + "\n"
+	}
+	for _, recipe := range status.VirusTotalWarnings {
+		body += "virustotal: " + recipe + "\n"
+	}
+	if status.Failed > 0 {
+		return h.ping(h.endpoint(h.FailureURL, "/fail"), body)
+	}
+	return h.ping(h.endpoint(h.SuccessURL, ""), body)
+}
+
+func (h healthcheck) ping(url, body string) error {
+	if url == "" {
+		return nil
+	}
+	resp, err := healthcheckClient.Post(url, "text/plain", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("healthcheck ping %s: %s", url, resp.Status)
+	}
+	return nil
+}
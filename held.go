@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// importGate configures holding new imports in a quarantine catalog until
+// someone releases them into the catalogs they were imported into.
+type importGate struct {
+	Enabled bool `toml:"enabled"`
+	// Catalog is where held items are, it defaults to quarantine.
+	Catalog string `toml:"catalog"`
+	// Exclude are item names or patterns which are never held.
+	Exclude []string `toml:"exclude"`
+}
+
+func (g importGate) catalog() string {
+	if g.Catalog == "" {
+		return "quarantine"
+	}
+	return g.Catalog
+}
+
+// The _metadata keys of a held pkginfo: the catalogs it is released into,
+// and when it was rejected. A released pkginfo keeps when it was released,
+// which promotion counts the soak from.
+const (
+	heldCatalogsKey = "autopkgd_held_catalogs"
+	heldRejectedKey = "autopkgd_held_rejected"
+	heldReleasedKey = "autopkgd_held_released"
+)
+
+// errNotHeld is returned when releasing or rejecting an item which isn't
+// held.
+var errNotHeld = errors.New("item is not held")
+
+// heldItem is an import waiting to be released.
+type heldItem struct {
+	// Pkginfo is the path of the pkginfo file, relative to pkgsinfo.
+	Pkginfo string `json:"pkginfo"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Catalogs are the catalogs the item is released into.
+	Catalogs []string `json:"catalogs"`
+	// Rejected is when the item was rejected, it stays held.
+	Rejected *time.Time `json:"rejected,omitempty"`
+}
+
+func (h heldItem) String() string {
+	return h.Name + " " + h.Version
+}
+
+// hold moves an imported item to the quarantine catalog, keeping its
+// catalogs in _metadata.
+func (g importGate) hold(repoPath string, item importedItem) (heldItem, error) {
+	held := heldItem{Pkginfo: item.Pkginfo, Name: item.Name, Version: item.Version}
+	err := updatePlist(filepath.Join(repoPath, "pkgsinfo", item.Pkginfo), func(pkginfo map[string]interface{}) bool {
+		catalogs, _ := pkginfo["catalogs"].([]interface{})
+		for _, c := range catalogs {
+			if c, ok := c.(string); ok && c != g.catalog() {
+				held.Catalogs = append(held.Catalogs, c)
+			}
+		}
+		metadata, ok := pkginfo["_metadata"].(map[string]interface{})
+		if !ok {
+			metadata = make(map[string]interface{})
+			pkginfo["_metadata"] = metadata
+		}
+		metadata[heldCatalogsKey] = stringsToPlist(held.Catalogs)
+		pkginfo["catalogs"] = []interface{}{g.catalog()}
+		return true
+	})
+	return held, err
+}
+
+func stringsToPlist(list []string) []interface{} {
+	values := make([]interface{}, 0, len(list))
+	for _, s := range list {
+		values = append(values, s)
+	}
+	return values
+}
+
+// heldItems returns the items of the repo which are held.
+func heldItems(repoPath string) ([]heldItem, error) {
+	items := []heldItem{}
+	err := walkPkginfos(repoPath, func(rel string, fi os.FileInfo, pkginfo map[string]interface{}, err error) error {
+		if err != nil {
+			return nil
+		}
+		if held, ok := heldFromPkginfo(rel, pkginfo); ok {
+			items = append(items, held)
+		}
+		return nil
+	})
+	return items, err
+}
+
+func heldFromPkginfo(rel string, pkginfo map[string]interface{}) (heldItem, bool) {
+	metadata, _ := pkginfo["_metadata"].(map[string]interface{})
+	catalogs, ok := metadata[heldCatalogsKey].([]interface{})
+	if !ok {
+		return heldItem{}, false
+	}
+	held := heldItem{Pkginfo: rel}
+	held.Name, _ = pkginfo["name"].(string)
+	held.Version, _ = pkginfo["version"].(string)
+	for _, c := range catalogs {
+		if c, ok := c.(string); ok {
+			held.Catalogs = append(held.Catalogs, c)
+		}
+	}
+	if t, ok := metadata[heldRejectedKey].(time.Time); ok {
+		held.Rejected = &t
+	}
+	return held, true
+}
+
+// release puts a held item back into its catalogs.
+func (g importGate) release(repoPath, rel string) (heldItem, error) {
+	var held heldItem
+	err := updatePlist(filepath.Join(repoPath, "pkgsinfo", filepath.Clean("/"+rel)), func(pkginfo map[string]interface{}) bool {
+		var ok bool
+		if held, ok = heldFromPkginfo(rel, pkginfo); !ok {
+			return false
+		}
+		pkginfo["catalogs"] = stringsToPlist(held.Catalogs)
+		metadata := pkginfo["_metadata"].(map[string]interface{})
+		delete(metadata, heldCatalogsKey)
+		delete(metadata, heldRejectedKey)
+		metadata[heldReleasedKey] = time.Now().UTC()
+		return true
+	})
+	if err == nil && held.Pkginfo == "" {
+		err = errNotHeld
+	}
+	return held, err
+}
+
+// reject marks a held item as rejected. It stays in the quarantine catalog
+// until it is removed from the repo.
+func (g importGate) reject(repoPath, rel string) (heldItem, error) {
+	var held heldItem
+	err := updatePlist(filepath.Join(repoPath, "pkgsinfo", filepath.Clean("/"+rel)), func(pkginfo map[string]interface{}) bool {
+		var ok bool
+		if held, ok = heldFromPkginfo(rel, pkginfo); !ok {
+			return false
+		}
+		pkginfo["_metadata"].(map[string]interface{})[heldRejectedKey] = time.Now().UTC()
+		return true
+	})
+	if err == nil && held.Pkginfo == "" {
+		err = errNotHeld
+	}
+	return held, err
+}
+
+// holdImports moves the items a recipe imported to the quarantine catalog
+// and asks for their release in slack.
+func (d *daemon) holdImports(recipe string, imports []importedItem) {
+	gate := d.conf.ImportGate
+	for _, item := range imports {
+		if item.Pkginfo == "" || (len(gate.Exclude) > 0 && matchAny(gate.Exclude, item.Name)) {
+			continue
+		}
+		held, err := gate.hold(d.conf.MunkiRepoPath, item)
+		if err != nil {
+			log.Printf("holding %s %s: %v", item.Name, item.Version, err)
+			continue
+		}
+		log.Printf("holding %s in %s until it is released into %s", held, gate.catalog(), strings.Join(held.Catalogs, ", "))
+		if !d.approvalsEnabled() {
+			log.Printf("slack approvals are off, release %s with `autopkgd release %s` or POST /held/release", held, held.Pkginfo)
+			continue
+		}
+		d.requestApproval(&approval{
+			Kind:    "release",
+			Subject: held.Pkginfo,
+			Text:    fmt.Sprintf("%s imported *%s* into %s. Release it into %s?", recipe, held, gate.catalog(), strings.Join(held.Catalogs, ", ")),
+			run: func(ctx context.Context) error {
+				return d.releaseHeld(ctx, held.Pkginfo)
+			},
+			rejected: func() error {
+				_, err := gate.reject(d.conf.MunkiRepoPath, held.Pkginfo)
+				return err
+			},
+		})
+	}
+}
+
+// releaseHeld releases a held item and rebuilds the catalogs. It is called
+// from slack and the API while a cycle may be running, rebuildCatalogs waits
+// for the cycle's own rebuild.
+func (d *daemon) releaseHeld(ctx context.Context, rel string) error {
+	held, err := d.conf.ImportGate.release(d.conf.MunkiRepoPath, rel)
+	if err != nil {
+		return err
+	}
+	log.Printf("released %s into %s", held, strings.Join(held.Catalogs, ", "))
+	_, err = d.rebuildCatalogs(ctx)
+	return err
+}
+
+// handleHeld lists the held items on GET /held, and releases or rejects one
+// on POST /held/release and /held/reject with {"pkginfo": "apps/Firefox-1.0.plist"}.
+func (d *daemon) handleHeld(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/held"), "/")
+	if action == "" {
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		items, err := heldItems(d.conf.MunkiRepoPath)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+	if action != "release" && action != "reject" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	var body struct {
+		Pkginfo string `json:"pkginfo"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Pkginfo == "" {
+		writeError(w, http.StatusBadRequest, "the body must be {\"pkginfo\": PATH}")
+		return
+	}
+	actor := requestPrincipal(r).Name
+	var err error
+	if action == "release" {
+		err = d.releaseHeld(withActor(d.ctx, actor), body.Pkginfo)
+	} else {
+		_, err = d.conf.ImportGate.reject(d.conf.MunkiRepoPath, body.Pkginfo)
+	}
+	switch {
+	case err == errNotHeld, os.IsNotExist(err):
+		writeError(w, http.StatusNotFound, body.Pkginfo+" is not held")
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	done := strings.TrimSuffix(action, "e") + "ed"
+	log.Printf("%s %s by %s", body.Pkginfo, done, actor)
+	if d.conf.AuditLog != "" {
+		ev := auditEvent{Actor: actor, Action: "held." + action, Item: body.Pkginfo}
+		if err := appendAudit(d.conf.AuditLog, ev); err != nil {
+			log.Println(err)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": done, "pkginfo": body.Pkginfo})
+}
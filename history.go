@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// importedItem is a single munki import from a recipe run.
+type importedItem struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Pkginfo is the path of the pkginfo file, relative to pkgsinfo.
+	Pkginfo string `json:"pkginfo,omitempty"`
+	// Icon is the path of the icon in the repo, relative to icons.
+	Icon string `json:"icon,omitempty"`
+}
+
+// runRecord is the outcome of a single recipe run, as kept in the run history.
+type runRecord struct {
+	Recipe    string         `json:"recipe"`
+	Start     time.Time      `json:"start"`
+	Duration  time.Duration  `json:"duration"`
+	Downloads []string       `json:"downloads,omitempty"`
+	Imports   []importedItem `json:"imports,omitempty"`
+	// JamfUpdates are the changes a .jss or .jamf recipe made in Jamf Pro.
+	JamfUpdates []jamfUpdate `json:"jamf_updates,omitempty"`
+	Failures    []failure    `json:"failures,omitempty"`
+	// Slow is set when the run took much longer than usual.
+	Slow bool `json:"slow,omitempty"`
+	// Check is set for runs with --check, which only look for new versions.
+	Check bool `json:"check,omitempty"`
+	// ReportUnreadable is set when autopkg left a corrupt report behind.
+	ReportUnreadable bool `json:"report_unreadable,omitempty"`
+	// InvalidPkginfos are imported pkginfo files which failed validation.
+	InvalidPkginfos []string `json:"invalid_pkginfos,omitempty"`
+	// Duplicates are imports of a name and version already in the repo,
+	// which are not counted as imports.
+	Duplicates []importedItem `json:"duplicates,omitempty"`
+	// SignatureFailures are the code signature verification failures of
+	// the run, and Quarantined the imports they moved out of the repo.
+	SignatureFailures []string       `json:"signature_failures,omitempty"`
+	Quarantined       []importedItem `json:"quarantined,omitempty"`
+	// VirusTotal are the VirusTotalAnalyzer results of the run.
+	VirusTotal []virusTotalResult `json:"virustotal,omitempty"`
+	// Builder is the remote builder the recipe ran on, empty for this Mac.
+	Builder string `json:"builder,omitempty"`
+	// Arch is the architecture the recipe was built on, empty if unknown.
+	Arch string `json:"arch,omitempty"`
+	// Report is the path of the report plist of the run.
+	Report string `json:"report,omitempty"`
+	// Tools are the autopkg and munki versions the run used.
+	Tools toolVersions `json:"tools"`
+	// Artifacts are the hashed installers and imported items, when enabled.
+	Artifacts []artifact `json:"artifacts,omitempty"`
+	// Labels name the host and environment the recipe ran in.
+	Labels labels `json:"labels,omitempty"`
+}
+
+func newRunRecord(recipe string, start time.Time, report autopkgReport) runRecord {
+	rec := runRecord{
+		Recipe:   recipe,
+		Start:    start,
+		Duration: time.Since(start),
+		Failures: report.Failures,
+		Labels:   outputLabels,
+	}
+	rec.ReportUnreadable = report.Unreadable
+	rec.InvalidPkginfos = report.InvalidPkginfos
+	rec.Duplicates = report.Duplicates
+	rec.SignatureFailures = report.SignatureFailures
+	rec.Quarantined = report.Quarantined
+	rec.VirusTotal = report.VirusTotal
+	rec.Builder = report.Builder
+	rec.Arch = report.Arch
+	rec.Report = report.Path
+	rec.Tools = tools
+	if summary, ok := report.SummaryResults["url_downloader_summary_result"]; ok {
+		for _, row := range summary.DataRows {
+			if path, ok := row["download_path"].(string); ok {
+				rec.Downloads = append(rec.Downloads, filepath.Base(path))
+			}
+		}
+	}
+	rec.Imports = importedItems(report)
+	rec.JamfUpdates = jamfUpdates(report)
+	return rec
+}
+
+// importedItems returns the items a report says were imported into munki.
+func importedItems(report autopkgReport) []importedItem {
+	var items []importedItem
+	if summary, ok := report.SummaryResults["munki_importer_summary_result"]; ok {
+		for _, row := range summary.DataRows {
+			name, _ := row["name"].(string)
+			version, _ := row["version"].(string)
+			pkginfo, _ := row["pkginfo_path"].(string)
+			icon, _ := row["icon_repo_path"].(string)
+			items = append(items, importedItem{Name: name, Version: version, Pkginfo: pkginfo, Icon: strings.TrimPrefix(icon, "icons/")})
+		}
+	}
+	return items
+}
+
+// result is a one word summary of the run outcome.
+func (r runRecord) result() string {
+	switch {
+	case r.ReportUnreadable:
+		return "unreadable"
+	case len(r.Failures) > 0:
+		return "failed"
+	case len(r.Imports) > 0, len(r.JamfUpdates) > 0:
+		return "imported"
+	case len(r.Downloads) > 0:
+		return "downloaded"
+	}
+	return "unchanged"
+}
+
+// historyMu serializes appends from concurrent workers.
+var historyMu sync.Mutex
+
+// appendHistory adds a record to the JSON lines history file at path.
+func appendHistory(path string, rec runRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	return appendLine(path, b, 0644)
+}
+
+// readHistory returns all records in the history file that started at or after since.
+// Lines which don't decode, such as one cut short by a crash mid-append, are
+// skipped and logged.
+func readHistory(path string, since time.Time) ([]runRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []runRecord
+	var line, bad int
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line++
+		var rec runRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			if bad == 0 {
+				log.Printf("%s:%d: skipping bad history record: %v", path, line, err)
+			}
+			bad++
+			continue
+		}
+		if rec.Start.Before(since) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	if bad > 1 {
+		log.Printf("%s: skipped %d bad history records", path, bad)
+	}
+	return records, scanner.Err()
+}
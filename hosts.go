@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/groob/plist"
+)
+
+// downloadLimitConfig limits how many recipes download from the same host at
+// once, so a vendor CDN doesn't throttle us.
+type downloadLimitConfig struct {
+	// PerHost is the number of recipes which may run at once against a
+	// download host. Zero disables the limit.
+	PerHost int `toml:"per_host"`
+	// AutopkgCachePath defaults to ~/Library/AutoPkg/Cache.
+	AutopkgCachePath string `toml:"autopkg_cache_path"`
+}
+
+// hostLimiter hands out per host slots for recipe runs. The host of a recipe
+// is learned from the receipts autopkg leaves in its cache, so recipes which
+// have never run aren't limited. A nil limiter doesn't limit.
+type hostLimiter struct {
+	perHost int
+	cache   string
+
+	mu    sync.Mutex
+	hosts map[string]string        // by recipe
+	slots map[string]chan struct{} // by host
+}
+
+func newHostLimiter(conf downloadLimitConfig) *hostLimiter {
+	if conf.PerHost == 0 {
+		return nil
+	}
+	return &hostLimiter{
+		perHost: conf.PerHost,
+		cache:   autopkgCachePath(conf.AutopkgCachePath),
+		hosts:   make(map[string]string),
+		slots:   make(map[string]chan struct{}),
+	}
+}
+
+// acquire waits for a slot on the download host of recipe. The returned
+// function releases it.
+func (l *hostLimiter) acquire(ctx context.Context, recipe string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	host := l.host(recipe)
+	if host == "" {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	slots, ok := l.slots[host]
+	if !ok {
+		slots = make(chan struct{}, l.perHost)
+		l.slots[host] = slots
+	}
+	l.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		log.Printf("%s waiting for a download slot on %s", recipe, host)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return func() { <-slots }, nil
+}
+
+// host returns the download host of recipe, reading it from the receipts
+// the first time.
+func (l *hostLimiter) host(recipe string) string {
+	l.mu.Lock()
+	host, ok := l.hosts[recipe]
+	l.mu.Unlock()
+	if ok {
+		return host
+	}
+	host = l.learn(recipe)
+	return host
+}
+
+// learn reads the download host of recipe from its latest receipt, which
+// picks up changes to the download URL after a run.
+func (l *hostLimiter) learn(recipe string) string {
+	if l == nil {
+		return ""
+	}
+	host, err := receiptHost(l.cache, recipe)
+	if err != nil {
+		log.Println(err)
+	}
+	l.mu.Lock()
+	l.hosts[recipe] = host
+	l.mu.Unlock()
+	return host
+}
+
+// receiptStep is a processor in an autopkg receipt.
+type receiptStep struct {
+	Processor string                 `plist:"Processor"`
+	Input     map[string]interface{} `plist:"Input"`
+}
+
+// receiptHost returns the host of the first URL a recipe's processors were
+// given in its latest receipt. Receipts are written to
+// Cache/<identifier>/receipts/<recipe>-receipt-<timestamp>.plist, the
+// timestamp sorts by time.
+func receiptHost(cache, recipe string) (string, error) {
+	receipts, err := filepath.Glob(filepath.Join(cache, "*", "receipts", recipe+"-receipt-*.plist"))
+	if err != nil || len(receipts) == 0 {
+		return "", err
+	}
+	latest := receipts[0]
+	for _, path := range receipts[1:] {
+		if filepath.Base(path) > filepath.Base(latest) {
+			latest = path
+		}
+	}
+	f, err := os.Open(latest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var steps []receiptStep
+	if err := plist.NewDecoder(f).Decode(&steps); err != nil {
+		return "", err
+	}
+	for _, step := range steps {
+		s, ok := step.Input["url"].(string)
+		if !ok {
+			continue
+		}
+		if u, err := url.Parse(s); err == nil && u.Host != "" {
+			return u.Hostname(), nil
+		}
+	}
+	return "", nil
+}
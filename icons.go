@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// resolveIcons points icon_repo_path of the import rows of a report at the
+// icon munki will show for each item: the one the import extracted, the
+// icon_name of the pkginfo, or icons/NAME.png, whichever is in the repo.
+// Rows of items without an icon lose the key and are logged, since Managed
+// Software Center then shows a generic icon.
+func resolveIcons(repoPath string, report autopkgReport) {
+	summary, ok := report.SummaryResults["munki_importer_summary_result"]
+	if !ok {
+		return
+	}
+	for _, row := range summary.DataRows {
+		name, _ := row["name"].(string)
+		var candidates []string
+		if icon, ok := row["icon_repo_path"].(string); ok && icon != "" {
+			candidates = append(candidates, icon)
+		}
+		if pkginfo, ok := row["pkginfo_path"].(string); ok && pkginfo != "" {
+			if item, err := readPkginfo(filepath.Join(repoPath, "pkgsinfo", pkginfo)); err == nil {
+				if icon, ok := item["icon_name"].(string); ok && icon != "" {
+					candidates = append(candidates, filepath.Join("icons", icon))
+				}
+			}
+		}
+		if name != "" {
+			candidates = append(candidates, filepath.Join("icons", name+".png"))
+		}
+		delete(row, "icon_repo_path")
+		for _, icon := range candidates {
+			if _, err := os.Stat(filepath.Join(repoPath, icon)); err == nil {
+				row["icon_repo_path"] = icon
+				break
+			}
+		}
+		if _, ok := row["icon_repo_path"]; !ok && name != "" {
+			log.Printf("no icon for %s in %s", name, filepath.Join(repoPath, "icons"))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// influxDB configures writing measurements to an InfluxDB server using the
+// line protocol. Version 1 servers use Database, RetentionPolicy, Username and
+// Password; version 2 servers use Org, Bucket and Token.
+type influxDB struct {
+	URL             string `toml:"url"`
+	Version         int    `toml:"version"`
+	Database        string `toml:"database"`
+	RetentionPolicy string `toml:"retention_policy"`
+	Username        string `toml:"username"`
+	Password        string `toml:"password"`
+	Org             string `toml:"org"`
+	Bucket          string `toml:"bucket"`
+	Token           string `toml:"token"`
+}
+
+var influxClient = &http.Client{Timeout: 10 * time.Second}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+// writeRun writes an autopkgd_run point for a single recipe run.
+func (c influxDB) writeRun(rec runRecord) error {
+	line := fmt.Sprintf("autopkgd_run,recipe=%s,result=%s%s duration=%f,downloads=%di,imports=%di,failures=%di %d",
+		influxTagEscaper.Replace(rec.Recipe),
+		rec.result(),
+		rec.Labels.influxTags(),
+		rec.Duration.Seconds(),
+		len(rec.Downloads),
+		len(rec.Imports),
+		len(rec.Failures),
+		rec.Start.UnixNano(),
+	)
+	return c.write(line)
+}
+
+// writeCycle writes an autopkgd_cycle point summarizing a cycle.
+func (c influxDB) writeCycle(status cycleStatus) error {
+	line := fmt.Sprintf("autopkgd_cycle%s duration=%f,recipes=%di,imported=%di,downloaded=%di,failed=%di,stale=%di %d",
+		status.Labels.influxTags(),
+		status.End.Sub(status.Start).Seconds(),
+		status.Recipes,
+		status.Imported,
+		status.Downloaded,
+		status.Failed,
+		len(status.StaleRecipes),
+		status.Start.UnixNano(),
+	)
+	return c.write(line)
+}
+
+func (c influxDB) write(lines string) error {
+	if c.URL == "" {
+		return nil
+	}
+	base := strings.TrimSuffix(c.URL, "/")
+	params := url.Values{"precision": {"ns"}}
+	var endpoint string
+	if c.Version == 2 {
+		params.Set("org", c.Org)
+		params.Set("bucket", c.Bucket)
+		endpoint = base + "/api/v2/write?" + params.Encode()
+	} else {
+		params.Set("db", c.Database)
+		if c.RetentionPolicy != "" {
+			params.Set("rp", c.RetentionPolicy)
+		}
+		endpoint = base + "/write?" + params.Encode()
+	}
+
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(lines+"\n"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if c.Version == 2 {
+		req.Header.Set("Authorization", "Token "+c.Token)
+	} else if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := influxClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("influxdb write: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import "strings"
+
+// jamfUpdate is a package, policy or group a .jss or .jamf recipe created or
+// updated in Jamf Pro.
+type jamfUpdate struct {
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+func (u jamfUpdate) String() string {
+	if u.Version != "" {
+		return u.Kind + " " + u.Name + " " + u.Version
+	}
+	return u.Kind + " " + u.Name
+}
+
+// rowString returns the first non-empty string of row under keys.
+func rowString(row map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		if s, ok := row[key].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// jamfUpdates returns what a recipe changed in Jamf Pro, from the summary of
+// JSSImporter or of the JamfUploader processors.
+func jamfUpdates(report autopkgReport) []jamfUpdate {
+	var updates []jamfUpdate
+	if summary, ok := report.SummaryResults["jss_importer_summary_result"]; ok {
+		for _, row := range summary.DataRows {
+			version := rowString(row, "Version")
+			if pkg := rowString(row, "Package"); pkg != "" {
+				updates = append(updates, jamfUpdate{Kind: "package", Name: pkg, Version: version})
+			}
+			if policy := rowString(row, "Policy"); policy != "" {
+				updates = append(updates, jamfUpdate{Kind: "policy", Name: policy})
+			}
+			for _, group := range strings.Split(rowString(row, "Groups"), ",") {
+				if group = strings.TrimSpace(group); group != "" {
+					updates = append(updates, jamfUpdate{Kind: "group", Name: group})
+				}
+			}
+		}
+	}
+	uploaders := []struct{ summary, kind string }{
+		{"jamfpackageuploader_summary_result", "package"},
+		{"jamfpolicyuploader_summary_result", "policy"},
+		{"jamfcomputergroupuploader_summary_result", "group"},
+	}
+	for _, u := range uploaders {
+		summary, ok := report.SummaryResults[u.summary]
+		if !ok {
+			continue
+		}
+		for _, row := range summary.DataRows {
+			name := rowString(row, "pkg_name", "policy", "group", "name")
+			if name != "" {
+				updates = append(updates, jamfUpdate{Kind: u.kind, Name: name, Version: rowString(row, "version")})
+			}
+		}
+	}
+	return updates
+}
+
+// isJamfRecipe reports whether a recipe imports into Jamf Pro rather than
+// munki, by its extension.
+func isJamfRecipe(recipe string) bool {
+	return strings.HasSuffix(recipe, ".jss") || strings.HasSuffix(recipe, ".jamf")
+}
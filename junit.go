@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// runOutputs are the result files `autopkgd run -output format=path`
+// writes, by format.
+type runOutputs map[string]string
+
+// parseRunOutputs parses the -output flags. junit is the only format.
+func parseRunOutputs(flags []string) (runOutputs, error) {
+	outputs := make(runOutputs)
+	for _, f := range flags {
+		format, path, ok := strings.Cut(f, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("-output %s: want format=path, e.g. junit=results.xml", f)
+		}
+		if format != "junit" {
+			return nil, fmt.Errorf("-output %s: unknown format %s", f, format)
+		}
+		outputs[format] = path
+	}
+	return outputs, nil
+}
+
+// junitTestSuite is a cycle in the JUnit XML format CI systems render: one
+// test case per recipe.
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Hostname  string          `xml:"hostname,attr,omitempty"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Skipped   *junitMessage `xml:"skipped"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitReport returns the JUnit XML of a cycle which started at start.
+// runs are the records of the recipes which ran, skipped why the others
+// didn't.
+func junitReport(start time.Time, recipes []string, runs map[string]runRecord, skipped map[string]string, hostname string) ([]byte, error) {
+	suite := junitTestSuite{
+		Name:      "autopkgd",
+		Time:      time.Since(start).Seconds(),
+		Timestamp: start.UTC().Format("2006-01-02T15:04:05"),
+		Hostname:  hostname,
+	}
+	for _, recipe := range recipes {
+		c := junitTestCase{Name: recipe, ClassName: "autopkgd.recipes"}
+		rec, ran := runs[recipe]
+		switch {
+		case !ran:
+			reason := skipped[recipe]
+			if reason == "" {
+				reason = "not run"
+			}
+			c.Skipped = &junitMessage{Message: reason}
+			suite.Skipped++
+		case rec.result() == "failed" || rec.result() == "unreadable":
+			c.Time = rec.Duration.Seconds()
+			var messages []string
+			var text []string
+			for _, f := range rec.Failures {
+				messages = append(messages, f.Message)
+				text = append(text, strings.TrimSpace(f.Message+"\n"+f.Traceback))
+			}
+			if rec.ReportUnreadable {
+				messages = append(messages, "autopkg left a corrupt report")
+			}
+			c.Failure = &junitMessage{Message: strings.Join(messages, "; "), Text: strings.Join(text, "\n\n")}
+			suite.Failures++
+		default:
+			c.Time = rec.Duration.Seconds()
+			c.SystemOut = rec.result()
+			for _, item := range rec.Imports {
+				c.SystemOut += fmt.Sprintf("\nimported %s %s", item.Name, item.Version)
+			}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	suite.Tests = len(suite.Cases)
+	b, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// labels name the machine and environment every notification, metric,
+// report and API response comes from, e.g. site = "hq" and environment =
+// "production", so the events of a fleet of autopkgd hosts can be told
+// apart. host is always set, to the hostname unless configured.
+type labels map[string]string
+
+// outputLabels are attached to everything autopkgd sends. They are set once
+// at startup from the config.
+var outputLabels labels
+
+// resolve returns the configured labels with host filled in, or nil
+// without a [labels] section, so the outputs stay as they were.
+func (l labels) resolve() labels {
+	if l == nil {
+		return nil
+	}
+	resolved := make(labels, len(l)+1)
+	for k, v := range l {
+		resolved[k] = v
+	}
+	if resolved["host"] == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "unknown"
+		}
+		resolved["host"] = host
+	}
+	return resolved
+}
+
+// keys returns the label names, host first and the rest sorted.
+func (l labels) keys() []string {
+	var keys []string
+	for k := range l {
+		if k != "host" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if _, ok := l["host"]; ok {
+		keys = append([]string{"host"}, keys...)
+	}
+	return keys
+}
+
+// String formats the labels as host=build-01,site=hq.
+func (l labels) String() string {
+	var pairs []string
+	for _, k := range l.keys() {
+		pairs = append(pairs, k+"="+l[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// prefix is the tag put in front of chat messages, e.g.
+// "[build-01 site=hq] ".
+func (l labels) prefix() string {
+	if len(l) == 0 {
+		return ""
+	}
+	parts := []string{l["host"]}
+	for _, k := range l.keys()[1:] {
+		parts = append(parts, k+"="+l[k])
+	}
+	return "[" + strings.Join(parts, " ") + "] "
+}
+
+// influxTags formats the labels as line protocol tags, with a leading
+// comma.
+func (l labels) influxTags() string {
+	var s string
+	for _, k := range l.keys() {
+		s += "," + influxTagEscaper.Replace(k) + "=" + influxTagEscaper.Replace(l[k])
+	}
+	return s
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// logFileConfig configures writing the daemon log to a file which autopkgd
+// rotates itself, so it doesn't grow forever the way a log redirected by
+// launchd does.
+type logFileConfig struct {
+	// Path is the log file. Logging to a file is disabled without it.
+	Path string `toml:"path"`
+	// MaxSizeMB and MaxAge, in seconds, rotate the file once it is larger
+	// or older. 100 MB by default, and no age limit.
+	MaxSizeMB int64         `toml:"max_size_mb"`
+	MaxAge    time.Duration `toml:"max_age"`
+	// Compress gzips the rotated files.
+	Compress bool `toml:"compress"`
+	// Keep is the number of rotated files kept, 7 by default.
+	Keep int `toml:"keep"`
+}
+
+// rotatingFile is a log file which is renamed with the time it was rotated
+// and replaced by a new one when it grows too large or old.
+type rotatingFile struct {
+	conf logFileConfig
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(conf logFileConfig) (*rotatingFile, error) {
+	if conf.MaxSizeMB == 0 {
+		conf.MaxSizeMB = 100
+	}
+	if conf.Keep == 0 {
+		conf.Keep = 7
+	}
+	r := &rotatingFile{conf: conf}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the log file for appending. The age of an existing file counts
+// from its modification time, as its creation time isn't portable.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.conf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("log_file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("log_file: %v", err)
+	}
+	r.f, r.size, r.opened = f, fi.Size(), time.Now()
+	if fi.Size() > 0 {
+		r.opened = fi.ModTime()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tooOld := r.conf.MaxAge > 0 && time.Since(r.opened) > time.Second*r.conf.MaxAge
+	if r.size > 0 && (r.size+int64(len(p)) > r.conf.MaxSizeMB<<20 || tooOld) {
+		if err := r.rotate(); err != nil {
+			// keep logging to the old file rather than lose lines.
+			fmt.Fprintln(os.Stderr, "rotating the log:", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the log file, opens a new one and prunes the rotated files
+// in the background. r.mu must be held.
+func (r *rotatingFile) rotate() error {
+	// the names have nanoseconds, so rotations within a second don't
+	// overwrite each other, and sort in time order.
+	var rotated string
+	for t := time.Now(); ; t = t.Add(time.Nanosecond) {
+		rotated = r.conf.Path + "." + t.Format("20060102-150405.000000000")
+		if !rotatedExists(rotated) {
+			break
+		}
+	}
+	if err := os.Rename(r.conf.Path, rotated); err != nil {
+		return err
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		// the old file is still open under its new name.
+		return err
+	}
+	old.Close()
+	go r.prune(rotated)
+	return nil
+}
+
+// rotatedExists reports whether a rotated file of that name, compressed or
+// not, is there already.
+func rotatedExists(name string) bool {
+	for _, path := range []string{name, name + ".gz"} {
+		if _, err := os.Lstat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// prune compresses the file just rotated and removes all but the newest
+// Keep rotated files.
+func (r *rotatingFile) prune(rotated string) {
+	if r.conf.Compress {
+		if err := gzipFile(rotated); err != nil {
+			log.Println("compressing the rotated log:", err)
+		}
+	}
+	files, err := filepath.Glob(r.conf.Path + ".*")
+	if err != nil {
+		return
+	}
+	// the timestamps sort in time order.
+	sort.Strings(files)
+	for len(files) > r.conf.Keep {
+		if err := os.Remove(files[0]); err != nil {
+			log.Println(err)
+		}
+		files = files[1:]
+	}
+}
+
+// gzipFile replaces path with path.gz.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+// setupLogging sends the standard logger to stderr and any additional
+// destinations enabled in the config.
+func setupLogging(conf Config) error {
+	writers := []io.Writer{os.Stderr}
+	if conf.LogFile.Path != "" {
+		w, err := newRotatingFile(conf.LogFile)
+		if err != nil {
+			return err
+		}
+		writers = append(writers, w)
+	}
+	if conf.Syslog.Enabled {
+		w, err := newSyslogWriter(conf.Syslog)
+		if err != nil {
+			return err
+		}
+		writers = append(writers, w)
+	}
+	if conf.OSLog.Enabled {
+		w, err := newOSLogWriter(conf.OSLog)
+		if err != nil {
+			return err
+		}
+		writers = append(writers, w)
+	}
+	log.SetOutput(io.MultiWriter(writers...))
+	return nil
+}
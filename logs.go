@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// streamLogs reads the log stream of a recipe from the daemon, calling fn
+// with each line, until the run ends or, unless follow is set, the output so
+// far was read.
+func (c *controlClient) streamLogs(ctx context.Context, recipe string, follow bool, fn func(line string)) error {
+	path := "http://autopkgd/recipes/" + url.PathEscape(recipe) + "/logs"
+	if !follow {
+		path += "?follow=false"
+	}
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	// the control client's timeout would cut the stream short.
+	client := &http.Client{Transport: c.http.Transport}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("is autopkgd running? %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", req.URL.Path, resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxLineLength+64)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "event: end":
+			return nil
+		case strings.HasPrefix(line, "data: "):
+			fn(strings.TrimPrefix(line, "data: "))
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
+
+// runLogs implements `autopkgd logs recipe`, which prints the output of the
+// latest or running run of a recipe, as captured by the daemon.
+func runLogs(args []string) int {
+	var (
+		flags   = flag.NewFlagSet("logs", flag.ExitOnError)
+		fConfig = flags.String("config", "", "configuration file to load")
+		fSocket = flags.String("socket", "", "control socket of the daemon (default control_socket from the config)")
+		fFollow = flags.Bool("f", false, "follow the output until the run finishes")
+	)
+	flags.Parse(args)
+	// allow the flags after the recipe as well, e.g. logs Firefox.munki -f.
+	if flags.NArg() > 1 {
+		rest := flags.Args()
+		flags.Parse(rest[1:])
+		if flags.NArg() == 0 {
+			flags.Parse(rest[:1])
+		}
+	}
+	if flags.NArg() != 1 {
+		fmt.Println("usage: autopkgd logs [-config file] [-f] recipe")
+		return 1
+	}
+
+	socket := *fSocket
+	if socket == "" {
+		conf, err := loadConfig(*fConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		socket = conf.ControlSocket
+	}
+	if socket == "" {
+		fmt.Println("you must specify control_socket in your config or pass -socket")
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var lines int
+	err := newControlClient(socket).streamLogs(ctx, flags.Arg(0), *fFollow, func(line string) {
+		lines++
+		fmt.Println(line)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if lines == 0 {
+		fmt.Fprintf(os.Stderr, "no output captured for %s since the daemon started\n", flags.Arg(0))
+	}
+	return 0
+}
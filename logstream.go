@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxLogLines is the number of output lines kept per recipe.
+const maxLogLines = 5000
+
+// recipeLog is the captured output of the latest run of a recipe.
+type recipeLog struct {
+	lines   []string
+	running bool
+	subs    map[chan string]bool
+}
+
+// logBroker captures autopkg output per recipe and fans it out to
+// subscribers following a run live.
+type logBroker struct {
+	mu   sync.Mutex
+	logs map[string]*recipeLog
+}
+
+func newLogBroker() *logBroker {
+	return &logBroker{logs: make(map[string]*recipeLog)}
+}
+
+// start resets the captured output of recipe for a new run.
+func (b *logBroker) start(recipe string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l, ok := b.logs[recipe]
+	if !ok {
+		l = &recipeLog{subs: make(map[chan string]bool)}
+		b.logs[recipe] = l
+	}
+	l.lines = nil
+	l.running = true
+}
+
+func (b *logBroker) publish(recipe, line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l, ok := b.logs[recipe]
+	if !ok {
+		return
+	}
+	l.lines = append(l.lines, line)
+	if len(l.lines) > maxLogLines {
+		l.lines = l.lines[len(l.lines)-maxLogLines:]
+	}
+	for ch := range l.subs {
+		// drop lines for subscribers which can't keep up.
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// finish marks the run of recipe as done and closes all subscriptions.
+func (b *logBroker) finish(recipe string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l, ok := b.logs[recipe]
+	if !ok {
+		return
+	}
+	l.running = false
+	for ch := range l.subs {
+		close(ch)
+		delete(l.subs, ch)
+	}
+}
+
+// subscribe returns the output captured so far and, if the recipe is running,
+// a channel of further lines which is closed when the run finishes. The
+// returned function cancels the subscription.
+func (b *logBroker) subscribe(recipe string) ([]string, <-chan string, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l, ok := b.logs[recipe]
+	if !ok {
+		return nil, nil, func() {}
+	}
+	backlog := append([]string(nil), l.lines...)
+	if !l.running {
+		return backlog, nil, func() {}
+	}
+	ch := make(chan string, 256)
+	l.subs[ch] = true
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if l.subs[ch] {
+			delete(l.subs, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, cancel
+}
+
+// serveLogStream streams the output of recipe as server-sent events. Each
+// line is a message event; an end event is sent when the run is finished, or
+// right after the output so far with follow=false.
+func (b *logBroker) serveLogStream(w http.ResponseWriter, r *http.Request, recipe string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	backlog, lines, cancel := b.subscribe(recipe)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, line := range backlog {
+		writeEvent(w, "", line)
+	}
+	flusher.Flush()
+	if r.URL.Query().Get("follow") == "false" {
+		lines = nil
+	}
+	for lines != nil {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				lines = nil
+				continue
+			}
+			writeEvent(w, "", line)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+	writeEvent(w, "end", "")
+	flusher.Flush()
+}
+
+func writeEvent(w http.ResponseWriter, event, data string) {
+	if event != "" {
+		fmt.Fprintf(w, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
@@ -1,18 +1,19 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
-	"sync"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/groob/plist"
-	"github.com/juju/deputy"
 )
 
 var (
@@ -20,215 +21,341 @@ var (
 	Version = "unreleased"
 )
 
-// Config autopkgd config
-type Config struct {
-	AutopkgCmdPath      string        `toml:"autopkg_path,omitempty"`
-	MakecatalogsCmdPath string        `toml:"makecatalogs_path,omitempty"`
-	RecipesFile         string        `toml:"recipes_file"`
-	MunkiRepoPath       string        `toml:"munki_repo"`
-	ReportsPath         string        `toml:"reports_path"`
-	MaxProcesses        int           `toml:"max_processes"`
-	ExecTimeout         time.Duration `toml:"autopkg_exec_timeout"`
-	CheckInterval       time.Duration `toml:"autopkg_check_interval"`
-
-	// Slack config
-	Slack slack `toml:"slack"`
+type processor struct {
+	DataRows    []map[string]interface{} `plist:"data_rows" json:"data_rows"`
+	Header      []string                 `plist:"header" json:"header"`
+	SummaryText string                   `plist:"summary_text" json:"summary_text"`
 }
 
-type processor struct {
-	DataRows    []map[string]interface{} `plist:"data_rows"`
-	Header      []string                 `plist:"header"`
-	SummaryText string                   `plist:"summary_text"`
+// failure is an entry in the failures array of an autopkg report plist.
+type failure struct {
+	Recipe    string `plist:"recipe" json:"recipe"`
+	Message   string `plist:"message" json:"message"`
+	Traceback string `plist:"traceback" json:"traceback,omitempty"`
 }
 
 type autopkgReport struct {
-	Failures       []interface{}        `plist:"failures"`
-	SummaryResults map[string]processor `plist:"summary_results"`
+	// Recipe is the recipe the report is of.
+	Recipe         string               `plist:"-" json:"recipe,omitempty"`
+	Failures       []failure            `plist:"failures" json:"failures"`
+	SummaryResults map[string]processor `plist:"summary_results" json:"summary_results"`
+	// Unreadable is set when the report plist could not be decoded.
+	Unreadable bool `plist:"-" json:"unreadable,omitempty"`
+	// InvalidPkginfos are imported pkginfo files which failed validation.
+	InvalidPkginfos []string `plist:"-" json:"invalid_pkginfos,omitempty"`
+	// Duplicates are imports of versions which were already in the repo.
+	Duplicates []importedItem `plist:"-" json:"duplicates,omitempty"`
+	// SignatureFailures are the code signature verification failures.
+	SignatureFailures []string `plist:"-" json:"signature_failures,omitempty"`
+	// Quarantined are imports moved out of the repo because their code
+	// signature didn't verify.
+	Quarantined []importedItem `plist:"-" json:"quarantined,omitempty"`
+	// TrustDiff is what changed in the parent recipes of a recipe which
+	// failed trust verification, and TrustDiffURL a link to it.
+	TrustDiff    string `plist:"-" json:"trust_diff,omitempty"`
+	TrustDiffURL string `plist:"-" json:"-"`
+	// VirusTotal are the VirusTotalAnalyzer results.
+	VirusTotal []virusTotalResult `plist:"-" json:"virustotal,omitempty"`
+	// Builder is the remote builder the recipe ran on, empty for this Mac.
+	Builder string `plist:"-" json:"builder,omitempty"`
+	// Arch is the architecture autopkg ran as, empty if unknown.
+	Arch string `plist:"-" json:"arch,omitempty"`
+	// Path is where the report plist is kept.
+	Path string `plist:"-" json:"-"`
 }
 
-func runAutopkg(recipe, reportsPath, cmdPath string, check bool, execTimeout time.Duration) autopkgReport {
-	autopkgCmd := exec.Command(cmdPath, "run", "--report-plist="+reportsPath+"/"+recipe)
-
-	if check {
-		autopkgCmd.Args = append(autopkgCmd.Args, "--check")
+// runAutopkg runs a single recipe with r and returns its report, which is
+// kept at reportPath. Each line autopkg writes to stdout is passed to output.
+// autopkg is terminated when ctx is done or after execTimeout.
+func runAutopkg(ctx context.Context, r runner, recipe, reportPath string, check bool, verbosity int, execTimeout time.Duration, output func([]byte)) autopkgReport {
+	name, args := r.autopkg(autopkgArgs(recipe, r.reportPath(recipe, reportPath), check, verbosity)...)
+	ctx, cancel := withExecTimeout(ctx, time.Second*execTimeout)
+	defer cancel()
+
+	// remove the previous report so a run which dies before writing one is
+	// not mistaken for a repeat of the last result.
+	if err := os.Remove(reportPath); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	// report_filename may put reports in subdirectories, which autopkg
+	// writes into as the run_as account.
+	if err := mkdirAllForChild(filepath.Dir(reportPath)); err != nil {
+		log.Println(err)
 	}
 
-	autopkgCmd.Args = append(autopkgCmd.Args, recipe)
-	d := deputy.Deputy{
-		Errors:    deputy.FromStderr,
-		StdoutLog: func(b []byte) { log.Print(string(b)) },
-		Timeout:   time.Second * execTimeout,
+	// autopkg exits non-zero when a recipe fails, but still writes a report
+	// describing the failure, so try to read it before giving up.
+	runErr := runCommand(ctx, output, name, args...)
+	if runErr != nil {
+		log.Println(runErr)
 	}
-	if err := d.Run(autopkgCmd); err != nil {
+	if err := r.fetchReport(ctx, recipe, reportPath); err != nil {
 		log.Println(err)
-		return autopkgReport{}
 	}
-	report, err := readReportPlist(reportsPath + "/" + recipe)
+	report, err := readReportPlist(reportPath)
 	if err != nil {
 		log.Println(err)
-		return autopkgReport{}
+		var msg string
+		switch {
+		case os.IsNotExist(err):
+			msg = "autopkg did not write a report"
+		case isReportUnreadable(err):
+			msg = "report unreadable, autopkg may have been killed while writing it: " + err.Error()
+			report.Unreadable = true
+		default:
+			msg = err.Error()
+		}
+		if runErr != nil {
+			msg += ": " + runErr.Error()
+		}
+		report.Failures = append(report.Failures, failure{Recipe: recipe, Message: msg})
+		return report
+	}
+	if runErr != nil && len(report.Failures) == 0 {
+		report.Failures = append(report.Failures, failure{Recipe: recipe, Message: runErr.Error()})
 	}
 	return report
 }
 
+// autopkgArgs returns the arguments autopkg runs a recipe with.
+func autopkgArgs(recipe, reportPath string, check bool, verbosity int) []string {
+	args := []string{"run", "--report-plist=" + reportPath}
+	if verbosity > 0 {
+		args = append(args, "-"+strings.Repeat("v", verbosity))
+	}
+
+	if check {
+		args = append(args, "--check")
+	}
+
+	return append(args, recipe)
+}
+
+// reportUnreadableError is returned when a report plist exists but cannot be
+// decoded, typically because it is truncated.
+type reportUnreadableError struct {
+	path string
+	err  error
+}
+
+func (e reportUnreadableError) Error() string {
+	return "decoding report " + e.path + ": " + e.err.Error()
+}
+
+func isReportUnreadable(err error) bool {
+	_, ok := err.(reportUnreadableError)
+	return ok
+}
+
 func readReportPlist(path string) (autopkgReport, error) {
-	r := autopkgReport{}
+	var r autopkgReport
 	f, err := os.Open(path)
 	if err != nil {
 		return r, err
 	}
 	defer f.Close()
-	return r, plist.NewDecoder(f).Decode(&r)
+	if err := plist.NewDecoder(f).Decode(&r); err != nil {
+		return autopkgReport{}, reportUnreadableError{path: path, err: err}
+	}
+	return r, nil
 }
 
-func makeCatalogs(makeCatalogsPath, repoPath string, execTimeout time.Duration) {
-	makecatalogsCmd := exec.Command(
-		makeCatalogsPath,
-		repoPath,
-	)
-	d := deputy.Deputy{
-		Errors:    deputy.FromStderr,
-		StdoutLog: func(b []byte) { log.Println(string(b)) },
-		Timeout:   time.Second * execTimeout,
-	}
-	if err := d.Run(makecatalogsCmd); err != nil {
-		log.Println(err)
-		return
-	}
+func makeCatalogs(ctx context.Context, makeCatalogsPath, repoPath string, flags []string, execTimeout time.Duration) error {
+	ctx, cancel := withExecTimeout(ctx, time.Second*execTimeout)
+	defer cancel()
+	output := func(b []byte) { log.Println(string(b)) }
+	return runCommand(ctx, output, makeCatalogsPath, makecatalogsArgs(repoPath, flags)...)
 }
 
-func process(done chan<- bool, concurrency int, slackReport, check bool, recipeFile, autopkgCmdPath, makecatalogsPath, repoPath, reportsPath string, execTimeout time.Duration, slackConfig slack) {
-	var catalogsModified bool
-	sem := make(chan int, concurrency)
-
-	// make a channel of autopkgReports and create workers
-	// close the reports channel when done
-	reports := make(chan autopkgReport)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		wg.Wait()
-		close(reports)
-	}()
-
-	// create a channel of recipes for each worker to run
-	// once the file is read, close the channel
-	recipes := make(chan string)
-	go func() {
-		defer wg.Done()
-		file, err := os.Open(recipeFile)
-		if err != nil {
+func makecatalogsArgs(repoPath string, flags []string) []string {
+	return append(append([]string{}, flags...), repoPath)
+}
+
+// notifyCatalogChanges logs the catalog changes made by makecatalogs and posts
+// them to slack as a single message.
+func notifyCatalogChanges(changes []catalogChange, slackReport bool, slackConfig slack) {
+	if len(changes) == 0 {
+		return
+	}
+	lines := []string{"Catalog changes:"}
+	for _, change := range changes {
+		log.Println("catalog:", change)
+		lines = append(lines, "- "+change.String())
+	}
+	if slackReport {
+		if err := postSlack(slackConfig, strings.Join(lines, "\n")); err != nil {
 			log.Println(err)
-			return
 		}
-		defer file.Close()
-
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			recipe := scanner.Text()
-			// ignore empty lines, comments and MakeCatalogs.munki
-			if len(recipe) == 0 || recipe == "MakeCatalogs.munki" || []byte(recipe)[0] == []byte("#")[0] {
-				continue
-			}
-			recipes <- recipe
+	}
+}
+
+func main() {
+	name, args := "daemon", os.Args[1:]
+	// without a subcommand, e.g. `autopkgd -config config.toml`, the daemon
+	// runs as it always has.
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, c := range commands {
+		if c.name == name {
+			os.Exit(c.run(args))
 		}
-		close(recipes)
-	}()
+	}
+	fmt.Fprintf(os.Stderr, "autopkgd: unknown command %q\n\n", name)
+	printUsage()
+	os.Exit(2)
+}
 
-	// Send reports to slack if flag is enabled
-	if slackReport {
-		go notifySlack(reports, slackConfig)
+// checkDaemonConfig checks the parts of the config the daemon can't run
+// without.
+func checkDaemonConfig(conf Config) error {
+	// is report path configured?
+	if conf.ReportsPath == "" {
+		return errors.New("you must specify a directory for reports to be saved in your config")
 	}
 
-	go func() {
-		for report := range reports {
-			if _, ok := report.SummaryResults["munki_importer_summary_result"]; ok {
-				catalogsModified = true
-			}
-		}
-	}()
+	// does report path exist?
+	fileInfo, err := os.Stat(conf.ReportsPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("No such file or directory: %s", conf.ReportsPath)
+	}
+	if err != nil {
+		return err
+	}
 
-	for recipe := range recipes {
-		wg.Add(1)
-		sem <- 1
-		go func(recipe string) {
-			reports <- runAutopkg(recipe, reportsPath, autopkgCmdPath, check, execTimeout)
-			wg.Done()
-			<-sem
-		}(recipe)
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("%v must be a directory", conf.ReportsPath)
 	}
 
-	if catalogsModified {
-		makeCatalogs(makecatalogsPath, repoPath, execTimeout)
+	if conf.Digest.interval() != 0 && conf.HistoryFile == "" {
+		return errors.New("the digest requires history_file to be set in your config")
 	}
+	if conf.ArtifactVerification.Interval != 0 && (conf.HistoryFile == "" || !conf.HashArtifacts) {
+		return errors.New("artifact_verification requires history_file and hash_artifacts to be set in your config")
+	}
+	return nil
+}
 
-	done <- true
+// setupRecipeRuns applies the config settings for running autopkg, in the
+// daemon or standalone.
+func setupRecipeRuns(conf Config) error {
+	if err := setupLogging(conf); err != nil {
+		return err
+	}
+	childResources = conf.Resources
+	commandAuditLog = conf.AuditLog
+	outputLabels = conf.Labels.resolve()
+	account, err := conf.RunAs.lookup()
+	if err != nil {
+		return err
+	}
+	childAccount = account
+	if conf.MaxOutputMB > 0 {
+		maxOutputBytes = conf.MaxOutputMB << 20
+	}
+	if err := checkDaemonConfig(conf); err != nil {
+		return err
+	}
+	if childAccount != nil {
+		errs := checkChildAccess(conf.childPaths()...)
+		for _, err := range errs {
+			log.Println(err)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("the run_as account %s can't write to the repo, reports or cache", childAccount.name)
+		}
+		log.Printf("running commands as %s", childAccount.name)
+	}
+	tools = detectTools(conf)
+	log.Printf("autopkg %s, munki tools %s", orNone(tools.Autopkg), orNone(tools.Munki))
+	for _, warning := range tools.warnings(conf.CheckToolReleases) {
+		log.Println(warning)
+	}
+	return nil
 }
 
-func main() {
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// runDaemon implements `autopkgd daemon`, which runs the recipes every
+// check interval until it is stopped.
+func runDaemon(args []string) int {
 	var (
-		conf     Config
-		fConfig  = flag.String("config", "", "configuration file to load")
-		fSlack   = flag.Bool("slack", false, "Send reports to slack?")
-		fCheck   = flag.Bool("check", false, "autopkg check option")
-		fVersion = flag.Bool("version", false, "display the version")
+		flags    = flag.NewFlagSet("daemon", flag.ExitOnError)
+		fConfig  = flags.String("config", "", "configuration file to load")
+		fSlack   = flags.Bool("slack", false, "Send reports to slack?")
+		fCheck   = flags.Bool("check", false, "autopkg check option")
+		fVersion = flags.Bool("version", false, "display the version")
+		fDryRun  = flags.Bool("dry-run", false, "print the commands a cycle would run and the notifiers it would use, without running anything")
+		fMock    = flags.String("mock", "", "simulate the recipe runs with the canned reports in this directory")
+		fVerbose = flags.Int("verbosity", -1, "autopkg verbosity, 0 to 4 (default autopkg_verbosity from the config)")
+		fBase    = flags.Bool("baseline", false, "first run the whole recipe list once without notifications, when deploying against an existing repo")
 	)
-	flag.Parse()
+	flags.Parse(args)
 
 	if *fVersion {
 		fmt.Printf("autopkgd - version %s\n", Version)
-		os.Exit(0)
+		return 0
 	}
 
-	if _, err := toml.DecodeFile(*fConfig, &conf); err != nil {
+	conf, err := loadConfig(*fConfig)
+	if err != nil {
 		log.Fatal(err)
 	}
-
-	if conf.AutopkgCmdPath == "" {
-		conf.AutopkgCmdPath = "/usr/local/bin/autopkg"
+	conf.Mock = *fMock
+	if *fVerbose >= 0 {
+		conf.AutopkgVerbosity = *fVerbose
 	}
-
-	if conf.MakecatalogsCmdPath == "" {
-		conf.MakecatalogsCmdPath = "/usr/local/munki/makecatalogs"
+	if err := validateVerbosity(conf.AutopkgVerbosity, nil); err != nil {
+		fmt.Println(err)
+		return 1
 	}
-
-	if conf.MaxProcesses == 0 {
-		conf.MaxProcesses = 1
+	if *fDryRun {
+		return dryRun(conf, nil, *fSlack, *fCheck)
 	}
 
-	if conf.ExecTimeout == 0 {
-		conf.ExecTimeout = 600
+	if err := setupRecipeRuns(conf); err != nil {
+		fmt.Println(err)
+		return 1
 	}
 
-	if conf.CheckInterval == 0 {
-		conf.CheckInterval = 1
-	}
+	// SIGINT and SIGTERM terminate the running recipes and stop the daemon
+	// once the cycle has wound down.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// is report path configured?
-	if conf.ReportsPath == "" {
-		fmt.Println("you must specify a directory for reports to be saved in your config")
-		os.Exit(1)
+	// a previous instance which crashed may have left autopkg running, don't
+	// let it import alongside our own runs.
+	if conf.ChildrenFile != "" {
+		if err := reapOrphans(ctx, conf.ChildrenFile, conf.Orphans == "wait"); err != nil {
+			log.Fatal(err)
+		}
+		children = newChildTracker(conf.ChildrenFile)
 	}
-
-	// does report path exist?
-	fileInfo, err := os.Stat(conf.ReportsPath)
-	if os.IsNotExist(err) {
-		fmt.Printf("No such file or directory: %s\n", conf.ReportsPath)
-		os.Exit(1)
+	// the daemon picks up the baseline runs from the history.
+	if *fBase && !runBaseline(conf, *fCheck) {
+		return 1
 	}
-
-	if !fileInfo.IsDir() {
-		fmt.Printf("%v must be a directory\n", conf.ReportsPath)
-		os.Exit(1)
+	d := newDaemon(ctx, conf, *fSlack, *fCheck)
+	if conf.ControlSocket != "" {
+		go func() {
+			log.Fatal(serveControlSocket(conf.ControlSocket, d))
+		}()
 	}
-
-	// loop through all the recipes at an interval
-	// done blocks untill process finishes
-	done := make(chan bool)
-	ticker := time.NewTicker(time.Second * conf.CheckInterval).C
-	for {
-		go process(done, conf.MaxProcesses, *fSlack, *fCheck, conf.RecipesFile, conf.AutopkgCmdPath, conf.MakecatalogsCmdPath, conf.ReportsPath, conf.ReportsPath, conf.ExecTimeout, conf.Slack)
-		<-done
-		<-ticker
+	if conf.API.Listen != "" {
+		go func() {
+			log.Fatal(serveAPI(conf.API, d))
+		}()
+	}
+	d.run()
+	log.Println("shutting down")
+	d.workers.stop()
+	if conf.ControlSocket != "" {
+		os.Remove(conf.ControlSocket)
 	}
+	return 0
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// manifestUpdate adds newly imported items to a munki manifest, for the
+// recipes and item names it matches.
+type manifestUpdate struct {
+	// Manifest is the path of the manifest, relative to manifests.
+	Manifest string `toml:"manifest"`
+	// Section defaults to optional_installs.
+	Section string   `toml:"section"`
+	Recipes []string `toml:"recipes"`
+	Names   []string `toml:"names"`
+}
+
+func (u manifestUpdate) section() string {
+	if u.Section == "" {
+		return "optional_installs"
+	}
+	return u.Section
+}
+
+// manifestsMu serializes manifest edits by concurrent recipe runs.
+var manifestsMu sync.Mutex
+
+// updateManifests adds the items a recipe imported to the manifests which
+// are configured for them.
+func updateManifests(updates []manifestUpdate, repoPath, recipe string, imports []importedItem) {
+	manifestsMu.Lock()
+	defer manifestsMu.Unlock()
+	for _, u := range updates {
+		var add []string
+		for _, item := range imports {
+			if item.Name != "" && matchAny(u.Recipes, recipe) && matchAny(u.Names, item.Name) {
+				add = append(add, item.Name)
+			}
+		}
+		if len(add) == 0 {
+			continue
+		}
+		path := filepath.Join(repoPath, "manifests", u.Manifest)
+		var added []string
+		err := updatePlist(path, func(manifest map[string]interface{}) bool {
+			section, _ := manifest[u.section()].([]interface{})
+			for _, name := range add {
+				if !hasString(section, name) {
+					section = append(section, name)
+					added = append(added, name)
+				}
+			}
+			manifest[u.section()] = section
+			return len(added) > 0
+		})
+		if err != nil {
+			log.Printf("updating manifest %s: %v", u.Manifest, err)
+			continue
+		}
+		for _, name := range added {
+			log.Printf("added %s to %s of manifest %s", name, u.section(), u.Manifest)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// mdmHook configures telling an MDM about new imports once the catalogs are
+// rebuilt, so it can push them to a pilot group of Macs. With MicroMDMURL an
+// InstallApplication command is sent to each of UDIDs; with WebhookURL the
+// imports are posted as JSON for the MDM to act on.
+type mdmHook struct {
+	// MicroMDMURL is the MicroMDM server, e.g. https://mdm.example.com,
+	// with APIKey its API key.
+	MicroMDMURL string `toml:"micromdm_url"`
+	APIKey      string `toml:"api_key"`
+	// UDIDs are the pilot devices InstallApplication is sent to.
+	UDIDs []string `toml:"udids"`
+	// ManifestURL is the app manifest InstallApplication installs, with
+	// {name} and {version} replaced by the imported item, e.g. a bootstrap
+	// package which runs managedsoftwareupdate.
+	ManifestURL string `toml:"manifest_url"`
+	// WebhookURL receives the imports, with Token as a bearer token.
+	WebhookURL string `toml:"webhook_url"`
+	Token      string `toml:"token"`
+	// Group is the pilot device group passed to the webhook.
+	Group string `toml:"group"`
+	// Names are the item names or patterns which are pushed, all of them
+	// by default.
+	Names []string `toml:"names"`
+}
+
+var mdmClient = &http.Client{Timeout: 30 * time.Second}
+
+func (c mdmHook) enabled() bool {
+	return c.MicroMDMURL != "" || c.WebhookURL != ""
+}
+
+// validate checks MicroMDM has the devices and manifest to send.
+func (c mdmHook) validate() error {
+	if c.MicroMDMURL != "" && (len(c.UDIDs) == 0 || c.ManifestURL == "") {
+		return fmt.Errorf("mdm: micromdm_url requires udids and manifest_url")
+	}
+	return nil
+}
+
+// push tells the MDM about the imports matching Names.
+func (c mdmHook) push(imports []importedItem) error {
+	var items []importedItem
+	for _, item := range imports {
+		if matchAny(c.Names, item.Name) {
+			items = append(items, item)
+		}
+	}
+	if !c.enabled() || len(items) == 0 {
+		return nil
+	}
+	if c.WebhookURL != "" {
+		if err := c.postWebhook(items); err != nil {
+			return err
+		}
+	}
+	if c.MicroMDMURL == "" {
+		return nil
+	}
+	for _, item := range items {
+		manifest := strings.NewReplacer("{name}", url.PathEscape(item.Name), "{version}", url.PathEscape(item.Version)).Replace(c.ManifestURL)
+		for _, udid := range c.UDIDs {
+			if err := c.installApplication(udid, manifest); err != nil {
+				return fmt.Errorf("micromdm: %s on %s: %v", item.Name, udid, err)
+			}
+			log.Printf("sent InstallApplication of %s %s to %s", item.Name, item.Version, udid)
+		}
+	}
+	return nil
+}
+
+// installApplication queues an InstallApplication command for a device.
+func (c mdmHook) installApplication(udid, manifestURL string) error {
+	body, err := json.Marshal(map[string]string{
+		"udid":         udid,
+		"request_type": "InstallApplication",
+		"manifest_url": manifestURL,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.MicroMDMURL, "/")+"/v1/commands", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("micromdm", c.APIKey)
+	return c.do(req)
+}
+
+// postWebhook posts the imports and the pilot group.
+func (c mdmHook) postWebhook(items []importedItem) error {
+	body, err := json.Marshal(struct {
+		Group   string         `json:"group,omitempty"`
+		Source  string         `json:"source"`
+		Imports []importedItem `json:"imports"`
+		Labels  labels         `json:"labels,omitempty"`
+	}{c.Group, aggregator{}.node(), items, outputLabels})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if err := c.do(req); err != nil {
+		return fmt.Errorf("mdm webhook: %v", err)
+	}
+	return nil
+}
+
+func (c mdmHook) do(req *http.Request) error {
+	resp, err := mdmClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mockRunner simulates recipe runs with canned report plists, so configs,
+// notifiers and schedules can be tried without autopkg or a munki repo. The
+// report of a recipe is DIR/RECIPE.plist, else DIR/default.plist, else an
+// empty report. A run takes DIR/RECIPE.delay seconds if that file exists.
+type mockRunner struct {
+	dir string
+}
+
+func (r mockRunner) autopkg(args ...string) (string, []string) {
+	return "/bin/echo", append([]string{"mock autopkg"}, args...)
+}
+
+func (r mockRunner) reportPath(recipe, local string) string {
+	return local
+}
+
+// emptyReport is the report of a mock run with nothing new.
+const emptyReport = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict><key>failures</key><array/><key>summary_results</key><dict/></dict></plist>
+`
+
+// fetchReport copies the canned report of recipe to local, after the
+// recipe's delay.
+func (r mockRunner) fetchReport(ctx context.Context, recipe, local string) error {
+	if b, err := ioutil.ReadFile(filepath.Join(r.dir, recipe+".delay")); err == nil {
+		if d, err := time.ParseDuration(strings.TrimSpace(string(b)) + "s"); err == nil {
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	report := []byte(emptyReport)
+	for _, name := range []string{recipe + ".plist", "default.plist"} {
+		b, err := ioutil.ReadFile(filepath.Join(r.dir, name))
+		if err == nil {
+			report = b
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return ioutil.WriteFile(local, report, 0644)
+}
+
+func (r mockRunner) String() string { return "" }
+
+func (r mockRunner) architecture() string { return hostArch() }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// mountConfig configures checking that a munki repo on a network share is
+// mounted and writable before each cycle.
+type mountConfig struct {
+	// MountPoint is where the share is mounted, e.g. /Volumes/munki_repo.
+	// The check is disabled without it.
+	MountPoint string `toml:"mount_point"`
+	// RemountCommand is run when the share isn't mounted, e.g.
+	// ["/sbin/mount", "-t", "smbfs", "//autopkg@files/munki", "/Volumes/munki"].
+	RemountCommand []string `toml:"remount_command"`
+}
+
+// isMountPoint reports whether path is the root of a mounted file system:
+// it is on another device than its parent.
+func isMountPoint(path string) (bool, error) {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(filepath.Dir(filepath.Clean(path)), &parent); err != nil {
+		return false, err
+	}
+	return st.Dev != parent.Dev, nil
+}
+
+// checkRepoWritable creates and removes a file in the repo.
+func checkRepoWritable(repoPath string) error {
+	f, err := ioutil.TempFile(repoPath, ".autopkgd-write-test")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkMount returns why the repo can't be used, trying to remount the share
+// once if it isn't mounted. A hung network share fails the check instead of
+// blocking the cycle.
+func (c mountConfig) checkMount(ctx context.Context, repoPath string) error {
+	if c.MountPoint == "" {
+		return nil
+	}
+	mounted := func() error {
+		return withTimeout(func() error {
+			ok, err := isMountPoint(c.MountPoint)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("%s is not mounted", c.MountPoint)
+			}
+			return nil
+		})
+	}
+	err := mounted()
+	if err != nil && len(c.RemountCommand) > 0 {
+		log.Printf("%v, remounting", err)
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+		output := func(b []byte) { log.Println(string(b)) }
+		if err := runCommand(ctx, output, c.RemountCommand[0], c.RemountCommand[1:]...); err != nil {
+			return fmt.Errorf("remounting %s: %v", c.MountPoint, err)
+		}
+		err = mounted()
+	}
+	if err != nil {
+		return err
+	}
+	if err := withTimeout(func() error { return checkRepoWritable(repoPath) }); err != nil {
+		return fmt.Errorf("munki repo not writable: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// munkiReport configures posting import and failure events to a MunkiReport
+// or Sal endpoint, so pipeline activity shows up next to client reporting.
+type munkiReport struct {
+	URL string `toml:"url"`
+	// Token is sent as a bearer token, or in TokenHeader if set, e.g. a
+	// module passphrase header.
+	Token       string `toml:"token"`
+	TokenHeader string `toml:"token_header"`
+	// Source names this build machine in the events, by default its
+	// hostname.
+	Source string `toml:"source"`
+}
+
+// pipelineEvent is an import or a failure of a recipe run.
+type pipelineEvent struct {
+	Time    time.Time `json:"timestamp"`
+	Source  string    `json:"source"`
+	Type    string    `json:"type"`
+	Recipe  string    `json:"recipe"`
+	Name    string    `json:"name,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Labels  labels    `json:"labels,omitempty"`
+}
+
+var munkiReportClient = &http.Client{Timeout: 10 * time.Second}
+
+// pushEvents posts the imports and failures of a run. Runs which changed
+// nothing aren't posted.
+func (c munkiReport) pushEvents(rec runRecord) error {
+	if c.URL == "" {
+		return nil
+	}
+	source := c.Source
+	if source == "" {
+		source = aggregator{}.node()
+	}
+	var events []pipelineEvent
+	for _, item := range rec.Imports {
+		events = append(events, pipelineEvent{Time: rec.Start, Source: source, Type: "import", Recipe: rec.Recipe, Name: item.Name, Version: item.Version, Labels: rec.Labels})
+	}
+	for _, f := range rec.Failures {
+		events = append(events, pipelineEvent{Time: rec.Start, Source: source, Type: "failure", Recipe: rec.Recipe, Message: f.Message, Labels: rec.Labels})
+	}
+	for _, msg := range rec.SignatureFailures {
+		events = append(events, pipelineEvent{Time: rec.Start, Source: source, Type: "signature_failure", Recipe: rec.Recipe, Message: msg, Labels: rec.Labels})
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	switch {
+	case c.Token != "" && c.TokenHeader != "":
+		req.Header.Set(c.TokenHeader, c.Token)
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := munkiReportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("munkireport: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runRecipes implements `autopkgd run recipe...`. When a daemon is listening
+// on the control socket the recipes are queued on it, otherwise they run
+// once in this process with the daemon's config: the same concurrency,
+// notifiers, reports and history.
+func runRecipes(args []string) int {
+	var (
+		flags       = flag.NewFlagSet("run", flag.ExitOnError)
+		fConfig     = flags.String("config", "", "configuration file to load")
+		fSocket     = flags.String("socket", "", "control socket of the daemon (default control_socket from the config)")
+		fStandalone = flags.Bool("standalone", false, "run the recipes in this process even if the daemon is running")
+		fOnce       = flags.Bool("once", false, "run the recipes once in this process and exit, the whole recipe list if none are given (implies -standalone)")
+		fSlack      = flags.Bool("slack", false, "Send reports to slack? (standalone, the daemon reports as its -slack says)")
+		fCheck      = flags.Bool("check", false, "autopkg check option")
+		fDryRun     = flags.Bool("dry-run", false, "print the commands the run would execute, without running anything")
+		fMatch      = flags.String("match", "", "also run the recipes of the recipe list matching this regular expression, e.g. 'Adobe.*'")
+		fTags       stringList
+		fOutputs    stringList
+		fMock       = flags.String("mock", "", "simulate the recipe runs with the canned reports in this directory (standalone)")
+		fVerbose    = flags.Int("verbosity", -1, "autopkg verbosity, 0 to 4 (standalone, default autopkg_verbosity from the config)")
+	)
+	flags.Var(&fTags, "tag", "also run the recipes of the recipe list with this tag, may be repeated to require several")
+	flags.Var(&fOutputs, "output", "write the results to a file, e.g. junit=results.xml for CI (implies -standalone)")
+	flags.Parse(args)
+	if flags.NArg() == 0 && *fMatch == "" && len(fTags) == 0 && !*fOnce {
+		fmt.Println("usage: autopkgd run [-config file] [-standalone | -once] [-match regexp] [-tag tag] [-output junit=file] [recipe...]")
+		return 1
+	}
+	outputs, err := parseRunOutputs(fOutputs)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	conf, err := loadConfig(*fConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf.Mock = *fMock
+	if *fVerbose >= 0 {
+		conf.AutopkgVerbosity = *fVerbose
+	}
+	if err := validateVerbosity(conf.AutopkgVerbosity, nil); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	recipes := flags.Args()
+	if *fMatch != "" || len(fTags) > 0 {
+		list, err := readRecipes(conf.RecipesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		selected, err := selectRecipes(list, conf.RecipeTags, *fMatch, fTags)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if len(selected) == 0 {
+			fmt.Println("no recipe of the recipe list matches")
+			return 1
+		}
+		recipes = append(recipes, selected...)
+	}
+	if len(recipes) == 0 {
+		if recipes, err = readRecipes(conf.RecipesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *fDryRun {
+		return dryRun(conf, recipes, *fSlack, *fCheck)
+	}
+	socket := *fSocket
+	if socket == "" {
+		socket = conf.ControlSocket
+	}
+	// the results of queued runs aren't known here, and the daemon doesn't
+	// mock.
+	if !*fStandalone && !*fOnce && len(outputs) == 0 && *fMock == "" && socket != "" && daemonListening(socket) {
+		c := newControlClient(socket)
+		query := ""
+		if *fCheck {
+			query = "?check=true"
+		}
+		if *fSlack {
+			fmt.Println("-slack has no effect on recipes queued on the daemon, which reports to slack as its own -slack says")
+		}
+		for _, recipe := range recipes {
+			if err := c.do("POST", "/recipes/"+url.PathEscape(recipe)+"/run"+query, nil); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			fmt.Printf("queued %s\n", recipe)
+		}
+		return 0
+	}
+
+	if err := setupRecipeRuns(conf); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	d, start, interrupted := runOnce(conf, recipes, *fSlack, *fCheck)
+	if path, ok := outputs["junit"]; ok {
+		if err := d.writeJUnit(path, start, recipes); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if d.lastCycle.Failed > 0 || interrupted {
+		return 1
+	}
+	return 0
+}
+
+// runOnce runs a single cycle of recipes in this process, which must have
+// been set up with setupRecipeRuns. It returns the daemon which ran it, when
+// the cycle started and whether it was interrupted.
+func runOnce(conf Config, recipes []string, slackReport, check bool) (*daemon, time.Time, bool) {
+	// the interrupted cycle and the processes of a daemon started later
+	// aren't ours to resume or kill.
+	conf.CycleStateFile = ""
+	conf.ChildrenFile = ""
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	d := newDaemon(ctx, conf, slackReport, check)
+	start := time.Now()
+	d.cycle(recipes, cliActor(), false)
+	d.workers.stop()
+	return d, start, ctx.Err() != nil
+}
+
+// writeJUnit writes the outcome of the cycle which started at start to path
+// as JUnit XML.
+func (d *daemon) writeJUnit(path string, start time.Time, recipes []string) error {
+	runs := make(map[string]runRecord)
+	skipped := make(map[string]string)
+	d.mu.Lock()
+	for _, recipe := range recipes {
+		if rec, ok := d.last[recipe]; ok && !rec.Start.Before(start) {
+			runs[recipe] = rec
+		}
+		if reason, ok := d.progress.Skipped[recipe]; ok {
+			skipped[recipe] = reason
+		}
+	}
+	d.mu.Unlock()
+	hostname, _ := os.Hostname()
+	b, err := junitReport(start, recipes, runs, skipped, hostname)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0644)
+}
+
+// daemonListening reports whether a daemon accepts connections on the
+// control socket.
+func daemonListening(socket string) bool {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// childProcess is a running autopkg or makecatalogs process. Every child runs
+// in its own process group, led by Pid.
+type childProcess struct {
+	Pid   int       `json:"pid"`
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+}
+
+// childTracker keeps the running children in a file, so a daemon which
+// restarts after a crash can find the ones it left behind. A nil tracker
+// doesn't track.
+type childTracker struct {
+	path string
+
+	mu      sync.Mutex
+	running map[int]childProcess
+}
+
+// children tracks the running children, if children_file is configured.
+var children *childTracker
+
+func newChildTracker(path string) *childTracker {
+	if path == "" {
+		return nil
+	}
+	t := &childTracker{path: path, running: make(map[int]childProcess)}
+	t.save()
+	return t
+}
+
+func (t *childTracker) add(pid int, name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running[pid] = childProcess{Pid: pid, Name: name, Start: time.Now()}
+	t.save()
+}
+
+func (t *childTracker) remove(pid int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.running, pid)
+	t.save()
+}
+
+// save writes the running children, t.mu must be held.
+func (t *childTracker) save() {
+	procs := []childProcess{}
+	for _, p := range t.running {
+		procs = append(procs, p)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Pid < procs[j].Pid })
+	b, err := json.Marshal(procs)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := writeFileAtomic(t.path, b, 0644); err != nil {
+		log.Println(err)
+	}
+}
+
+// groupAlive reports whether any process is left in the process group.
+func groupAlive(pgid int) bool {
+	return syscall.Kill(-pgid, 0) == nil
+}
+
+// reapOrphans deals with the children a previous instance left running,
+// listed in the children file at path. With wait set it waits for them to
+// exit, otherwise it terminates them, so they don't import concurrently with
+// the runs of this instance.
+func reapOrphans(ctx context.Context, path string, wait bool) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var procs []childProcess
+	if err := json.Unmarshal(b, &procs); err != nil {
+		return err
+	}
+	for _, p := range procs {
+		if !groupAlive(p.Pid) {
+			continue
+		}
+		if wait {
+			log.Printf("waiting for %s (pid %d) left running by a previous instance", p.Name, p.Pid)
+		} else {
+			log.Printf("terminating %s (pid %d) left running by a previous instance", p.Name, p.Pid)
+			syscall.Kill(-p.Pid, syscall.SIGTERM)
+		}
+		deadline := time.Now().Add(killDelay)
+		for groupAlive(p.Pid) {
+			if !wait && time.Now().After(deadline) {
+				syscall.Kill(-p.Pid, syscall.SIGKILL)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+	return nil
+}
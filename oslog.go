@@ -0,0 +1,24 @@
+package main
+
+// osLogConfig configures logging to the macOS unified logging system.
+type osLogConfig struct {
+	Enabled   bool   `toml:"enabled"`
+	Subsystem string `toml:"subsystem"`
+	Category  string `toml:"category"`
+}
+
+const (
+	defaultOSLogSubsystem = "io.groob.autopkgd"
+	defaultOSLogCategory  = "daemon"
+)
+
+func (c osLogConfig) names() (subsystem, category string) {
+	subsystem, category = c.Subsystem, c.Category
+	if subsystem == "" {
+		subsystem = defaultOSLogSubsystem
+	}
+	if category == "" {
+		category = defaultOSLogCategory
+	}
+	return subsystem, category
+}
@@ -0,0 +1,43 @@
+//go:build darwin && cgo
+
+package main
+
+/*
+#include <os/log.h>
+#include <stdlib.h>
+
+static os_log_t autopkgd_os_log_create(const char *subsystem, const char *category) {
+	return os_log_create(subsystem, category);
+}
+
+static void autopkgd_os_log(os_log_t log, const char *msg) {
+	os_log_with_type(log, OS_LOG_TYPE_DEFAULT, "%{public}s", msg);
+}
+*/
+import "C"
+
+import (
+	"io"
+	"strings"
+	"unsafe"
+)
+
+type osLogWriter struct {
+	log C.os_log_t
+}
+
+func newOSLogWriter(conf osLogConfig) (io.Writer, error) {
+	subsystem, category := conf.names()
+	cSubsystem := C.CString(subsystem)
+	defer C.free(unsafe.Pointer(cSubsystem))
+	cCategory := C.CString(category)
+	defer C.free(unsafe.Pointer(cCategory))
+	return &osLogWriter{log: C.autopkgd_os_log_create(cSubsystem, cCategory)}, nil
+}
+
+func (w *osLogWriter) Write(p []byte) (int, error) {
+	msg := C.CString(strings.TrimRight(string(p), "\n"))
+	defer C.free(unsafe.Pointer(msg))
+	C.autopkgd_os_log(w.log, msg)
+	return len(p), nil
+}
@@ -0,0 +1,12 @@
+//go:build !darwin || !cgo
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func newOSLogWriter(conf osLogConfig) (io.Writer, error) {
+	return nil, errors.New("os_log is only available on macOS builds with cgo enabled")
+}
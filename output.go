@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const (
+	// maxLineLength truncates longer lines of child output.
+	maxLineLength = 64 * 1024
+	// outputQueue is the number of lines which may wait for the consumer
+	// before further lines are dropped.
+	outputQueue = 1024
+	// maxStderr is how much of stderr is kept for the error message.
+	maxStderr = 64 * 1024
+)
+
+// maxOutputBytes is the output of a single run passed on to the logs. It is
+// set at startup from the config.
+var maxOutputBytes int64 = 8 << 20
+
+// outputCapture hands lines of child output to a consumer on a separate
+// goroutine, so a slow log destination can't block the child on a full
+// pipe. Lines which don't fit the queue or the per-run budget are dropped.
+type outputCapture struct {
+	output func([]byte)
+	lines  chan []byte
+	done   chan struct{}
+
+	budget    int64
+	dropped   int
+	truncated bool
+}
+
+func newOutputCapture(output func([]byte)) *outputCapture {
+	c := &outputCapture{
+		output: output,
+		lines:  make(chan []byte, outputQueue),
+		done:   make(chan struct{}),
+		budget: maxOutputBytes,
+	}
+	go func() {
+		defer close(c.done)
+		for line := range c.lines {
+			c.output(line)
+		}
+	}()
+	return c
+}
+
+// add queues a copy of line, or drops it.
+func (c *outputCapture) add(line []byte) {
+	if c.budget -= int64(len(line)); c.budget < 0 {
+		c.truncated = true
+		c.dropped++
+		return
+	}
+	select {
+	case c.lines <- append([]byte(nil), line...):
+	default:
+		c.dropped++
+	}
+}
+
+// close waits for the queued lines to be consumed and notes dropped lines.
+func (c *outputCapture) close() {
+	close(c.lines)
+	<-c.done
+	switch {
+	case c.truncated:
+		c.output([]byte(fmt.Sprintf("autopkgd: output truncated after %d bytes, %d lines dropped", maxOutputBytes, c.dropped)))
+	case c.dropped > 0:
+		c.output([]byte(fmt.Sprintf("autopkgd: %d lines of output dropped", c.dropped)))
+	}
+}
+
+// readLines calls fn with every line read from r, without the newline.
+// Lines longer than maxLineLength are truncated.
+func readLines(r io.Reader, fn func([]byte)) {
+	br := bufio.NewReaderSize(r, maxLineLength)
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			fn(line)
+			// skip the rest of the line.
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if len(line) > 0 {
+			fn(bytes.TrimSuffix(line, []byte("\n")))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the
+// rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
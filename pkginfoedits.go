@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"text/template"
+
+	"github.com/groob/plist"
+)
+
+// pkginfoEdit sets keys of newly imported pkginfo files, for the recipes and
+// item names it matches. Unset fields leave the pkginfo alone.
+type pkginfoEdit struct {
+	// Recipes and Names are patterns such as "Adobe*". An empty list
+	// matches everything.
+	Recipes []string `toml:"recipes"`
+	Names   []string `toml:"names"`
+
+	Category          string   `toml:"category"`
+	Developer         string   `toml:"developer"`
+	Catalogs          []string `toml:"catalogs"`
+	UnattendedInstall *bool    `toml:"unattended_install"`
+	// DisplayName is a text/template executed against the pkginfo, e.g.
+	// "{{.name}} {{.version}}".
+	DisplayName string `toml:"display_name"`
+}
+
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// apply changes item, returning whether anything changed.
+func (e pkginfoEdit) apply(item map[string]interface{}) (bool, error) {
+	set := make(map[string]interface{})
+	if e.Category != "" {
+		set["category"] = e.Category
+	}
+	if e.Developer != "" {
+		set["developer"] = e.Developer
+	}
+	if e.Catalogs != nil {
+		set["catalogs"] = e.Catalogs
+	}
+	if e.UnattendedInstall != nil {
+		set["unattended_install"] = *e.UnattendedInstall
+	}
+	if e.DisplayName != "" {
+		tmpl, err := template.New("display_name").Option("missingkey=zero").Parse(e.DisplayName)
+		if err != nil {
+			return false, err
+		}
+		var name bytes.Buffer
+		if err := tmpl.Execute(&name, item); err != nil {
+			return false, err
+		}
+		set["display_name"] = name.String()
+	}
+	changed := false
+	for key, value := range set {
+		if fmt.Sprint(item[key]) != fmt.Sprint(value) {
+			item[key] = value
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// editPkginfos applies the configured edits to the pkginfo files a recipe
+// imported, before the catalogs are rebuilt.
+func editPkginfos(edits []pkginfoEdit, repoPath, recipe string, imports []importedItem) {
+	for _, imported := range imports {
+		if imported.Pkginfo == "" {
+			continue
+		}
+		file := filepath.Join(repoPath, "pkgsinfo", imported.Pkginfo)
+		item, err := readPkginfo(file)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		changed := false
+		for _, edit := range edits {
+			if !matchAny(edit.Recipes, recipe) || !matchAny(edit.Names, imported.Name) {
+				continue
+			}
+			c, err := edit.apply(item)
+			if err != nil {
+				log.Printf("editing %s: %v", imported.Pkginfo, err)
+				continue
+			}
+			changed = changed || c
+		}
+		if !changed {
+			continue
+		}
+		b, err := plist.MarshalIndent(item, "\t")
+		if err != nil {
+			log.Printf("editing %s: %v", imported.Pkginfo, err)
+			continue
+		}
+		if err := writeFileAtomic(file, b, 0644); err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("edited pkginfo %s", imported.Pkginfo)
+	}
+}
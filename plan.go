@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// plan is what `autopkgd plan` found a cycle would import, for review
+// before `autopkgd apply` runs it against the production repo.
+type plan struct {
+	Created time.Time `json:"created"`
+	// Changes are the recipes which would import something.
+	Changes []plannedImport `json:"changes"`
+	// Failed are the recipes whose check failed.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// plannedImport is a recipe whose check downloaded something new.
+type plannedImport struct {
+	Recipe    string   `json:"recipe"`
+	Downloads []string `json:"downloads"`
+	// Name is the item the recipe last imported, and RepoVersion the newest
+	// version of it in the repo, when they are known.
+	Name        string `json:"name,omitempty"`
+	RepoVersion string `json:"repo_version,omitempty"`
+}
+
+func (p plannedImport) String() string {
+	name := p.Name
+	if name == "" {
+		name = p.Recipe
+	}
+	var downloads []string
+	for _, d := range p.Downloads {
+		downloads = append(downloads, filepath.Base(d))
+	}
+	s := fmt.Sprintf("would import %s: %s", name, strings.Join(downloads, ", "))
+	if p.RepoVersion != "" {
+		s += fmt.Sprintf(" (repo has %s)", p.RepoVersion)
+	}
+	return s
+}
+
+// makePlan collects the recipes of runs which downloaded something, with
+// the item each last imported from history and its newest version in the
+// repo.
+func makePlan(runs []runRecord, history []runRecord, repoPath string) plan {
+	p := plan{Created: time.Now()}
+	names := make(map[string]string)
+	for _, rec := range history {
+		if len(rec.Imports) > 0 {
+			names[rec.Recipe] = rec.Imports[0].Name
+		}
+	}
+	newest := make(map[string]string)
+	err := walkPkginfos(repoPath, func(rel string, fi os.FileInfo, item map[string]interface{}, err error) error {
+		if err != nil {
+			return nil
+		}
+		name, _ := item["name"].(string)
+		version, _ := item["version"].(string)
+		if v, ok := newest[name]; !ok || compareVersions(version, v) > 0 {
+			newest[name] = version
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	for _, rec := range runs {
+		switch {
+		case len(rec.Failures) > 0 || rec.ReportUnreadable:
+			p.Failed = append(p.Failed, rec.Recipe)
+		case len(rec.Downloads) > 0:
+			name := names[rec.Recipe]
+			p.Changes = append(p.Changes, plannedImport{Recipe: rec.Recipe, Downloads: rec.Downloads, Name: name, RepoVersion: newest[name]})
+		}
+	}
+	return p
+}
+
+// runPlan implements `autopkgd plan`, which runs the recipes with --check
+// and stores which of them would import something.
+func runPlan(args []string) int {
+	var (
+		flags   = flag.NewFlagSet("plan", flag.ExitOnError)
+		fConfig = flags.String("config", "", "configuration file to load")
+		fOut    = flags.String("out", "plan.json", "file the plan is stored in for `autopkgd apply`")
+	)
+	flags.Parse(args)
+
+	conf, err := loadConfig(*fConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	recipes := flags.Args()
+	if len(recipes) == 0 {
+		if recipes, err = readRecipes(conf.RecipesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := setupRecipeRuns(conf); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	// a plan isn't a cycle the monitoring should see.
+	conf.StatusFile = ""
+	conf.ReportPushURL = ""
+	d, start, interrupted := runOnce(conf, recipes, false, true)
+	if interrupted {
+		return 1
+	}
+	var runs []runRecord
+	d.mu.Lock()
+	for _, recipe := range recipes {
+		if rec, ok := d.last[recipe]; ok && !rec.Start.Before(start) {
+			runs = append(runs, rec)
+		}
+	}
+	d.mu.Unlock()
+	var history []runRecord
+	if conf.HistoryFile != "" {
+		if history, err = readHistory(conf.HistoryFile, time.Time{}); err != nil {
+			log.Println(err)
+		}
+	}
+	p := makePlan(runs, history, conf.MunkiRepoPath)
+
+	fmt.Println()
+	for _, change := range p.Changes {
+		fmt.Println(change)
+	}
+	for _, recipe := range p.Failed {
+		fmt.Printf("check of %s failed\n", recipe)
+	}
+	if len(p.Changes) == 0 {
+		fmt.Println("no changes, nothing to apply")
+		return 0
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeFileAtomic(*fOut, append(b, '\n'), 0644); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("\n%d recipes would import, run `autopkgd apply -plan %s` to import them\n", len(p.Changes), *fOut)
+	return 0
+}
+
+// runApply implements `autopkgd apply`, which runs the recipes of a stored
+// plan in full.
+func runApply(args []string) int {
+	var (
+		flags   = flag.NewFlagSet("apply", flag.ExitOnError)
+		fConfig = flags.String("config", "", "configuration file to load")
+		fPlan   = flags.String("plan", "plan.json", "plan stored by `autopkgd plan`")
+		fMaxAge = flags.Duration("max-age", 24*time.Hour, "refuse plans older than this")
+		fSlack  = flags.Bool("slack", false, "Send reports to slack?")
+	)
+	flags.Parse(args)
+
+	conf, err := loadConfig(*fConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(*fPlan)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	var p plan
+	if err := json.Unmarshal(b, &p); err != nil {
+		fmt.Printf("reading %s: %v\n", *fPlan, err)
+		return 1
+	}
+	if age := time.Since(p.Created); *fMaxAge > 0 && age > *fMaxAge {
+		fmt.Printf("the plan is %v old, run `autopkgd plan` again\n", age.Round(time.Minute))
+		return 1
+	}
+	var recipes []string
+	for _, change := range p.Changes {
+		fmt.Println(change)
+		recipes = append(recipes, change.Recipe)
+	}
+	if len(recipes) == 0 {
+		fmt.Println("the plan has no changes")
+		return 0
+	}
+	if err := setupRecipeRuns(conf); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	d, _, interrupted := runOnce(conf, recipes, *fSlack, false)
+	if d.lastCycle.Failed > 0 || interrupted {
+		return 1
+	}
+	// the plan is spent, applying it again would re-run the recipes.
+	if err := os.Remove(*fPlan); err != nil {
+		log.Println(err)
+	}
+	return 0
+}
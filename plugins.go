@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// plugin is an external executable run after each recipe and at the end of
+// each cycle, for site-specific integrations. It gets the run record, or the
+// cycle status, as JSON on stdin, and AUTOPKGD_EVENT (run or cycle),
+// AUTOPKGD_RECIPE and AUTOPKGD_RESULT in the environment. Its output and exit
+// status are logged, and the command is recorded in the audit log.
+type plugin struct {
+	Name string   `toml:"name"`
+	Path string   `toml:"path"`
+	Args []string `toml:"args"`
+	// Events are the events the plugin runs on, run and cycle by default.
+	Events []string `toml:"events"`
+	// Timeout is in seconds, 60 by default.
+	Timeout time.Duration `toml:"timeout"`
+}
+
+type plugins []plugin
+
+func (p plugins) validate() error {
+	for _, plugin := range p {
+		if plugin.Name == "" || plugin.Path == "" {
+			return fmt.Errorf("plugins: name and path are required")
+		}
+		for _, event := range plugin.Events {
+			if event != "run" && event != "cycle" {
+				return fmt.Errorf("plugins: %s: event must be run or cycle, not %q", plugin.Name, event)
+			}
+		}
+	}
+	return nil
+}
+
+func (p plugin) handles(event string) bool {
+	if len(p.Events) == 0 {
+		return true
+	}
+	for _, e := range p.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// runRecord runs the plugins handling run events with the record of a run.
+func (p plugins) runRecord(ctx context.Context, rec runRecord) {
+	env := []string{"AUTOPKGD_EVENT=run", "AUTOPKGD_RECIPE=" + rec.Recipe, "AUTOPKGD_RESULT=" + rec.result()}
+	p.run(ctx, "run", rec, env)
+}
+
+// cycleEnd runs the plugins handling cycle events with the status of a
+// cycle.
+func (p plugins) cycleEnd(ctx context.Context, status cycleStatus) {
+	result := "ok"
+	if status.Failed > 0 {
+		result = "failed"
+	}
+	env := []string{"AUTOPKGD_EVENT=cycle", "AUTOPKGD_RESULT=" + result, "AUTOPKGD_FAILED=" + strconv.Itoa(status.Failed)}
+	p.run(ctx, "cycle", status, env)
+}
+
+func (p plugins) run(ctx context.Context, event string, v interface{}, env []string) {
+	if len(outputLabels) > 0 {
+		env = append(env, "AUTOPKGD_LABELS="+outputLabels.String())
+	}
+	var input []byte
+	for _, plugin := range p {
+		if !plugin.handles(event) {
+			continue
+		}
+		if input == nil {
+			var err error
+			if input, err = json.Marshal(v); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		if err := plugin.exec(ctx, input, env); err != nil {
+			log.Printf("plugin %s: %v", plugin.Name, err)
+		}
+	}
+}
+
+// exec runs the plugin with input on stdin, logging each line it writes.
+func (p plugin) exec(ctx context.Context, input []byte, env []string) error {
+	timeout := time.Second * p.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := newCommand(ctx, p.Path, p.Args...)
+	cmd.Env = append(cmd.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(input)
+	out := &limitedBuffer{max: maxStderr}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	start := time.Now()
+	err := cmd.Run()
+	auditCommand(ctx, cmd, start, err)
+	readLines(bytes.NewReader(out.Bytes()), func(line []byte) {
+		log.Printf("plugin %s: %s", p.Name, line)
+	})
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+	return err
+}
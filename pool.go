@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// poolQueue is the number of jobs which may wait for a worker. Submitting
+// blocks while the queue is full.
+const poolQueue = 64
+
+// job is a recipe to run on the worker pool, until ctx is done. The outcome
+// is sent on results.
+type job struct {
+	ctx     context.Context
+	recipe  string
+	check   bool
+	results chan<- runResult
+}
+
+// workerPool runs jobs from a bounded queue on long lived workers. The target
+// number of workers can be changed while jobs are running: new workers start
+// at once, surplus workers exit after their current job. A worker only takes
+// a job while the workers don't outnumber the target, so once the surplus
+// jobs are done no more than target jobs run at a time.
+type workerPool struct {
+	run func(ctx context.Context, recipe string, check bool) runResult
+	wg  sync.WaitGroup
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queue are the jobs waiting for a worker.
+	queue []job
+	// target is the number of workers wanted, running those which haven't
+	// exited yet.
+	target  int
+	running int
+	stopped bool
+}
+
+func newWorkerPool(workers int, run func(ctx context.Context, recipe string, check bool) runResult) *workerPool {
+	p := &workerPool{run: run}
+	p.cond = sync.NewCond(&p.mu)
+	p.resize(workers)
+	return p
+}
+
+func (p *workerPool) worker() {
+	defer p.wg.Done()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		switch {
+		case p.running > p.target:
+			p.running--
+			return
+		case len(p.queue) > 0:
+			j := p.queue[0]
+			p.queue = p.queue[1:]
+			// a submitter may be waiting for room in the queue.
+			p.cond.Broadcast()
+			p.mu.Unlock()
+			j.results <- p.run(j.ctx, j.recipe, j.check)
+			p.mu.Lock()
+		case p.stopped:
+			p.running--
+			return
+		default:
+			p.cond.Wait()
+		}
+	}
+}
+
+// submit queues a job, blocking while the queue is full.
+func (p *workerPool) submit(j job) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) >= poolQueue {
+		p.cond.Wait()
+	}
+	p.queue = append(p.queue, j)
+	p.cond.Broadcast()
+}
+
+// resize changes the target number of workers. Workers left over from a
+// previous resize count towards it until they exit.
+func (p *workerPool) resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.target = n
+	for ; p.running < n; p.running++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	// wake idle workers so the surplus exits.
+	p.cond.Broadcast()
+}
+
+// size is the target number of workers.
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.target
+}
+
+// stop waits for the queued jobs to finish and the workers to exit. No
+// jobs may be submitted after stop.
+func (p *workerPool) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	p.wg.Wait()
+}
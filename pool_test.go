@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedRun is a worker pool run function which blocks each job until it is
+// released, keeping track of how many run at once.
+type gatedRun struct {
+	release chan struct{}
+
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+func newGatedRun() *gatedRun {
+	return &gatedRun{release: make(chan struct{})}
+}
+
+func (g *gatedRun) run(ctx context.Context, recipe string, check bool) runResult {
+	g.mu.Lock()
+	g.active++
+	if g.active > g.maxActive {
+		g.maxActive = g.active
+	}
+	g.mu.Unlock()
+	<-g.release
+	g.mu.Lock()
+	g.active--
+	g.mu.Unlock()
+	return runResult{rec: runRecord{Recipe: recipe}}
+}
+
+func (g *gatedRun) counts() (active, maxActive int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.active, g.maxActive
+}
+
+// resetMax starts measuring the most jobs run at once from now.
+func (g *gatedRun) resetMax() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maxActive = g.active
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func submitJobs(p *workerPool, n int, results chan<- runResult) {
+	for i := 0; i < n; i++ {
+		p.submit(job{ctx: context.Background(), recipe: "Recipe" + strconv.Itoa(i) + ".munki", results: results})
+	}
+}
+
+func activeIs(g *gatedRun, n int) func() bool {
+	return func() bool {
+		active, _ := g.counts()
+		return active == n
+	}
+}
+
+func TestWorkerPoolResizeUnderLoad(t *testing.T) {
+	g := newGatedRun()
+	p := newWorkerPool(2, g.run)
+	results := make(chan runResult, 20)
+	submitJobs(p, 20, results)
+
+	waitFor(t, "2 running jobs", activeIs(g, 2))
+	p.resize(4)
+	waitFor(t, "4 running jobs", activeIs(g, 4))
+	if p.size() != 4 {
+		t.Errorf("size = %d, want 4", p.size())
+	}
+
+	p.resize(1)
+	g.resetMax()
+	// the 4 running jobs finish, after which only one runs at a time.
+	for i := 0; i < 4; i++ {
+		g.release <- struct{}{}
+	}
+	waitFor(t, "1 running job", activeIs(g, 1))
+	for i := 0; i < 5; i++ {
+		g.release <- struct{}{}
+		waitFor(t, "the next job", activeIs(g, 1))
+	}
+	if _, max := g.counts(); max > 4 {
+		t.Errorf("%d jobs ran at once after shrinking, want at most the 4 already running", max)
+	}
+	g.resetMax()
+	for i := 0; i < 3; i++ {
+		g.release <- struct{}{}
+		waitFor(t, "the next job", activeIs(g, 1))
+	}
+	if _, max := g.counts(); max != 1 {
+		t.Errorf("%d jobs ran at once with 1 worker, want 1", max)
+	}
+
+	close(g.release)
+	p.stop()
+	if len(results) != 20 {
+		t.Errorf("%d results, want 20", len(results))
+	}
+}
+
+func TestWorkerPoolShrinkThenGrowStaysWithinTarget(t *testing.T) {
+	g := newGatedRun()
+	p := newWorkerPool(3, g.run)
+	results := make(chan runResult, 10)
+	submitJobs(p, 10, results)
+	waitFor(t, "3 running jobs", activeIs(g, 3))
+
+	// the 3 workers are busy, so the shrink leaves 2 of them over, which
+	// must count towards the grow.
+	p.resize(1)
+	p.resize(2)
+	time.Sleep(20 * time.Millisecond)
+	if active, _ := g.counts(); active != 3 {
+		t.Fatalf("%d jobs running after shrinking and growing, want the 3 already running", active)
+	}
+	g.release <- struct{}{}
+	waitFor(t, "a job to finish", func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.running == 2
+	})
+	g.resetMax()
+	for i := 0; i < 5; i++ {
+		g.release <- struct{}{}
+		waitFor(t, "2 running jobs", activeIs(g, 2))
+	}
+	if _, max := g.counts(); max > 2 {
+		t.Errorf("%d jobs ran at once with a target of 2", max)
+	}
+
+	close(g.release)
+	p.stop()
+	if len(results) != 10 {
+		t.Errorf("%d results, want 10", len(results))
+	}
+}
+
+func TestWorkerPoolStopDrainsQueue(t *testing.T) {
+	var mu sync.Mutex
+	ran := make(map[string]bool)
+	p := newWorkerPool(2, func(ctx context.Context, recipe string, check bool) runResult {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		ran[recipe] = true
+		mu.Unlock()
+		return runResult{}
+	})
+	results := make(chan runResult, 30)
+	submitJobs(p, 30, results)
+	p.resize(1)
+	p.stop()
+	if len(ran) != 30 || len(results) != 30 {
+		t.Errorf("stop returned after %d of 30 jobs with %d results", len(ran), len(results))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running != 0 {
+		t.Errorf("%d workers left after stop", p.running)
+	}
+}
+
+func TestWorkerPoolSubmitBlocksWhileQueueIsFull(t *testing.T) {
+	g := newGatedRun()
+	p := newWorkerPool(1, g.run)
+	results := make(chan runResult, poolQueue+2)
+	submitJobs(p, poolQueue+1, results)
+	waitFor(t, "1 running job", activeIs(g, 1))
+
+	submitted := make(chan struct{})
+	go func() {
+		submitJobs(p, 1, results)
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("submit didn't block with a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	g.release <- struct{}{}
+	select {
+	case <-submitted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("submit still blocked after a job finished")
+	}
+	close(g.release)
+	p.stop()
+	if len(results) != poolQueue+2 {
+		t.Errorf("%d results, want %d", len(results), poolQueue+2)
+	}
+}
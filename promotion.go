@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/groob/plist"
+)
+
+// promotionConfig configures moving items from a testing catalog to a
+// production catalog once they have soaked long enough.
+type promotionConfig struct {
+	// From and To are the catalogs, promotion is disabled without To. From
+	// defaults to testing.
+	From string `toml:"from"`
+	To   string `toml:"to"`
+	// Soak is the number of seconds an item stays in From before it is
+	// promoted, counted from the creation date munki records in _metadata,
+	// or from when a held item was released.
+	Soak time.Duration `toml:"soak"`
+	// Exclude are item names or patterns which are never promoted.
+	Exclude []string `toml:"exclude"`
+	// Replace removes the item from From when it is promoted.
+	Replace bool `toml:"replace"`
+	// Approve asks for approval in slack before promoting an item.
+	Approve bool `toml:"approve"`
+}
+
+// promotionRejectedKey marks, in the _metadata of a pkginfo, an item whose
+// promotion was rejected so it isn't proposed again.
+const promotionRejectedKey = "autopkgd_promotion_rejected"
+
+// promotionCandidate is a pkginfo which is due for promotion.
+type promotionCandidate struct {
+	path    string // relative to pkgsinfo
+	name    string
+	version string
+}
+
+func (c promotionCandidate) String() string {
+	return c.name + " " + c.version
+}
+
+// promotionCandidates returns the items of the repo which soaked in the From
+// catalog for long enough.
+func (c promotionConfig) promotionCandidates(repoPath string) ([]promotionCandidate, error) {
+	var candidates []promotionCandidate
+	err := walkPkginfos(repoPath, func(rel string, fi os.FileInfo, item map[string]interface{}, err error) error {
+		if err != nil {
+			return nil
+		}
+		name, _ := item["name"].(string)
+		version, _ := item["version"].(string)
+		if name == "" || (len(c.Exclude) > 0 && matchAny(c.Exclude, name)) {
+			return nil
+		}
+		catalogs, _ := item["catalogs"].([]interface{})
+		if !hasString(catalogs, c.From) || hasString(catalogs, c.To) {
+			return nil
+		}
+		created := fi.ModTime()
+		metadata, _ := item["_metadata"].(map[string]interface{})
+		if t, ok := metadata["creation_date"].(time.Time); ok {
+			created = t
+		}
+		if _, held := metadata[heldCatalogsKey]; held {
+			return nil
+		}
+		if t, ok := metadata[heldReleasedKey].(time.Time); ok && t.After(created) {
+			created = t
+		}
+		if _, rejected := metadata[promotionRejectedKey]; rejected {
+			return nil
+		}
+		if time.Since(created) < time.Second*c.Soak {
+			return nil
+		}
+		candidates = append(candidates, promotionCandidate{path: rel, name: name, version: version})
+		return nil
+	})
+	return candidates, err
+}
+
+// hasString reports whether a plist array contains s.
+func hasString(list []interface{}, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// updatePlist reads a plist dictionary such as a pkginfo or a manifest,
+// passes it to change and writes it back if change returns true.
+func updatePlist(path string, change func(dict map[string]interface{}) bool) error {
+	dict, err := readPkginfo(path)
+	if err != nil {
+		return err
+	}
+	if !change(dict) {
+		return nil
+	}
+	b, err := plist.MarshalIndent(dict, "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0644)
+}
+
+// promote adds the item to the To catalog.
+func (c promotionConfig) promote(repoPath string, candidate promotionCandidate) error {
+	return updatePlist(filepath.Join(repoPath, "pkgsinfo", candidate.path), func(item map[string]interface{}) bool {
+		catalogs, _ := item["catalogs"].([]interface{})
+		var promoted []interface{}
+		for _, catalog := range catalogs {
+			if !c.Replace || catalog != c.From {
+				promoted = append(promoted, catalog)
+			}
+		}
+		item["catalogs"] = append(promoted, c.To)
+		return true
+	})
+}
+
+// reject marks the item so its promotion isn't proposed again.
+func (c promotionConfig) reject(repoPath string, candidate promotionCandidate) error {
+	return updatePlist(filepath.Join(repoPath, "pkgsinfo", candidate.path), func(item map[string]interface{}) bool {
+		metadata, ok := item["_metadata"].(map[string]interface{})
+		if !ok {
+			metadata = make(map[string]interface{})
+			item["_metadata"] = metadata
+		}
+		metadata[promotionRejectedKey] = time.Now().UTC()
+		return true
+	})
+}
+
+// promoteItems promotes the items which soaked long enough and reports
+// whether the catalogs need to be rebuilt. With approval required it asks
+// for it instead, and an approved promotion rebuilds the catalogs itself.
+func (d *daemon) promoteItems() bool {
+	conf := d.conf.Promotion
+	if conf.To == "" {
+		return false
+	}
+	repo := d.conf.MunkiRepoPath
+	candidates, err := conf.promotionCandidates(repo)
+	if err != nil {
+		log.Println(err)
+	}
+	var promoted []string
+	for _, candidate := range candidates {
+		candidate := candidate
+		if conf.Approve {
+			d.requestApproval(&approval{
+				Kind:    "promote",
+				Subject: candidate.path,
+				Text:    fmt.Sprintf("*%s* has been in %s for %v. Promote it to %s?", candidate, conf.From, time.Second*conf.Soak, conf.To),
+				run: func(ctx context.Context) error {
+					if err := conf.promote(repo, candidate); err != nil {
+						return err
+					}
+					log.Printf("promoted %s to %s", candidate, conf.To)
+					_, err := d.rebuildCatalogs(ctx)
+					return err
+				},
+				rejected: func() error {
+					return conf.reject(repo, candidate)
+				},
+			})
+			continue
+		}
+		if err := conf.promote(repo, candidate); err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("promoted %s to %s", candidate, conf.To)
+		promoted = append(promoted, "- "+candidate.String())
+	}
+	if len(promoted) > 0 && d.slack {
+		text := fmt.Sprintf("Promoted to %s:\n%s", conf.To, strings.Join(promoted, "\n"))
+		if err := postSlack(d.conf.Slack, text); err != nil {
+			log.Println(err)
+		}
+	}
+	return len(promoted) > 0
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// readRecipes returns the recipes in the recipe list file, ignoring empty
+// lines, comments and MakeCatalogs.munki.
+func readRecipes(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	recipes := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		recipe := scanner.Text()
+		if len(recipe) == 0 || recipe == "MakeCatalogs.munki" || strings.HasPrefix(recipe, "#") {
+			continue
+		}
+		recipes = append(recipes, recipe)
+	}
+	return recipes, scanner.Err()
+}
+
+// A recipe is disabled by commenting out its line in the recipe list, e.g.
+// "# Firefox.munki". Comments which are a single dotted word are taken to be
+// disabled recipes, other comments are left alone.
+func disabledRecipe(line string) (string, bool) {
+	if !strings.HasPrefix(line, "#") {
+		return "", false
+	}
+	name := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+	if !strings.Contains(name, ".") || strings.ContainsAny(name, " \t#") {
+		return "", false
+	}
+	return name, true
+}
+
+// readDisabledRecipes returns the disabled recipes in the recipe list file.
+func readDisabledRecipes(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	recipes := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if name, ok := disabledRecipe(line); ok {
+			recipes = append(recipes, name)
+		}
+	}
+	return recipes, nil
+}
+
+var (
+	errRecipeExists   = errors.New("recipe is already in the recipe list")
+	errRecipeNotFound = errors.New("recipe is not in the recipe list")
+	errInvalidRecipe  = errors.New("invalid recipe name")
+)
+
+func validRecipeName(name string) bool {
+	return name != "" && name != "MakeCatalogs.munki" && !strings.HasPrefix(name, "#") &&
+		!strings.ContainsAny(name, " \t\r\n/")
+}
+
+// recipesMu serializes changes to the recipe list file.
+var recipesMu sync.Mutex
+
+// editRecipes rewrites the recipe list file with the lines returned by edit.
+func editRecipes(path string, edit func(lines []string) ([]string, error)) error {
+	recipesMu.Lock()
+	defer recipesMu.Unlock()
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(b) == 0 {
+		lines = nil
+	}
+	if lines, err = edit(lines); err != nil {
+		return err
+	}
+	data := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		data += "\n"
+	}
+	return writeFileAtomic(path, []byte(data), info.Mode().Perm())
+}
+
+// findRecipe returns the index of the enabled or disabled line of name.
+func findRecipe(lines []string, name string) int {
+	for i, line := range lines {
+		if line == name {
+			return i
+		}
+		if disabled, ok := disabledRecipe(line); ok && disabled == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// addRecipe appends an enabled recipe to the recipe list file.
+func addRecipe(path, name string) error {
+	if !validRecipeName(name) {
+		return errInvalidRecipe
+	}
+	return editRecipes(path, func(lines []string) ([]string, error) {
+		if findRecipe(lines, name) >= 0 {
+			return nil, errRecipeExists
+		}
+		return append(lines, name), nil
+	})
+}
+
+// removeRecipe removes an enabled or disabled recipe from the recipe list file.
+func removeRecipe(path, name string) error {
+	return editRecipes(path, func(lines []string) ([]string, error) {
+		i := findRecipe(lines, name)
+		if i < 0 {
+			return nil, errRecipeNotFound
+		}
+		return append(lines[:i], lines[i+1:]...), nil
+	})
+}
+
+// setRecipeEnabled comments out or uncomments a recipe in the recipe list file.
+func setRecipeEnabled(path, name string, enabled bool) error {
+	return editRecipes(path, func(lines []string) ([]string, error) {
+		i := findRecipe(lines, name)
+		if i < 0 {
+			return nil, errRecipeNotFound
+		}
+		if enabled {
+			lines[i] = name
+		} else {
+			lines[i] = "# " + name
+		}
+		return lines, nil
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// repoGit configures committing the changes to the metadata of a munki repo
+// which is a git work tree after each cycle.
+type repoGit struct {
+	Commit bool `toml:"commit"`
+	// Push pushes the commit to Remote, origin by default, and Branch, the
+	// current branch by default.
+	Push   bool   `toml:"push"`
+	Remote string `toml:"remote"`
+	Branch string `toml:"branch"`
+}
+
+// commitMessage lists the imports and catalog changes of a cycle.
+func commitMessage(status cycleStatus) string {
+	subject := "autopkgd: update repo metadata"
+	var imports []string
+	for _, item := range status.imports {
+		imports = append(imports, item.Name+" "+item.Version)
+	}
+	if len(imports) > 0 {
+		subject = "autopkgd: import " + strings.Join(imports, ", ")
+		if len(subject) > 72 {
+			subject = fmt.Sprintf("autopkgd: import %d items", len(imports))
+		}
+	}
+	var body []string
+	for _, item := range imports {
+		body = append(body, "- import "+item)
+	}
+	for _, change := range status.CatalogChanges {
+		body = append(body, "- "+change.String())
+	}
+	if len(body) == 0 {
+		return subject
+	}
+	return subject + "\n\n" + strings.Join(body, "\n")
+}
+
+// commitRepo commits and pushes what a cycle changed in the repo metadata.
+func (d *daemon) commitRepo(status cycleStatus) {
+	conf := d.conf.RepoGit
+	if !conf.Commit {
+		return
+	}
+	// finish even when shutting down, the changes are already made.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	repo := d.conf.MunkiRepoPath
+	commit, err := gitCommit(ctx, repo, commitMessage(status))
+	if err == nil && conf.Push && strings.HasPrefix(commit, "commit ") {
+		remote, branch := conf.Remote, conf.Branch
+		if remote == "" {
+			remote = "origin"
+		}
+		if branch == "" {
+			branch = "HEAD"
+		}
+		if err = runCommand(ctx, nil, "git", "-C", repo, "push", "-q", remote, branch); err != nil {
+			err = fmt.Errorf("pushing %s: %v", commit, err)
+		}
+	}
+	if err != nil {
+		msg := fmt.Sprintf("committing the munki repo changes: %v", err)
+		log.Println(msg)
+		if d.slack {
+			if err := postSlack(d.conf.Slack, msg); err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
+	log.Printf("munki repo: %s", commit)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// lockRepo takes an advisory flock on the repo lock file, waiting until it
+// is available or ctx is done. Recipe runs share the lock with each other,
+// makecatalogs and people running munkiimport by hand take it exclusively.
+// The returned function releases the lock.
+func lockRepo(ctx context.Context, path string, exclusive bool) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	waiting := false
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, err
+		}
+		if !waiting {
+			log.Printf("waiting for the repo lock %s", path)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// runLock implements `autopkgd lock -- command`, which runs a command with
+// the repo lock held exclusively, e.g. munkiimport or makecatalogs by hand.
+func runLock(args []string) int {
+	var (
+		flags   = flag.NewFlagSet("lock", flag.ExitOnError)
+		fConfig = flags.String("config", "", "configuration file to load")
+	)
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Println("usage: autopkgd lock [-config file] -- command [args...]")
+		return 1
+	}
+	conf, err := loadConfig(*fConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.RepoLock == "" {
+		fmt.Println("you must specify repo_lock in your config")
+		return 1
+	}
+
+	unlock, err := lockRepo(context.Background(), conf.RepoLock, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer unlock()
+	cmd := exec.Command(flags.Arg(0), flags.Args()[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return exit.ExitCode()
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runReport implements `autopkgd report recipe`, which prints the summary
+// results and failures of the last report of a recipe and its recent runs
+// from the history.
+func runReport(args []string) int {
+	var (
+		flags   = flag.NewFlagSet("report", flag.ExitOnError)
+		fConfig = flags.String("config", "", "configuration file to load")
+		fLast   = flags.Int("last", 5, "number of runs from the history to show")
+		fJSON   = flags.Bool("json", false, "print JSON instead of text")
+	)
+	flags.Parse(args)
+	// allow the flags after the recipe as well, e.g. report Firefox.munki -last 3.
+	if flags.NArg() > 1 {
+		rest := flags.Args()
+		flags.Parse(rest[1:])
+		if flags.NArg() == 0 {
+			flags.Parse(rest[:1])
+		}
+	}
+	if flags.NArg() != 1 {
+		fmt.Println("usage: autopkgd report [-config file] [-last N] [-json] recipe")
+		return 1
+	}
+	recipe := flags.Arg(0)
+
+	conf, err := loadConfig(*fConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var runs []runRecord
+	if conf.HistoryFile != "" {
+		records, err := readHistory(conf.HistoryFile, time.Time{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i := len(records) - 1; i >= 0 && len(runs) < *fLast; i-- {
+			if records[i].Recipe == recipe {
+				runs = append(runs, records[i])
+			}
+		}
+	}
+	var last *runRecord
+	if len(runs) > 0 {
+		last = &runs[0]
+	}
+	reportPath := conf.lastReportFile(recipe, last)
+	var report *autopkgReport
+	var reportTime time.Time
+	if r, err := readReportPlist(reportPath); err == nil {
+		report = &r
+		if fi, err := os.Stat(reportPath); err == nil {
+			reportTime = fi.ModTime()
+		}
+	} else if !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	if report == nil && len(runs) == 0 {
+		fmt.Printf("no report or history for %s\n", recipe)
+		return 1
+	}
+
+	if *fJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(struct {
+			Recipe string         `json:"recipe"`
+			Report *autopkgReport `json:"report"`
+			Runs   []runRecord    `json:"runs"`
+		}{recipe, report, runs})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return 0
+	}
+
+	if report != nil {
+		fmt.Printf("%s, last report %s\n", recipe, reportTime.Local().Format("2006-01-02 15:04:05"))
+		printReport(*report)
+	}
+	if len(runs) > 0 {
+		fmt.Println("\nrecent runs:")
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, rec := range runs {
+			var items []string
+			for _, item := range rec.Imports {
+				items = append(items, item.Name+" "+item.Version)
+			}
+			for _, f := range rec.Failures {
+				items = append(items, f.Message)
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%v\t%s\n", rec.Start.Local().Format("2006-01-02 15:04"), rec.result(), rec.Duration.Round(time.Second), strings.Join(items, "; "))
+		}
+		w.Flush()
+	}
+	return 0
+}
+
+// printReport prints the summary results of a report as tables, followed by
+// its failures.
+func printReport(report autopkgReport) {
+	var names []string
+	for name, summary := range report.SummaryResults {
+		if len(summary.DataRows) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 && len(report.Failures) == 0 {
+		fmt.Println("  nothing new")
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		summary := report.SummaryResults[name]
+		fmt.Printf("\n  %s:\n", strings.Replace(strings.TrimSuffix(name, "_summary_result"), "_", " ", -1))
+		header := summary.Header
+		if len(header) == 0 {
+			// without a header, show every key of the rows.
+			seen := make(map[string]bool)
+			for _, row := range summary.DataRows {
+				for key := range row {
+					if !seen[key] {
+						seen[key] = true
+						header = append(header, key)
+					}
+				}
+			}
+			sort.Strings(header)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "    %s\n", strings.Join(header, "\t"))
+		for _, row := range summary.DataRows {
+			var cells []string
+			for _, key := range header {
+				cells = append(cells, fmt.Sprint(row[key]))
+			}
+			fmt.Fprintf(w, "    %s\n", strings.Join(cells, "\t"))
+		}
+		w.Flush()
+	}
+	if len(report.Failures) > 0 {
+		fmt.Println("\n  failures:")
+		for _, f := range report.Failures {
+			fmt.Printf("    %s: %s\n", f.Recipe, f.Message)
+			if f.Traceback != "" {
+				for _, line := range strings.Split(strings.TrimSpace(f.Traceback), "\n") {
+					fmt.Println("      " + line)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// reportFileData is what the report_filename template is executed with.
+type reportFileData struct {
+	// Recipe is the recipe, e.g. Firefox.munki, and Name and Type its
+	// parts, Firefox and munki.
+	Recipe string
+	Name   string
+	Type   string
+	// Timestamp and Date are when the run started, as 20060102-150405
+	// and 2006-01-02.
+	Timestamp string
+	Date      string
+}
+
+// parseReportFilename parses the report_filename template, which defaults
+// to the recipe name, and checks it makes a file name.
+func parseReportFilename(text string) (*template.Template, error) {
+	if text == "" {
+		text = "{{.Recipe}}"
+	}
+	tmpl, err := template.New("report_filename").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("report_filename: %v", err)
+	}
+	if _, err := executeReportFilename(tmpl, "Example.munki", time.Now()); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func executeReportFilename(tmpl *template.Template, recipe string, start time.Time) (string, error) {
+	name, typ := recipe, ""
+	if i := strings.LastIndex(recipe, "."); i > 0 {
+		name, typ = recipe[:i], recipe[i+1:]
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, reportFileData{
+		Recipe:    recipe,
+		Name:      name,
+		Type:      typ,
+		Timestamp: start.Format("20060102-150405"),
+		Date:      start.Format("2006-01-02"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("report_filename: %v", err)
+	}
+	file := filepath.Clean(strings.TrimSpace(buf.String()))
+	if file == "." || strings.HasSuffix(buf.String(), "/") {
+		return "", fmt.Errorf("report_filename: %q is not a file name", buf.String())
+	}
+	if !filepath.IsAbs(file) && (file == ".." || strings.HasPrefix(file, "../")) {
+		return "", fmt.Errorf("report_filename: %s is outside reports_path", file)
+	}
+	return file, nil
+}
+
+// reportFile returns where the report of a run of recipe started at start is
+// kept: the report_filename template relative to reports_path, or as is
+// when it is absolute, e.g. on another volume.
+func (conf Config) reportFile(recipe string, start time.Time) string {
+	file := recipe
+	// the template was parsed and checked when the config was loaded.
+	if conf.reportFilename != nil {
+		if f, err := executeReportFilename(conf.reportFilename, recipe, start); err == nil {
+			file = f
+		}
+	}
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(conf.ReportsPath, file)
+}
+
+// lastReportFile returns the report of the last run of recipe, rec if it is
+// known.
+func (conf Config) lastReportFile(recipe string, rec *runRecord) string {
+	if rec != nil && rec.Report != "" {
+		return rec.Report
+	}
+	return conf.reportFile(recipe, time.Now())
+}
+
+// verboseLogFile returns where the verbose autopkg output of the run whose
+// report is kept at reportPath goes, next to the report.
+func verboseLogFile(reportPath string) string {
+	return strings.TrimSuffix(reportPath, ".plist") + ".log"
+}
+
+// childPaths are the paths the children's account must be able to write to:
+// the repo, the reports, the directories report_filename puts the reports
+// of the recipe list in, and the autopkg cache.
+func (conf Config) childPaths() []string {
+	paths := []string{conf.MunkiRepoPath, conf.ReportsPath}
+	seen := map[string]bool{filepath.Clean(conf.ReportsPath): true}
+	recipes, _ := readRecipes(conf.RecipesFile)
+	for _, recipe := range recipes {
+		dir := filepath.Dir(conf.reportFile(recipe, time.Now()))
+		if !seen[dir] {
+			seen[dir] = true
+			paths = append(paths, dir)
+		}
+	}
+	return append(paths, autopkgCachePath(conf.Disk.AutopkgCachePath))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// cyclePush is a cycle summary pushed to the central collector of
+// report_push_url, which gathers the cycles of the daemons of every site.
+type cyclePush struct {
+	// Node is the aggregator node name, the hostname by default.
+	Node    string      `json:"node"`
+	Version string      `json:"version"`
+	Cycle   cycleStatus `json:"cycle"`
+}
+
+// validateReportPush checks the collector is reached over HTTPS, so the
+// token isn't sent in the clear.
+func validateReportPush(pushURL string) error {
+	if pushURL == "" {
+		return nil
+	}
+	u, err := url.Parse(pushURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("report_push_url must be an https URL, not %q", pushURL)
+	}
+	return nil
+}
+
+// pushCycle posts the summary of a cycle to the collector, with token as a
+// bearer token.
+func pushCycle(pushURL, token, node string, status cycleStatus) error {
+	if pushURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(cyclePush{Node: node, Version: Version, Cycle: status})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", pushURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := aggregatorClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("report push to %s: %s: %s", pushURL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+// repoSync configures copying the munki repo to an S3 bucket with the aws
+// command line tool, after the catalogs were rebuilt, for repos served from
+// S3 or CloudFront.
+type repoSync struct {
+	// Bucket is the destination, e.g. s3://munki-repo or s3://bucket/repo.
+	// Sync is disabled without it.
+	Bucket  string `toml:"bucket"`
+	AWSPath string `toml:"aws_path"`
+	// Profile, or the access key, select the credentials. Without either the
+	// aws tool finds credentials the usual way, e.g. from an instance role.
+	Profile         string `toml:"profile"`
+	Region          string `toml:"region"`
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	// syncOptions, whose Exclude are aws --exclude patterns such as
+	// "*.DS_Store".
+	syncOptions
+	// CloudFrontDistribution is invalidated after the sync, so clients see
+	// the new catalogs at once.
+	CloudFrontDistribution string `toml:"cloudfront_distribution"`
+}
+
+// syncOptions are the settings every repo sync has.
+type syncOptions struct {
+	// Delete removes what is gone from the repo from the destination.
+	Delete bool `toml:"delete"`
+	// Exclude are patterns of the files which aren't copied, in the syntax
+	// of the sync tool.
+	Exclude []string `toml:"exclude"`
+	// DryRun only logs what the sync tool would copy, and skips the cache
+	// invalidation.
+	DryRun bool `toml:"dry_run"`
+}
+
+// syncCommand is a sync of the repo with a command line tool, and the
+// commands which invalidate the CDN in front of the destination after it.
+type syncCommand struct {
+	tool string
+	env  []string
+	// dest is where the repo is copied, as it is logged.
+	dest string
+	args []string
+	// cdn names what invalidate clears, for the dry run log.
+	cdn        string
+	invalidate [][]string
+}
+
+// syncFlags are the command line flags of the sync tool for the options.
+type syncFlags struct {
+	delete  string
+	exclude func(patterns []string) []string
+	dryRun  string
+}
+
+// repeatedFlag passes each pattern with its own flag.
+func repeatedFlag(flag string) func(patterns []string) []string {
+	return func(patterns []string) []string {
+		var args []string
+		for _, pattern := range patterns {
+			args = append(args, flag, pattern)
+		}
+		return args
+	}
+}
+
+// flags appends the flags for the options to args.
+func (o syncOptions) flags(args []string, f syncFlags) []string {
+	if o.Delete {
+		args = append(args, f.delete)
+	}
+	if len(o.Exclude) > 0 {
+		args = append(args, f.exclude(o.Exclude)...)
+	}
+	if o.DryRun {
+		args = append(args, f.dryRun)
+	}
+	return args
+}
+
+// run runs the sync, then the invalidation unless it was a dry run, within
+// execTimeout seconds.
+func (o syncOptions) run(ctx context.Context, repoPath string, execTimeout time.Duration, s syncCommand) error {
+	ctx, cancel := withExecTimeout(ctx, time.Second*execTimeout)
+	defer cancel()
+	output := func(b []byte) { log.Println(string(b)) }
+	log.Printf("syncing %s to %s", repoPath, s.dest)
+	if err := runCommandEnv(ctx, s.env, output, s.tool, s.args...); err != nil {
+		return err
+	}
+	if len(s.invalidate) == 0 {
+		return nil
+	}
+	if o.DryRun {
+		log.Printf("dry run, not invalidating %s", s.cdn)
+		return nil
+	}
+	for _, args := range s.invalidate {
+		if err := runCommandEnv(ctx, s.env, output, s.tool, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invalidatedPaths are the paths of the repo which change on every rebuild,
+// and are invalidated in a CDN after a sync.
+var invalidatedPaths = []string{"/catalogs/*", "/manifests/*", "/icons/*"}
+
+// sync copies the files of the repo which changed to the bucket. aws s3 sync
+// compares sizes and modification times, so only the new and changed files
+// are uploaded.
+func (c repoSync) sync(ctx context.Context, repoPath string, execTimeout time.Duration) error {
+	if c.Bucket == "" {
+		return nil
+	}
+	s := syncCommand{tool: c.AWSPath, dest: c.Bucket}
+	if s.tool == "" {
+		s.tool = "/usr/local/bin/aws"
+	}
+	if c.AccessKeyID != "" {
+		s.env = append(s.env, "AWS_ACCESS_KEY_ID="+c.AccessKeyID, "AWS_SECRET_ACCESS_KEY="+c.SecretAccessKey)
+	}
+	var global []string
+	if c.Profile != "" {
+		global = append(global, "--profile", c.Profile)
+	}
+	if c.Region != "" {
+		global = append(global, "--region", c.Region)
+	}
+
+	s.args = append([]string{"s3", "sync", strings.TrimSuffix(repoPath, "/") + "/", c.Bucket, "--no-progress"}, global...)
+	s.args = c.flags(s.args, syncFlags{
+		delete:  "--delete",
+		exclude: repeatedFlag("--exclude"),
+		dryRun:  "--dryrun",
+	})
+	if c.CloudFrontDistribution != "" {
+		s.cdn = "CloudFront distribution " + c.CloudFrontDistribution
+		args := append([]string{"cloudfront", "create-invalidation", "--distribution-id", c.CloudFrontDistribution, "--paths"}, invalidatedPaths...)
+		s.invalidate = [][]string{append(args, global...)}
+	}
+	return c.run(ctx, repoPath, execTimeout, s)
+}
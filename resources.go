@@ -0,0 +1,51 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+)
+
+// resourceConfig lowers the priority of autopkg and makecatalogs and limits
+// their resources, so imports don't make a shared build Mac unusable.
+type resourceConfig struct {
+	// Nice is the niceness children run with, 0 to 19.
+	Nice int `toml:"nice"`
+	// Background runs children with taskpolicy -b on macOS, which throttles
+	// CPU and disk I/O, or ionice -c3 on Linux.
+	Background bool `toml:"background"`
+	// CPUSeconds and MemoryMB set resource limits on each child. The memory
+	// limit is the address space limit, which macOS does not enforce.
+	CPUSeconds int `toml:"cpu_seconds"`
+	MemoryMB   int `toml:"memory_mb"`
+}
+
+// childResources applies to every command autopkgd runs. It is set once at
+// startup from the config.
+var childResources resourceConfig
+
+// wrap returns the command line which runs name with the configured
+// priority and limits.
+func (c resourceConfig) wrap(name string, args []string) (string, []string) {
+	argv := append([]string{name}, args...)
+	if c.CPUSeconds > 0 || c.MemoryMB > 0 {
+		script := ""
+		if c.CPUSeconds > 0 {
+			script += "ulimit -t " + strconv.Itoa(c.CPUSeconds) + " && "
+		}
+		if c.MemoryMB > 0 {
+			script += "ulimit -v " + strconv.Itoa(c.MemoryMB*1024) + " && "
+		}
+		argv = append([]string{"/bin/sh", "-c", script + `exec "$@"`, "sh"}, argv...)
+	}
+	if c.Background {
+		if runtime.GOOS == "darwin" {
+			argv = append([]string{"/usr/sbin/taskpolicy", "-b"}, argv...)
+		} else {
+			argv = append([]string{"ionice", "-c3"}, argv...)
+		}
+	}
+	if c.Nice > 0 {
+		argv = append([]string{"nice", "-n", strconv.Itoa(c.Nice)}, argv...)
+	}
+	return argv[0], argv[1:]
+}
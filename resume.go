@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// cycleState is the progress of the running cycle, persisted so a cycle
+// interrupted by a crash or shutdown resumes on the next start.
+type cycleState struct {
+	Start time.Time `json:"start"`
+	// Remaining are the recipes which have not finished.
+	Remaining []string `json:"remaining"`
+	// Imported is set when a recipe imported something, so the catalogs
+	// still need to be rebuilt.
+	Imported bool `json:"imported"`
+}
+
+func readCycleState(path string) (*cycleState, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state cycleState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// saveCycleState writes the state of the running cycle, if a state file is
+// configured.
+func (d *daemon) saveCycleState(state cycleState) {
+	if d.conf.CycleStateFile == "" {
+		return
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := writeFileAtomic(d.conf.CycleStateFile, b, 0644); err != nil {
+		log.Println(err)
+	}
+}
+
+// clearCycleState removes the state file once a cycle has completed.
+func (d *daemon) clearCycleState() {
+	if d.conf.CycleStateFile == "" {
+		return
+	}
+	if err := os.Remove(d.conf.CycleStateFile); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+}
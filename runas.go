@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// runAsConfig configures a dedicated account autopkg, makecatalogs and the
+// other commands autopkgd runs are run as, so they don't run as root or as
+// the logged in admin.
+type runAsConfig struct {
+	// User is a user name or uid. The section is disabled without it.
+	User string `toml:"user"`
+	// Group is a group name or gid, it defaults to the user's primary group.
+	Group string `toml:"group"`
+}
+
+// account is the user and groups children run as.
+type account struct {
+	name     string
+	home     string
+	uid, gid uint32
+	groups   []uint32
+}
+
+// childAccount is the account every command autopkgd runs is run as, or nil
+// to run them as autopkgd's own user. It is set once at startup from the
+// config.
+var childAccount *account
+
+// lookup resolves the configured user and group. It returns nil without a
+// user, or if it is the user autopkgd already runs as.
+func (c runAsConfig) lookup() (*account, error) {
+	if c.User == "" {
+		return nil, nil
+	}
+	u, err := user.Lookup(c.User)
+	if err != nil {
+		if u, err = user.LookupId(c.User); err != nil {
+			return nil, fmt.Errorf("run_as: unknown user %s", c.User)
+		}
+	}
+	gid := u.Gid
+	if c.Group != "" {
+		g, err := user.LookupGroup(c.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(c.Group); err != nil {
+				return nil, fmt.Errorf("run_as: unknown group %s", c.Group)
+			}
+		}
+		gid = g.Gid
+	}
+	a := &account{name: u.Username, home: u.HomeDir}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("run_as: uid of %s: %v", u.Username, err)
+	}
+	a.uid = uint32(uid)
+	n, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("run_as: gid of %s: %v", u.Username, err)
+	}
+	a.gid = uint32(n)
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("run_as: groups of %s: %v", u.Username, err)
+	}
+	for _, id := range ids {
+		if n, err := strconv.ParseUint(id, 10, 32); err == nil {
+			a.groups = append(a.groups, uint32(n))
+		}
+	}
+
+	if int(a.uid) == os.Geteuid() && int(a.gid) == os.Getegid() {
+		return nil, nil
+	}
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("run_as: autopkgd must run as root to run commands as %s", a.name)
+	}
+	return a, nil
+}
+
+// credential makes a command run as the account.
+func (a *account) credential() *syscall.Credential {
+	return &syscall.Credential{Uid: a.uid, Gid: a.gid, Groups: a.groups}
+}
+
+// env points HOME at the account's home, so autopkg uses its preferences
+// and cache.
+func (a *account) env() []string {
+	return []string{"HOME=" + a.home, "USER=" + a.name, "LOGNAME=" + a.name}
+}
+
+// mkdirAllForChild creates dir and its missing parents, owned by the
+// children's account so autopkg can write into them.
+func mkdirAllForChild(dir string) error {
+	var missing []string
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || filepath.Dir(d) == d {
+			break
+		}
+		missing = append(missing, d)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if childAccount == nil {
+		return nil
+	}
+	for _, d := range missing {
+		if err := os.Chown(d, int(childAccount.uid), int(childAccount.gid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkChildAccess returns an error for each of paths the children's account
+// can't write to. A path which doesn't exist yet is checked by its nearest
+// existing parent, where it would be created.
+func checkChildAccess(paths ...string) []error {
+	var errs []error
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		dir := filepath.Clean(path)
+		for {
+			if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		cmd := newCommand(ctx, "/bin/sh", "-c", `test -w "$1" && test -x "$1"`, "sh", dir)
+		start := time.Now()
+		err := cmd.Run()
+		auditCommand(ctx, cmd, start, err)
+		cancel()
+		if err != nil {
+			who := "autopkgd"
+			if childAccount != nil {
+				who = childAccount.name
+			}
+			errs = append(errs, fmt.Errorf("%s is not writable by %s", path, who))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// scriptTimeout bounds a single run of a report script, so a script which
+// loops forever can't hold up the slack messages.
+const scriptTimeout = time.Second
+
+// reportScript is a short Lua script which filters, rewrites or routes the
+// report events posted to slack, e.g. to ignore point releases of one app or
+// send another to a different channel. The event is in the global event
+// table; the script rewrites the message by setting event.text and acts by
+// calling drop() and route(channel). Script is the source, or File a file
+// holding it.
+type reportScript struct {
+	Name   string `toml:"name"`
+	Script string `toml:"script"`
+	File   string `toml:"file"`
+
+	// proto is the script compiled when the config is loaded, so editing
+	// the file takes a restart like the rest of the config.
+	proto *lua.FunctionProto
+}
+
+type reportScripts []reportScript
+
+// reportEvent is a single message about a recipe run: a failure, download,
+// import, Jamf Pro update or VirusTotal warning.
+type reportEvent struct {
+	Type    string
+	Recipe  string
+	Name    string
+	Version string
+	// Text is the message which will be posted.
+	Text string
+}
+
+// eventOutcome is what a script decided about an event.
+type eventOutcome struct {
+	drop    bool
+	channel string
+	text    string
+}
+
+// compile parses the script into a function which can be run in any Lua
+// state.
+func (s reportScript) compile() (*lua.FunctionProto, error) {
+	src := s.Script
+	if s.File != "" {
+		b, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return nil, err
+		}
+		src = string(b)
+	}
+	chunk, err := parse.Parse(strings.NewReader(src), s.Name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, s.Name)
+}
+
+// newScriptState returns a Lua state with only the base, string, table and
+// math libraries, without the functions which load code or files, and with
+// the functions scripts act through. print goes to the daemon log.
+func newScriptState(name string, out *eventOutcome) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.StringLibName, lua.OpenString},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, unsafe := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(unsafe, lua.LNil)
+	}
+	fns := map[string]lua.LGFunction{
+		"drop": func(L *lua.LState) int {
+			out.drop = true
+			return 0
+		},
+		"route": func(L *lua.LState) int {
+			out.channel = L.CheckString(1)
+			return 0
+		},
+		// glob matches a shell pattern, such as GoogleChrome*.
+		"glob": func(L *lua.LState) int {
+			ok, _ := path.Match(L.CheckString(1), L.CheckString(2))
+			L.Push(lua.LBool(ok))
+			return 1
+		},
+		// match matches a Go regular expression, for what Lua patterns
+		// can't express.
+		"match": func(L *lua.LState) int {
+			ok, err := regexp.MatchString(L.CheckString(1), L.CheckString(2))
+			if err != nil {
+				L.RaiseError("match: %v", err)
+			}
+			L.Push(lua.LBool(ok))
+			return 1
+		},
+		"print": func(L *lua.LState) int {
+			var args []string
+			for i := 1; i <= L.GetTop(); i++ {
+				args = append(args, L.ToStringMeta(L.Get(i)).String())
+			}
+			log.Printf("report script %s: %s", name, strings.Join(args, " "))
+			return 0
+		},
+	}
+	for name, fn := range fns {
+		L.SetGlobal(name, L.NewFunction(fn))
+	}
+	return L
+}
+
+// run runs the compiled script on an event.
+func (s reportScript) run(proto *lua.FunctionProto, ev reportEvent) (eventOutcome, error) {
+	out := eventOutcome{text: ev.Text}
+	L := newScriptState(s.Name, &out)
+	defer L.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	event := L.NewTable()
+	for k, v := range map[string]string{
+		"type":    ev.Type,
+		"recipe":  ev.Recipe,
+		"name":    ev.Name,
+		"version": ev.Version,
+		"text":    ev.Text,
+	} {
+		event.RawSetString(k, lua.LString(v))
+	}
+	L.SetGlobal("event", event)
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		return out, err
+	}
+	switch text := event.RawGetString("text").(type) {
+	case lua.LString:
+		out.text = string(text)
+	case *lua.LNilType:
+	default:
+		return out, fmt.Errorf("event.text must be a string, not %s", text.Type())
+	}
+	return out, nil
+}
+
+// validate compiles the scripts, so mistakes show up when the config is
+// loaded rather than when the first event is posted, and keeps them
+// compiled.
+func (s reportScripts) validate() error {
+	for i, script := range s {
+		if script.Name == "" {
+			return fmt.Errorf("report_scripts: name is required")
+		}
+		if (script.Script == "") == (script.File == "") {
+			return fmt.Errorf("report_scripts: %s: one of script and file is required", script.Name)
+		}
+		proto, err := script.compile()
+		if err != nil {
+			return fmt.Errorf("report_scripts: %s: %v", script.Name, err)
+		}
+		s[i].proto = proto
+	}
+	return nil
+}
+
+// process runs the scripts in order on an event. It returns the text to
+// post and the channel to post it to, empty for the default one, or false
+// if a script dropped the event. A script which fails is logged and doesn't
+// change the event.
+func (s reportScripts) process(ev reportEvent) (text, channel string, ok bool) {
+	for _, script := range s {
+		if script.proto == nil {
+			log.Printf("report script %s: not compiled", script.Name)
+			continue
+		}
+		out, err := script.run(script.proto, ev)
+		if err != nil {
+			log.Printf("report script %s: %v", script.Name, err)
+			continue
+		}
+		if out.drop {
+			return "", "", false
+		}
+		ev.Text = out.text
+		if out.channel != "" {
+			channel = out.channel
+		}
+	}
+	return ev.Text, channel, true
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aggregator configures pushing every run record to an `autopkgd server`,
+// which combines the runs of several worker machines.
+type aggregator struct {
+	URL   string `toml:"url"`
+	Token string `toml:"token"`
+	// Node names this machine on the server, the hostname by default.
+	Node string `toml:"node"`
+}
+
+// serverConfig configures `autopkgd server`. The server listens with the
+// settings of the [api] section.
+type serverConfig struct {
+	// Database is the JSON lines file the pushed runs are kept in.
+	Database string `toml:"database"`
+}
+
+// fleetRun is a run record pushed by a worker.
+type fleetRun struct {
+	Node   string    `json:"node"`
+	Record runRecord `json:"record"`
+}
+
+var aggregatorClient = &http.Client{Timeout: 10 * time.Second}
+
+func (c aggregator) node() string {
+	if c.Node != "" {
+		return c.Node
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// pushRun sends a run record to the server.
+func (c aggregator) pushRun(rec runRecord) error {
+	if c.URL == "" {
+		return nil
+	}
+	body, err := json.Marshal(fleetRun{Node: c.node(), Record: rec})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.URL, "/")+"/ingest", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	resp, err := aggregatorClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("push to %s: %s: %s", c.URL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// fleetServer aggregates the runs pushed by workers.
+type fleetServer struct {
+	conf Config
+
+	mu sync.Mutex
+	// last is the last run of each recipe, by node.
+	last   map[string]map[string]runRecord
+	recent []fleetRun
+}
+
+func newFleetServer(conf Config) (*fleetServer, error) {
+	s := &fleetServer{conf: conf, last: make(map[string]map[string]runRecord)}
+	f, err := os.Open(conf.Server.Database)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var run fleetRun
+		if err := json.Unmarshal(scanner.Bytes(), &run); err != nil {
+			return nil, err
+		}
+		s.add(run)
+	}
+	return s, scanner.Err()
+}
+
+// add updates the in memory state with a run. The caller must hold mu, or
+// be the only user of s.
+func (s *fleetServer) add(run fleetRun) {
+	if s.last[run.Node] == nil {
+		s.last[run.Node] = make(map[string]runRecord)
+	}
+	s.last[run.Node][run.Record.Recipe] = run.Record
+	s.recent = append(s.recent, run)
+	if len(s.recent) > recentRuns {
+		s.recent = s.recent[len(s.recent)-recentRuns:]
+	}
+}
+
+func (s *fleetServer) handler() http.Handler {
+	protect := func(h http.HandlerFunc) http.Handler {
+		return requireAuth(s.conf.API, h)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/ingest", protect(s.handleIngest))
+	mux.Handle("/nodes", protect(s.handleNodes))
+	mux.Handle("/recipes", protect(s.handleRecipes))
+	mux.Handle("/reports", protect(s.handleReports))
+	mux.Handle("/ui/", dashboardHandler())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		http.Redirect(w, r, "/ui/fleet.html", http.StatusFound)
+	})
+	return mux
+}
+
+// handleIngest stores a run pushed by a worker.
+func (s *fleetServer) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	var run fleetRun
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20)).Decode(&run); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid run: "+err.Error())
+		return
+	}
+	if run.Node == "" || run.Record.Recipe == "" {
+		writeError(w, http.StatusBadRequest, "node and record.recipe are required")
+		return
+	}
+
+	b, err := json.Marshal(run)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := appendLine(s.conf.Server.Database, b, 0644); err != nil {
+		log.Println(err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.add(run)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "stored"})
+}
+
+type nodeStatus struct {
+	Node     string    `json:"node"`
+	LastSeen time.Time `json:"last_seen"`
+	Recipes  int       `json:"recipes"`
+	Failed   int       `json:"failed"`
+}
+
+// handleNodes lists the workers with the number of recipes and failing
+// recipes of each.
+func (s *fleetServer) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	s.mu.Lock()
+	nodes := []nodeStatus{}
+	for node, last := range s.last {
+		status := nodeStatus{Node: node, Recipes: len(last)}
+		for _, rec := range last {
+			if end := rec.Start.Add(rec.Duration); end.After(status.LastSeen) {
+				status.LastSeen = end
+			}
+			if len(rec.Failures) > 0 {
+				status.Failed++
+			}
+		}
+		nodes = append(nodes, status)
+	}
+	s.mu.Unlock()
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+	writeJSON(w, http.StatusOK, nodes)
+}
+
+// handleRecipes lists the last run of every recipe on every node.
+func (s *fleetServer) handleRecipes(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	s.mu.Lock()
+	runs := []fleetRun{}
+	for node, last := range s.last {
+		for _, rec := range last {
+			runs = append(runs, fleetRun{Node: node, Record: rec})
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].Record.Recipe != runs[j].Record.Recipe {
+			return runs[i].Record.Recipe < runs[j].Record.Recipe
+		}
+		return runs[i].Node < runs[j].Node
+	})
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// handleReports returns the most recent runs, newest first, optionally of a
+// single node.
+func (s *fleetServer) handleReports(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	_, limit, err := pagination(r, 50)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	node := r.URL.Query().Get("node")
+	runs := []fleetRun{}
+	s.mu.Lock()
+	for i := len(s.recent) - 1; i >= 0 && len(runs) < limit; i-- {
+		if node == "" || s.recent[i].Node == node {
+			runs = append(runs, s.recent[i])
+		}
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// runServer implements `autopkgd server`.
+func runServer(args []string) int {
+	var (
+		flags   = flag.NewFlagSet("server", flag.ExitOnError)
+		fConfig = flags.String("config", "", "configuration file to load")
+	)
+	flags.Parse(args)
+
+	conf, err := loadConfig(*fConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := setupLogging(conf); err != nil {
+		log.Fatal(err)
+	}
+	if conf.API.Listen == "" || conf.Server.Database == "" {
+		fmt.Println("server mode requires listen in [api] and database in [server]")
+		return 1
+	}
+	if !conf.API.authEnabled() {
+		fmt.Println("server mode requires [[api.tokens]] or [[api.clients]], workers push with a trigger token")
+		return 1
+	}
+	s, err := newFleetServer(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("aggregating runs from %d nodes on %s", len(s.last), conf.API.Listen)
+	log.Fatal(listenAndServe(conf.API, s.handler()))
+	return 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// settings are the parts of the configuration which can be changed at
+// runtime through the API, without restarting the daemon.
+type settings struct {
+	MaxProcesses int `json:"max_processes"`
+	// CheckInterval is the time between scheduled cycles, in seconds.
+	CheckInterval int `json:"check_interval"`
+	// PausedRecipes are skipped by every cycle until they are resumed.
+	PausedRecipes []string `json:"paused_recipes"`
+}
+
+// settingsUpdate is a partial update of the settings. Unset fields are left
+// unchanged.
+type settingsUpdate struct {
+	MaxProcesses  *int     `json:"max_processes"`
+	CheckInterval *int     `json:"check_interval"`
+	PauseRecipes  []string `json:"pause_recipes"`
+	ResumeRecipes []string `json:"resume_recipes"`
+}
+
+// settings returns the current runtime settings.
+func (d *daemon) settings() settings {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := settings{
+		MaxProcesses:  d.workers.size(),
+		CheckInterval: int(d.checkInterval / time.Second),
+		PausedRecipes: []string{},
+	}
+	for recipe := range d.pausedRecipes {
+		s.PausedRecipes = append(s.PausedRecipes, recipe)
+	}
+	sort.Strings(s.PausedRecipes)
+	return s
+}
+
+func (u settingsUpdate) validate() error {
+	if u.MaxProcesses != nil && (*u.MaxProcesses < 1 || *u.MaxProcesses > maxProcessesLimit) {
+		return fmt.Errorf("max_processes must be between 1 and %d", maxProcessesLimit)
+	}
+	if u.CheckInterval != nil && *u.CheckInterval < 1 {
+		return errors.New("check_interval must be at least 1 second")
+	}
+	return nil
+}
+
+// updateSettings applies u. A changed limit on processes applies to the
+// running cycle as soon as a worker is free, a changed interval restarts the
+// schedule.
+func (d *daemon) updateSettings(u settingsUpdate) {
+	if u.MaxProcesses != nil {
+		d.workers.resize(*u.MaxProcesses)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if u.CheckInterval != nil {
+		d.checkInterval = time.Second * time.Duration(*u.CheckInterval)
+		if d.ticker != nil {
+			d.ticker.Reset(d.checkInterval)
+		}
+	}
+	for _, recipe := range u.PauseRecipes {
+		d.pausedRecipes[recipe] = true
+	}
+	for _, recipe := range u.ResumeRecipes {
+		delete(d.pausedRecipes, recipe)
+	}
+}
+
+func (d *daemon) isRecipePaused(recipe string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pausedRecipes[recipe]
+}
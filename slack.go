@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strings"
 )
 
 type slack struct {
@@ -14,6 +15,42 @@ type slack struct {
 	Channel    string `toml:"channel"`
 	Username   string `toml:"username"`
 	IconURL    string `toml:"icon_url"`
+	// CycleSummary posts a one line summary at the end of every cycle.
+	CycleSummary bool `toml:"cycle_summary"`
+	// SigningSecret enables interactive approval messages. It is used to
+	// verify the callbacks slack sends to /slack/actions.
+	SigningSecret string `toml:"signing_secret"`
+	// IconsURL is where the icons directory of the repo is served, e.g.
+	// https://munki.example.com/repo/icons. Import messages then show the
+	// icon of the item.
+	IconsURL string `toml:"icons_url"`
+	// IgnoreSummaryResults are the summary_results keys of the reports,
+	// e.g. url_downloader_summary_result, which aren't posted. The
+	// _summary_result suffix may be left out. The history keeps them.
+	IgnoreSummaryResults []string `toml:"ignore_summary_results"`
+}
+
+// withoutSummaries returns a copy of report without the ignored summary
+// results, and without the VirusTotal results if their summary is ignored.
+func withoutSummaries(report autopkgReport, ignore []string) autopkgReport {
+	if len(ignore) == 0 {
+		return report
+	}
+	summaries := make(map[string]processor, len(report.SummaryResults))
+	for k, v := range report.SummaryResults {
+		summaries[k] = v
+	}
+	for _, key := range ignore {
+		if !strings.HasSuffix(key, "_summary_result") {
+			key += "_summary_result"
+		}
+		delete(summaries, key)
+		if key == "virus_total_analyzer_summary_result" {
+			report.VirusTotal = nil
+		}
+	}
+	report.SummaryResults = summaries
+	return report
 }
 
 type slackMsg struct {
@@ -22,6 +59,8 @@ type slackMsg struct {
 	Text     string `json:"text"`
 	Parse    string `json:"parse"`
 	IconURL  string `json:"icon_url,omitempty"`
+
+	Blocks []map[string]interface{} `json:"blocks,omitempty"`
 }
 
 func (m slackMsg) Encode() (string, error) {
@@ -32,7 +71,17 @@ func (m slackMsg) Encode() (string, error) {
 	return string(b), nil
 }
 
+// Post sends the message, tagged with the output labels.
 func (m slackMsg) Post(WebhookURL string) error {
+	if prefix := outputLabels.prefix(); prefix != "" {
+		m.Text = prefix + m.Text
+		if len(m.Blocks) > 0 {
+			m.Blocks = append(m.Blocks, map[string]interface{}{
+				"type":     "context",
+				"elements": []map[string]string{{"type": "mrkdwn", "text": strings.TrimSpace(prefix)}},
+			})
+		}
+	}
 	encoded, err := m.Encode()
 	if err != nil {
 		return err
@@ -42,6 +91,7 @@ func (m slackMsg) Post(WebhookURL string) error {
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		return errors.New("Not OK")
@@ -49,37 +99,115 @@ func (m slackMsg) Post(WebhookURL string) error {
 	return nil
 }
 
-func notifySlack(reports <-chan autopkgReport, conf slack) {
-	msg := &slackMsg{
+// postSlack sends a single text message to the configured channel.
+func postSlack(conf slack, text string) error {
+	msg := slackMsg{
 		Channel:  conf.Channel,
 		Username: conf.Username,
+		Text:     text,
 		Parse:    "full",
 		IconURL:  conf.IconURL,
 	}
+	return msg.Post(conf.WebhookURL)
+}
+
+// notifySlack posts the failures, downloads, Jamf Pro updates, VirusTotal
+// warnings and imports of each report, as decided by the report scripts.
+func notifySlack(reports <-chan autopkgReport, conf slack, scripts reportScripts) {
+	// post sends an event, with blocks unless a script rewrote its text.
+	post := func(ev reportEvent, blocks []map[string]interface{}) error {
+		text, channel, ok := scripts.process(ev)
+		if !ok {
+			return nil
+		}
+		if channel == "" {
+			channel = conf.Channel
+		}
+		if text != ev.Text {
+			blocks = nil
+		}
+		msg := slackMsg{
+			Channel:  channel,
+			Username: conf.Username,
+			Text:     text,
+			Parse:    "full",
+			IconURL:  conf.IconURL,
+			Blocks:   blocks,
+		}
+		return msg.Post(conf.WebhookURL)
+	}
 
 	for report := range reports {
+		report = withoutSummaries(report, conf.IgnoreSummaryResults)
+		recipe := report.Recipe
+		for _, f := range report.Failures {
+			// signature failures were alerted on already.
+			if len(report.SignatureFailures) > 0 && isSignatureFailure(f) {
+				continue
+			}
+			text := "Failed: " + f.Recipe + ": " + f.Message
+			if report.TrustDiff != "" && isTrustFailure(f) {
+				text += "\n" + trustDiffSnippet(report.TrustDiff, report.TrustDiffURL)
+			}
+			if err := post(reportEvent{Type: "failure", Recipe: f.Recipe, Text: text}, nil); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+
 		if summary, ok := report.SummaryResults["url_downloader_summary_result"]; ok {
 			for _, row := range summary.DataRows {
-				downloaded := filepath.Base(row["download_path"].(string))
-				msg.Text = "New download: " + downloaded
-				err := msg.Post(conf.WebhookURL)
-				if err != nil {
+				path, _ := row["download_path"].(string)
+				downloaded := filepath.Base(path)
+				ev := reportEvent{Type: "download", Recipe: recipe, Name: downloaded, Text: "New download: " + downloaded}
+				if err := post(ev, nil); err != nil {
 					log.Println(err)
 					return
 				}
 			}
 		}
 
-		if summary, ok := report.SummaryResults["munki_importer_summary_result"]; ok {
-			for _, row := range summary.DataRows {
-				name := row["name"].(string)
-				version := row["version"].(string)
-				msg.Text = "New munki import: " + name + " " + version
-				err := msg.Post(conf.WebhookURL)
-				if err != nil {
-					log.Println(err)
-					return
-				}
+		for _, u := range jamfUpdates(report) {
+			text := "Jamf Pro " + u.Kind + " updated: " + u.Name
+			if u.Version != "" {
+				text += " " + u.Version
+			}
+			ev := reportEvent{Type: "jamf", Recipe: recipe, Name: u.Name, Version: u.Version, Text: text}
+			if err := post(ev, nil); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+
+		scans := ""
+		for _, r := range report.VirusTotal {
+			scans += " (" + r.String() + ")"
+		}
+		for _, r := range virusTotalWarnings(report.VirusTotal) {
+			ev := reportEvent{Type: "virustotal", Recipe: recipe, Name: r.Name, Text: ":warning: VirusTotal flagged " + r.Name + ": " + r.Ratio + " " + r.Permalink}
+			if err := post(ev, nil); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+
+		for _, item := range importedItems(report) {
+			var blocks []map[string]interface{}
+			if conf.IconsURL != "" && item.Icon != "" {
+				blocks = []map[string]interface{}{{
+					"type": "section",
+					"text": map[string]string{"type": "mrkdwn", "text": "New munki import: *" + item.Name + "* " + item.Version},
+					"accessory": map[string]string{
+						"type":      "image",
+						"image_url": strings.TrimSuffix(conf.IconsURL, "/") + "/" + (&url.URL{Path: item.Icon}).EscapedPath(),
+						"alt_text":  item.Name,
+					},
+				}}
+			}
+			ev := reportEvent{Type: "import", Recipe: recipe, Name: item.Name, Version: item.Version, Text: "New munki import: " + item.Name + " " + item.Version + scans}
+			if err := post(ev, blocks); err != nil {
+				log.Println(err)
+				return
 			}
 		}
 	}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// slowRecipes configures flagging recipe runs which take much longer than
+// usual, which often points at an upstream problem.
+type slowRecipes struct {
+	// Factor flags runs longer than Factor times the rolling average.
+	Factor float64 `toml:"factor"`
+	// Threshold flags runs longer than this many seconds.
+	Threshold time.Duration `toml:"threshold"`
+	// Window is the number of previous successful runs averaged per recipe.
+	Window int `toml:"window"`
+	// MinRuns is the number of previous runs required before Factor applies.
+	MinRuns int `toml:"min_runs"`
+}
+
+// durationTracker keeps the recent durations of successful runs per recipe,
+// separately for --check runs, which are much shorter than full runs.
+type durationTracker struct {
+	conf slowRecipes
+
+	mu        sync.Mutex
+	durations map[durationKey][]time.Duration
+}
+
+type durationKey struct {
+	recipe string
+	check  bool
+}
+
+// newDurationTracker returns a tracker seeded with the run history, or nil if
+// slow recipe detection is not configured.
+func newDurationTracker(conf slowRecipes, history []runRecord) *durationTracker {
+	if conf.Factor == 0 && conf.Threshold == 0 {
+		return nil
+	}
+	if conf.Window == 0 {
+		conf.Window = 10
+	}
+	if conf.MinRuns == 0 {
+		conf.MinRuns = 3
+	}
+	t := &durationTracker{conf: conf, durations: make(map[durationKey][]time.Duration)}
+	for _, rec := range history {
+		t.add(rec)
+	}
+	return t
+}
+
+func (t *durationTracker) add(rec runRecord) {
+	if len(rec.Failures) > 0 {
+		return
+	}
+	key := durationKey{rec.Recipe, rec.Check}
+	d := append(t.durations[key], rec.Duration)
+	if len(d) > t.conf.Window {
+		d = d[len(d)-t.conf.Window:]
+	}
+	t.durations[key] = d
+}
+
+func (t *durationTracker) average(key durationKey) (time.Duration, int) {
+	d := t.durations[key]
+	if len(d) == 0 {
+		return 0, 0
+	}
+	var total time.Duration
+	for _, duration := range d {
+		total += duration
+	}
+	return total / time.Duration(len(d)), len(d)
+}
+
+// observe reports whether rec is slow compared to the previous runs of the
+// recipe in the same mode, then adds it to the rolling average.
+func (t *durationTracker) observe(rec runRecord) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.add(rec)
+
+	if t.conf.Threshold != 0 && rec.Duration > time.Second*t.conf.Threshold {
+		log.Printf("%s took %v, longer than the %v threshold", rec.Recipe, rec.Duration.Round(time.Second), time.Second*t.conf.Threshold)
+		return true
+	}
+	avg, n := t.average(durationKey{rec.Recipe, rec.Check})
+	if t.conf.Factor != 0 && n >= t.conf.MinRuns && float64(rec.Duration) > t.conf.Factor*float64(avg) {
+		mode := ""
+		if rec.Check {
+			mode = " --check"
+		}
+		log.Printf("%s took %v, %.1fx its%s average of %v", rec.Recipe, rec.Duration.Round(time.Second), float64(rec.Duration)/float64(avg), mode, avg.Round(time.Second))
+		return true
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotConfig configures saving the catalogs, pkgsinfo and manifests of
+// the munki repo before each import cycle, so a bad recipe or cleanup can be
+// rolled back.
+type snapshotConfig struct {
+	// Method is copy, apfs or git. Snapshots are disabled without it.
+	//   copy copies the metadata into a new directory under Dir.
+	//   apfs takes a local APFS snapshot with tmutil, which needs root.
+	//   git commits the metadata in the repo, which must be a git work tree.
+	Method string `toml:"method"`
+	Dir    string `toml:"dir"`
+	// Keep is the number of copies kept in Dir, zero keeps them all.
+	Keep int `toml:"keep"`
+}
+
+// snapshotDirs are the directories of the repo which are snapshotted. The
+// installers under pkgs are never changed in place, so they're left out.
+var snapshotDirs = []string{"catalogs", "pkgsinfo", "manifests"}
+
+func (c snapshotConfig) validate() error {
+	switch c.Method {
+	case "", "apfs", "git":
+	case "copy":
+		if c.Dir == "" {
+			return fmt.Errorf("repo_snapshot dir is required with the copy method")
+		}
+	default:
+		return fmt.Errorf("repo_snapshot method must be copy, apfs or git, not %q", c.Method)
+	}
+	return nil
+}
+
+// snapshot saves the repo metadata and returns a description of where.
+func (c snapshotConfig) snapshot(ctx context.Context, repoPath string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	output := func(b []byte) { log.Println(string(b)) }
+	switch c.Method {
+	case "apfs":
+		return "APFS local snapshot", runCommand(ctx, output, "/usr/bin/tmutil", "localsnapshot")
+	case "git":
+		return gitCommit(ctx, repoPath, "autopkgd: snapshot before cycle")
+	}
+	dst := filepath.Join(c.Dir, time.Now().Format("20060102-150405.000"))
+	for _, dir := range snapshotDirs {
+		if err := copyTree(filepath.Join(repoPath, dir), filepath.Join(dst, dir)); err != nil {
+			os.RemoveAll(dst)
+			return "", err
+		}
+	}
+	return dst, c.prune()
+}
+
+// prune removes the oldest copies beyond Keep.
+func (c snapshotConfig) prune() error {
+	if c.Keep == 0 {
+		return nil
+	}
+	files, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+	var copies []string
+	for _, fi := range files {
+		if fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+			copies = append(copies, fi.Name())
+		}
+	}
+	// the names are timestamps, so they sort oldest first.
+	sort.Strings(copies)
+	for len(copies) > c.Keep {
+		if err := os.RemoveAll(filepath.Join(c.Dir, copies[0])); err != nil {
+			return err
+		}
+		copies = copies[1:]
+	}
+	return nil
+}
+
+// gitCommit commits the changes to the repo metadata, returning the commit
+// or that there was nothing to commit.
+func gitCommit(ctx context.Context, repoPath, message string) (string, error) {
+	git := func(args ...string) error {
+		return runCommand(ctx, func([]byte) {}, "git", append([]string{"-C", repoPath}, args...)...)
+	}
+	var dirs []string
+	for _, dir := range snapshotDirs {
+		if _, err := os.Stat(filepath.Join(repoPath, dir)); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	if err := git(append([]string{"add", "-A", "--"}, dirs...)...); err != nil {
+		return "", err
+	}
+	// diff --quiet exits 1 when something is staged.
+	if git("diff", "--cached", "--quiet") == nil {
+		return "no changes to commit", nil
+	}
+	if err := git("commit", "-q", "-m", message); err != nil {
+		return "", err
+	}
+	var head string
+	err := runCommand(ctx, func(b []byte) { head = string(b) }, "git", "-C", repoPath, "rev-parse", "--short", "HEAD")
+	return "commit " + head, err
+}
+
+// copyTree copies the files under src to dst, skipping a missing src.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == src {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target, fi.Mode().Perm())
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// snapshotRepo snapshots the repo before a cycle, alerting if it fails. The
+// cycle runs anyway.
+func (d *daemon) snapshotRepo() {
+	conf := d.conf.RepoSnapshot
+	if conf.Method == "" {
+		return
+	}
+	where, err := conf.snapshot(d.ctx, d.conf.MunkiRepoPath)
+	if err != nil {
+		msg := fmt.Sprintf("snapshotting the munki repo: %v", err)
+		log.Println(msg)
+		if d.slack {
+			if err := postSlack(d.conf.Slack, msg); err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
+	log.Printf("munki repo snapshot: %s", where)
+}
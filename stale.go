@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// staleRecipes configures alerting on recipes which haven't succeeded for a
+// while. A recipe which fails quickly every cycle is easy to miss among the
+// other failures, this catches it once it has been broken for long enough.
+type staleRecipes struct {
+	// After is the number of seconds without a successful run after which
+	// a recipe is stale. Stale recipes aren't tracked without it.
+	After time.Duration `toml:"after"`
+	// Exclude are recipe names or patterns which are never stale, e.g.
+	// recipes of apps which rarely release.
+	Exclude []string `toml:"exclude"`
+}
+
+func (s staleRecipes) validate() error {
+	for _, pattern := range s.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("stale_recipes: bad exclude pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// staleSince returns when the recipe last succeeded, or when the daemon
+// started if it never did, and whether that is longer ago than the stale
+// window. Paused recipes are never stale. d.mu must be held.
+func (d *daemon) staleSince(recipe string, now time.Time) (time.Time, bool) {
+	conf := d.conf.StaleRecipes
+	if conf.After == 0 || d.pausedRecipes[recipe] || (len(conf.Exclude) > 0 && matchAny(conf.Exclude, recipe)) {
+		return time.Time{}, false
+	}
+	since, ok := d.lastSuccess[recipe]
+	if !ok {
+		since = d.started
+	}
+	return since, now.Sub(since) > time.Second*conf.After
+}
+
+// checkStale returns the stale recipes of the recipe list, and alerts on the
+// ones which became stale since the last check.
+func (d *daemon) checkStale() []string {
+	if d.conf.StaleRecipes.After == 0 {
+		return nil
+	}
+	recipes, err := readRecipes(d.conf.RecipesFile)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	now := time.Now()
+	var stale, lines []string
+	d.mu.Lock()
+	for _, recipe := range recipes {
+		since, ok := d.staleSince(recipe, now)
+		if !ok {
+			continue
+		}
+		stale = append(stale, recipe)
+		if d.staleAlerted[recipe] {
+			continue
+		}
+		d.staleAlerted[recipe] = true
+		if _, succeeded := d.lastSuccess[recipe]; succeeded {
+			lines = append(lines, fmt.Sprintf("%s, last succeeded %v ago", recipe, now.Sub(since).Round(time.Minute)))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s, no success since the daemon started %v ago", recipe, now.Sub(since).Round(time.Minute)))
+		}
+	}
+	d.mu.Unlock()
+	sort.Strings(stale)
+
+	if len(lines) > 0 {
+		msg := fmt.Sprintf(":warning: Recipes which haven't succeeded in %v:\n- %s",
+			time.Second*d.conf.StaleRecipes.After, strings.Join(lines, "\n- "))
+		log.Println(msg)
+		if d.slack {
+			if err := postSlack(d.conf.Slack, msg); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	return stale
+}
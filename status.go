@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// cycleStatus summarizes a single pass through the recipe list. The last one
+// is written to the status file for monitoring systems to pick up.
+type cycleStatus struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Recipes   int       `json:"recipes"`
+	Imported  int       `json:"imported"`
+	Unchanged int       `json:"unchanged"`
+	// Downloaded counts the runs which downloaded but didn't import.
+	Downloaded int `json:"downloaded"`
+	Failed     int `json:"failed"`
+	// Slowest is the recipe which took the longest to run.
+	Slowest         string        `json:"slowest,omitempty"`
+	SlowestDuration time.Duration `json:"slowest_duration,omitempty"`
+	// FailedRecipes lists the recipes which failed during the cycle.
+	FailedRecipes []string `json:"failed_recipes,omitempty"`
+	// SlowRecipes lists the recipes which took much longer than usual.
+	SlowRecipes []string `json:"slow_recipes,omitempty"`
+	// StaleRecipes lists the recipes of the recipe list which haven't
+	// succeeded within the stale_recipes window.
+	StaleRecipes []string `json:"stale_recipes,omitempty"`
+	// VirusTotalWarnings lists the recipes whose downloads VirusTotal
+	// flagged above the threshold.
+	VirusTotalWarnings []string `json:"virustotal_warnings,omitempty"`
+	// CatalogChanges lists the pkginfo entries changed by makecatalogs.
+	CatalogChanges []catalogChange `json:"catalog_changes,omitempty"`
+	// Labels name the host and environment the cycle ran in.
+	Labels labels `json:"labels,omitempty"`
+	// LastDigest is when the digest was last sent, read back at startup so
+	// restarting the daemon doesn't put off the next digest.
+	LastDigest time.Time `json:"last_digest,omitempty"`
+
+	// munkiImports counts the runs which imported into munki, rather than
+	// only Jamf Pro, and so need the catalogs rebuilt. Duplicate imports
+	// count too, they still wrote a pkginfo.
+	munkiImports int
+	// pkginfos are the pkginfo files written by the imports, invalid the
+	// ones which failed validation.
+	pkginfos []string
+	invalid  int
+	// imports are the items imported into munki.
+	imports []importedItem
+}
+
+func (s *cycleStatus) add(rec runRecord) {
+	s.Recipes++
+	switch rec.result() {
+	case "unchanged":
+		s.Unchanged++
+	case "downloaded":
+		s.Downloaded++
+	}
+	if rec.Duration > s.SlowestDuration {
+		s.Slowest, s.SlowestDuration = rec.Recipe, rec.Duration
+	}
+	if len(rec.Imports) > 0 || len(rec.JamfUpdates) > 0 {
+		s.Imported++
+	}
+	if len(rec.Imports) > 0 || len(rec.Duplicates) > 0 {
+		s.munkiImports++
+	}
+	s.invalid += len(rec.InvalidPkginfos)
+	for _, item := range append(rec.Imports, rec.Duplicates...) {
+		if item.Pkginfo != "" {
+			s.pkginfos = append(s.pkginfos, item.Pkginfo)
+		}
+	}
+	s.imports = append(s.imports, rec.Imports...)
+	if len(rec.Failures) > 0 {
+		s.Failed++
+		s.FailedRecipes = append(s.FailedRecipes, rec.Recipe)
+	}
+	if rec.Slow {
+		s.SlowRecipes = append(s.SlowRecipes, rec.Recipe)
+	}
+	if len(virusTotalWarnings(rec.VirusTotal)) > 0 {
+		s.VirusTotalWarnings = append(s.VirusTotalWarnings, rec.Recipe)
+	}
+}
+
+// nothingNew reports whether every recipe of the cycle ran without
+// downloading, importing or failing, and the catalogs didn't change.
+func (s cycleStatus) nothingNew() bool {
+	return s.Recipes == s.Unchanged && len(s.CatalogChanges) == 0
+}
+
+// summary is a one line description of the cycle.
+func (s cycleStatus) summary() string {
+	line := fmt.Sprintf("%d recipes run, %d imported, %d downloaded, %d unchanged, %d failed in %v",
+		s.Recipes, s.Imported, s.Downloaded, s.Unchanged, s.Failed, s.End.Sub(s.Start).Round(time.Second))
+	if s.Slowest != "" {
+		line += fmt.Sprintf(", slowest %s (%v)", s.Slowest, s.SlowestDuration.Round(time.Second))
+	}
+	return line
+}
+
+func writeStatus(path string, status cycleStatus) error {
+	b, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0644)
+}
+
+func readStatus(path string) (cycleStatus, error) {
+	var status cycleStatus
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return status, err
+	}
+	return status, json.Unmarshal(b, &status)
+}
+
+// Nagios plugin exit codes.
+const (
+	healthOK       = 0
+	healthWarning  = 1
+	healthCritical = 2
+)
+
+// runCheckHealth implements the check-health subcommand. It prints a single
+// summary line and returns a Nagios compatible exit code.
+func runCheckHealth(args []string) int {
+	var (
+		flags   = flag.NewFlagSet("check-health", flag.ExitOnError)
+		fConfig = flags.String("config", "", "configuration file to load")
+		fWarn   = flags.String("warn-age", "", "warn when the last cycle finished longer ago than this (default 2 check intervals plus the exec timeout)")
+		fCrit   = flags.String("crit-age", "", "critical when the last cycle finished longer ago than this (default twice the warning age)")
+	)
+	flags.Parse(args)
+
+	conf, err := loadConfig(*fConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.StatusFile == "" {
+		fmt.Println("CRITICAL - status_file is not configured")
+		return healthCritical
+	}
+
+	warn := 2*time.Second*conf.CheckInterval + time.Second*conf.ExecTimeout
+	if *fWarn != "" {
+		if warn, err = parseAge(*fWarn); err != nil {
+			log.Fatal(err)
+		}
+	}
+	crit := 2 * warn
+	if *fCrit != "" {
+		if crit, err = parseAge(*fCrit); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	status, err := readStatus(conf.StatusFile)
+	if err != nil {
+		fmt.Printf("CRITICAL - %v\n", err)
+		return healthCritical
+	}
+
+	age := time.Since(status.End)
+	summary := fmt.Sprintf("last cycle %v ago: %d recipes, %d imported, %d failed",
+		age.Round(time.Second), status.Recipes, status.Imported, status.Failed)
+	if len(status.StaleRecipes) > 0 {
+		summary += fmt.Sprintf(", %d stale", len(status.StaleRecipes))
+	}
+	switch {
+	case age > crit || (status.Recipes > 0 && status.Failed == status.Recipes):
+		fmt.Println("CRITICAL - " + summary)
+		return healthCritical
+	case age > warn || status.Failed > 0 || len(status.StaleRecipes) > 0:
+		fmt.Println("WARNING - " + summary)
+		return healthWarning
+	}
+	fmt.Println("OK - " + summary)
+	return healthOK
+}
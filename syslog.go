@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslogConfig configures sending the daemon log to syslog. An empty Network
+// logs to the local syslog daemon; udp, tcp and tls send RFC 5424 messages to
+// Address.
+type syslogConfig struct {
+	Network  string `toml:"network"`
+	Address  string `toml:"address"`
+	Facility string `toml:"facility"`
+	Tag      string `toml:"tag"`
+	CAFile   string `toml:"ca_file"`
+	Enabled  bool   `toml:"enabled"`
+}
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// newSyslogWriter returns a writer sending each log line to syslog.
+func newSyslogWriter(conf syslogConfig) (io.Writer, error) {
+	facility := syslog.LOG_DAEMON
+	if conf.Facility != "" {
+		f, ok := syslogFacilities[conf.Facility]
+		if !ok {
+			return nil, fmt.Errorf("unknown syslog facility %q", conf.Facility)
+		}
+		facility = f
+	}
+	tag := conf.Tag
+	if tag == "" {
+		tag = "autopkgd"
+	}
+
+	switch conf.Network {
+	case "":
+		return syslog.New(facility|syslog.LOG_INFO, tag)
+	case "udp", "tcp", "tls":
+		w := &rfc5424Writer{conf: conf, priority: facility | syslog.LOG_INFO, tag: tag}
+		if err := w.connect(); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	return nil, fmt.Errorf("unknown syslog network %q", conf.Network)
+}
+
+// rfc5424Writer sends each write as an RFC 5424 message to a remote syslog
+// server. Messages over tcp and tls use octet counting framing (RFC 6587).
+type rfc5424Writer struct {
+	conf     syslogConfig
+	priority syslog.Priority
+	tag      string
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+	// while the server is unreachable, lines are dropped until retryAt,
+	// backing off up to maxSyslogBackoff, and counted in dropped.
+	retryAt time.Time
+	backoff time.Duration
+	dropped int
+}
+
+const maxSyslogBackoff = time.Minute
+
+func (w *rfc5424Writer) connect() error {
+	if w.hostname == "" {
+		w.hostname, _ = os.Hostname()
+	}
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch w.conf.Network {
+	case "tls":
+		config := &tls.Config{}
+		if w.conf.CAFile != "" {
+			pem, err := ioutil.ReadFile(w.conf.CAFile)
+			if err != nil {
+				return err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return errors.New("syslog: no certificates found in " + w.conf.CAFile)
+			}
+		}
+		// a failed dial returns a nil *tls.Conn, which mustn't end up in
+		// w.conn as a non-nil net.Conn.
+		var tlsConn *tls.Conn
+		if tlsConn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", w.conf.Address, config); err == nil {
+			conn = tlsConn
+		}
+	default:
+		conn, err = net.DialTimeout(w.conf.Network, w.conf.Address, 10*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// backOff schedules the next connection attempt after err, so an outage
+// doesn't stall every log line for the dial timeout. w.mu must be held.
+func (w *rfc5424Writer) backOff(err error) {
+	w.backoff *= 2
+	if w.backoff == 0 {
+		w.backoff = time.Second
+	}
+	if w.backoff > maxSyslogBackoff {
+		w.backoff = maxSyslogBackoff
+	}
+	w.retryAt = time.Now().Add(w.backoff)
+	fmt.Fprintf(os.Stderr, "syslog: %v, dropping log lines for %v\n", err, w.backoff)
+}
+
+func (w *rfc5424Writer) format(p []byte) string {
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		w.priority,
+		time.Now().Format(time.RFC3339Nano),
+		w.hostname,
+		w.tag,
+		os.Getpid(),
+		strings.TrimRight(string(p), "\n"),
+	)
+	if w.conf.Network == "udp" {
+		return msg
+	}
+	return fmt.Sprintf("%d %s", len(msg), msg)
+}
+
+func (w *rfc5424Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	msg := w.format(p)
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if time.Now().Before(w.retryAt) {
+				break
+			}
+			if err := w.connect(); err != nil {
+				w.backOff(err)
+				break
+			}
+			if w.dropped > 0 {
+				fmt.Fprintf(os.Stderr, "syslog: reconnected to %s, %d log lines were dropped\n", w.conf.Address, w.dropped)
+			}
+			w.backoff, w.dropped = 0, 0
+		}
+		if _, err := io.WriteString(w.conn, msg); err != nil {
+			w.conn.Close()
+			w.conn = nil
+			if attempt == 1 {
+				w.backOff(err)
+			}
+			continue
+		}
+		return len(p), nil
+	}
+	// the line is dropped rather than returning an error, which would keep
+	// it from the log destinations after this one.
+	w.dropped++
+	return len(p), nil
+}
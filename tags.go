@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// recipeTags are named sets of recipes, e.g. security, which can be run
+// together with `autopkgd run -tag`. Members are recipe names or patterns
+// such as "Adobe*.munki".
+type recipeTags map[string][]string
+
+// validate checks the patterns of the members.
+func (t recipeTags) validate() error {
+	for tag, members := range t {
+		for _, member := range members {
+			if _, err := path.Match(member, ""); err != nil {
+				return fmt.Errorf("recipe tag %s: bad pattern %q", tag, member)
+			}
+		}
+	}
+	return nil
+}
+
+// has reports whether recipe is tagged with tag.
+func (t recipeTags) has(tag, recipe string) bool {
+	for _, member := range t[tag] {
+		if ok, _ := path.Match(member, recipe); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selectRecipes returns the recipes of the list which match the regular
+// expression, which must match the whole name, and have all the tags.
+func selectRecipes(list []string, tags recipeTags, match string, with []string) ([]string, error) {
+	var re *regexp.Regexp
+	if match != "" {
+		var err error
+		if re, err = regexp.Compile("^(?:" + match + ")$"); err != nil {
+			return nil, fmt.Errorf("bad -match pattern: %v", err)
+		}
+	}
+	for _, tag := range with {
+		if _, ok := tags[tag]; !ok {
+			return nil, fmt.Errorf("no recipe tag %q in the config", tag)
+		}
+	}
+	var selected []string
+	for _, recipe := range list {
+		if re != nil && !re.MatchString(recipe) {
+			continue
+		}
+		tagged := true
+		for _, tag := range with {
+			tagged = tagged && tags.has(tag, recipe)
+		}
+		if tagged {
+			selected = append(selected, recipe)
+		}
+	}
+	return selected, nil
+}
+
+// stringList is a flag which can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string { return fmt.Sprint(*l) }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// testClients configures checking, after the catalogs are rebuilt, that new
+// imports are offered to designated test Macs. Each host is reached over
+// SSH and runs managedsoftwareupdate --checkonly.
+type testClients struct {
+	// Hosts are ssh destinations such as admin@test-mac.example.com.
+	Hosts []string `toml:"hosts"`
+	// SSHArgs are passed to ssh before the host, e.g. ["-i", "/path/to/key"].
+	SSHArgs []string `toml:"ssh_args"`
+	// Command defaults to sudo managedsoftwareupdate --checkonly.
+	Command []string `toml:"command"`
+	// Names are the item names or patterns the clients are expected to be
+	// offered, all of them by default.
+	Names []string `toml:"names"`
+	// Timeout is in seconds, 600 by default.
+	Timeout time.Duration `toml:"timeout"`
+}
+
+var defaultTestClientCommand = []string{"sudo", "/usr/local/munki/managedsoftwareupdate", "--checkonly"}
+
+// offeredPattern matches the items managedsoftwareupdate lists for install,
+// e.g. "    + Firefox-121.0".
+var offeredPattern = regexp.MustCompile(`^\s*\+\s+(\S+)`)
+
+// checkClient runs the check on host and returns the items out of expected
+// which it isn't offered.
+func (c testClients) checkClient(ctx context.Context, host string, expected []importedItem) ([]importedItem, error) {
+	command := c.Command
+	if len(command) == 0 {
+		command = defaultTestClientCommand
+	}
+	args := append([]string{"-o", "BatchMode=yes"}, c.SSHArgs...)
+	args = append(append(args, host), command...)
+	offered := make(map[string]bool)
+	err := runCommand(ctx, func(line []byte) {
+		if m := offeredPattern.FindSubmatch(line); m != nil {
+			offered[string(m[1])] = true
+		}
+	}, "ssh", args...)
+	if err != nil {
+		return nil, err
+	}
+	var missing []importedItem
+	for _, item := range expected {
+		if !offered[item.Name+"-"+item.Version] {
+			missing = append(missing, item)
+		}
+	}
+	return missing, nil
+}
+
+// checkTestClients checks all test clients in parallel and reports which
+// of a cycle's imports they are offered.
+func (d *daemon) checkTestClients(imports []importedItem) {
+	conf := d.conf.TestClients
+	var expected []importedItem
+	for _, item := range imports {
+		if matchAny(conf.Names, item.Name) {
+			expected = append(expected, item)
+		}
+	}
+	if len(conf.Hosts) == 0 || len(expected) == 0 {
+		return
+	}
+	timeout := time.Second * conf.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(d.ctx, timeout)
+	defer cancel()
+
+	lines := make([]string, len(conf.Hosts))
+	ok := true
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, host := range conf.Hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			missing, err := conf.checkClient(ctx, host, expected)
+			var line string
+			switch {
+			case err != nil:
+				line = fmt.Sprintf("%s: check failed: %v", host, err)
+			case len(missing) > 0:
+				var names []string
+				for _, item := range missing {
+					names = append(names, item.Name+" "+item.Version)
+				}
+				line = fmt.Sprintf("%s: not offered %s", host, strings.Join(names, ", "))
+			default:
+				line = fmt.Sprintf("%s: offered all %d new items", host, len(expected))
+			}
+			log.Println("test client", line)
+			mu.Lock()
+			lines[i] = "- " + line
+			ok = ok && err == nil && len(missing) == 0
+			mu.Unlock()
+		}(i, host)
+	}
+	wg.Wait()
+	if !d.slack {
+		return
+	}
+	text := "Test clients see the new imports:\n"
+	if !ok {
+		text = ":warning: Test clients don't all see the new imports:\n"
+	}
+	if err := postSlack(d.conf.Slack, text+strings.Join(lines, "\n")); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeConfig configures certificates which are obtained and renewed
+// automatically from an ACME CA such as Let's Encrypt.
+type acmeConfig struct {
+	// Hosts are the names certificates are requested for, ACME is disabled
+	// without them.
+	Hosts []string `toml:"hosts"`
+	// CacheDir keeps the account key and the certificates, so a restart
+	// doesn't request new ones.
+	CacheDir string `toml:"cache_dir"`
+	// Email is given to the CA for expiry and account notices.
+	Email string `toml:"email"`
+	// DirectoryURL is the CA's directory, Let's Encrypt by default, e.g.
+	// its staging directory while testing.
+	DirectoryURL string `toml:"directory_url"`
+	// HTTPListen is where the http-01 challenge is answered, e.g. ":80".
+	// Without it the CA must reach the API itself on port 443 for the
+	// tls-alpn-01 challenge.
+	HTTPListen string `toml:"http_listen"`
+}
+
+// manager returns the certificate manager, or nil if ACME is not
+// configured.
+func (c acmeConfig) manager() (*autocert.Manager, error) {
+	if len(c.Hosts) == 0 {
+		return nil, nil
+	}
+	if c.CacheDir == "" {
+		return nil, errors.New("api.acme: cache_dir is required")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Hosts...),
+		Cache:      autocert.DirCache(c.CacheDir),
+		Email:      c.Email,
+	}
+	if c.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: c.DirectoryURL}
+	}
+	return m, nil
+}
+
+// certReloader loads the server certificate and key, reloading them when
+// the certificate file changes so renewals by an external ACME client are
+// picked up without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (c *certReloader) load() error {
+	fi, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && !fi.ModTime().After(c.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime = &cert, fi.ModTime()
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) > time.Minute {
+		c.checked = time.Now()
+		// keep serving the old certificate if the new one can't be loaded.
+		if err := c.load(); err != nil && c.cert == nil {
+			return nil, err
+		}
+	}
+	return c.cert, nil
+}
+
+// tlsConfig returns the server TLS config, or nil if TLS is not configured.
+// The certificates come from the ACME manager m if it isn't nil, otherwise
+// from CertFile and KeyFile. When ClientCAFile is set, client certificates
+// signed by it are verified and can be mapped to scopes with [[api.clients]].
+func (conf apiConfig) tlsConfig(m *autocert.Manager) (*tls.Config, error) {
+	var config *tls.Config
+	switch {
+	case m != nil:
+		if conf.CertFile != "" || conf.KeyFile != "" {
+			return nil, errors.New("api: use either acme or cert_file and key_file")
+		}
+		config = m.TLSConfig()
+		config.MinVersion = tls.VersionTLS12
+	case conf.CertFile != "" || conf.KeyFile != "":
+		reloader := &certReloader{certFile: conf.CertFile, keyFile: conf.KeyFile, checked: time.Now()}
+		if err := reloader.load(); err != nil {
+			return nil, err
+		}
+		config = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.getCertificate,
+		}
+	default:
+		if conf.ClientCAFile != "" || len(conf.Clients) > 0 {
+			return nil, errors.New("api client certificates require cert_file and key_file, or acme")
+		}
+		return nil, nil
+	}
+	if conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + conf.ClientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+func listenAndServe(conf apiConfig, handler http.Handler) error {
+	m, err := conf.ACME.manager()
+	if err != nil {
+		return err
+	}
+	config, err := conf.tlsConfig(m)
+	if err != nil {
+		return err
+	}
+	if m != nil && conf.ACME.HTTPListen != "" {
+		// answers the http-01 challenge and redirects everything else to
+		// https.
+		go func() {
+			log.Println("acme http-01 listener:", http.ListenAndServe(conf.ACME.HTTPListen, m.HTTPHandler(nil)))
+		}()
+	}
+	srv := &http.Server{
+		Addr:      conf.Listen,
+		Handler:   handler,
+		TLSConfig: config,
+	}
+	if config == nil {
+		return srv.ListenAndServe()
+	}
+	return srv.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The oldest autopkg and munki tools releases autopkgd is tested with.
+const (
+	minAutopkgVersion = "2.3"
+	minMunkiVersion   = "5.2"
+)
+
+// toolVersions are the versions of the tools autopkgd runs. They are
+// recorded with every run, to tell which runs came after an upgrade.
+type toolVersions struct {
+	Autopkg string `json:"autopkg,omitempty"`
+	// Munki is the version of makecatalogs, empty with the built-in one.
+	Munki string `json:"munki,omitempty"`
+}
+
+// tools are the versions detected at startup.
+var tools toolVersions
+
+// detectTools asks autopkg and makecatalogs for their versions. A tool
+// which can't be run has no version.
+func detectTools(conf Config) toolVersions {
+	var v toolVersions
+	v.Autopkg, _ = commandOutput(conf.AutopkgCmdPath, "version")
+	if !conf.BuiltinMakecatalogs {
+		v.Munki, _ = commandOutput(conf.MakecatalogsCmdPath, "--version")
+	}
+	return v
+}
+
+// warnings returns the tools which are older than the tested minimums and,
+// with checkReleases, those which have a newer release on GitHub.
+func (v toolVersions) warnings(checkReleases bool) []string {
+	var warnings []string
+	for _, t := range []struct{ name, version, min, repo string }{
+		{"autopkg", v.Autopkg, minAutopkgVersion, "autopkg/autopkg"},
+		{"munki tools", v.Munki, minMunkiVersion, "munki/munki"},
+	} {
+		if t.version == "" {
+			continue
+		}
+		if compareVersions(t.version, t.min) < 0 {
+			warnings = append(warnings, fmt.Sprintf("%s %s is older than %s, the oldest version autopkgd is tested with", t.name, t.version, t.min))
+		}
+		if !checkReleases {
+			continue
+		}
+		latest, err := latestRelease(t.repo)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("checking for %s releases: %v", t.name, err))
+			continue
+		}
+		if compareVersions(latest, t.version) > 0 {
+			warnings = append(warnings, fmt.Sprintf("%s %s is available, %s is installed", t.name, latest, t.version))
+		}
+	}
+	return warnings
+}
+
+var githubClient = &http.Client{Timeout: 10 * time.Second}
+
+// latestRelease returns the version of the latest release of a GitHub repo.
+func latestRelease(repo string) (string, error) {
+	resp, err := githubClient.Get("https://api.github.com/repos/" + repo + "/releases/latest")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("github: %s", resp.Status)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(release.TagName, "v"), nil
+}
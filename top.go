@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// topLogLines is how many lines of the selected recipe's output are kept.
+const topLogLines = 500
+
+// runTop implements `autopkgd top`, a terminal monitor of the running daemon:
+// a progress bar per running recipe, the queue, and the output of the
+// selected recipe. j and k or the arrow keys select a recipe, q quits.
+func runTop(args []string) int {
+	var (
+		flags     = flag.NewFlagSet("top", flag.ExitOnError)
+		fConfig   = flags.String("config", "", "configuration file to load")
+		fSocket   = flags.String("socket", "", "control socket of the daemon (default control_socket from the config)")
+		fInterval = flags.Duration("interval", time.Second, "refresh interval")
+	)
+	flags.Parse(args)
+
+	socket := *fSocket
+	if socket == "" {
+		conf, err := loadConfig(*fConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		socket = conf.ControlSocket
+	}
+	if socket == "" {
+		fmt.Println("you must specify control_socket in your config or pass -socket")
+		return 1
+	}
+	if !daemonListening(socket) {
+		fmt.Printf("autopkgd is not running, nothing listens on %s\n", socket)
+		return 1
+	}
+
+	restore, err := rawTerminal()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer restore()
+	fmt.Print("\033[?25l")         // hide the cursor
+	defer fmt.Print("\033[?25h\n") // and show it again
+
+	t := &topView{client: newControlClient(socket)}
+	keys := make(chan byte)
+	go readKeys(keys)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(*fInterval)
+	defer ticker.Stop()
+	for {
+		t.refresh()
+		t.draw()
+		select {
+		case key := <-keys:
+			if key == 'q' {
+				t.follow("")
+				return 0
+			}
+			t.key(key)
+		case <-ticker.C:
+		case <-sig:
+			t.follow("")
+			return 0
+		}
+	}
+}
+
+// topView is the state of the monitor.
+type topView struct {
+	client   *controlClient
+	queue    queueStatus
+	progress cycleProgress
+	err      error
+	selected int
+	escape   []byte // a partial escape sequence
+
+	mu       sync.Mutex
+	logs     []string // output of the followed recipe
+	followed string
+	cancel   context.CancelFunc
+}
+
+func (t *topView) refresh() {
+	t.err = t.client.do("GET", "/queue", &t.queue)
+	if t.err == nil {
+		t.err = t.client.do("GET", "/progress", &t.progress)
+	}
+	if t.selected >= len(t.queue.Running) {
+		t.selected = len(t.queue.Running) - 1
+	}
+	if t.selected < 0 {
+		t.selected = 0
+	}
+	if len(t.queue.Running) > 0 {
+		t.follow(t.queue.Running[t.selected].Recipe)
+	}
+}
+
+// key handles a key press: j, k and the up and down arrows, which arrive as
+// ESC [ A and ESC [ B.
+func (t *topView) key(key byte) {
+	if key == 0x1b || len(t.escape) > 0 {
+		t.escape = append(t.escape, key)
+		if len(t.escape) < 3 {
+			return
+		}
+		key, t.escape = map[string]byte{"\x1b[A": 'k', "\x1b[B": 'j'}[string(t.escape)], nil
+	}
+	switch key {
+	case 'j':
+		if t.selected < len(t.queue.Running)-1 {
+			t.selected++
+		}
+	case 'k':
+		if t.selected > 0 {
+			t.selected--
+		}
+	}
+}
+
+// follow streams the output of recipe into the log pane, stopping the stream
+// of the previously followed recipe.
+func (t *topView) follow(recipe string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if recipe == t.followed {
+		return
+	}
+	if t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+	}
+	t.followed, t.logs = recipe, nil
+	if recipe == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	go t.stream(ctx, recipe)
+}
+
+// stream follows the output of recipe into the log pane.
+func (t *topView) stream(ctx context.Context, recipe string) {
+	t.client.streamLogs(ctx, recipe, true, func(line string) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.followed != recipe {
+			return
+		}
+		t.logs = append(t.logs, line)
+		if len(t.logs) > topLogLines {
+			t.logs = t.logs[len(t.logs)-topLogLines:]
+		}
+	})
+}
+
+func (t *topView) draw() {
+	rows, cols := terminalSize()
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		line := fmt.Sprintf(format, args...)
+		if len(line) > cols {
+			line = line[:cols]
+		}
+		lines = append(lines, line)
+	}
+
+	state := "idle"
+	switch {
+	case t.err != nil:
+		state = t.err.Error()
+	case t.progress.Running:
+		state = fmt.Sprintf("cycle %d/%d recipes done, started %s", t.progress.Completed, t.progress.Total, t.progress.Start.Local().Format("15:04:05"))
+	}
+	if t.queue.Paused {
+		state += ", scheduled cycles paused"
+	}
+	if t.queue.CheckOnly {
+		state += ", check only"
+	}
+	add("autopkgd top - %s - %s", time.Now().Format("15:04:05"), state)
+	add("%d/%d workers busy, %d waiting, %d cycles queued   j/k select, q quit", len(t.queue.Running), t.queue.Workers, len(t.queue.Queued), len(t.queue.Pending))
+	add("")
+
+	width := 30
+	for i, run := range t.queue.Running {
+		marker := " "
+		if i == t.selected {
+			marker = ">"
+		}
+		elapsed := time.Duration(run.Seconds * float64(time.Second)).Round(time.Second)
+		bar, expected := strings.Repeat("?", width), ""
+		if run.Expected > 0 {
+			done := int(float64(width) * run.Seconds / run.Expected)
+			if done > width {
+				done = width
+			}
+			bar = strings.Repeat("#", done) + strings.Repeat("-", width-done)
+			expected = " / ~" + time.Duration(run.Expected*float64(time.Second)).Round(time.Second).String()
+		}
+		add("%s %-40s [%s] %v%s", marker, run.Recipe, bar, elapsed, expected)
+	}
+	if len(t.queue.Queued) > 0 {
+		add("  waiting: %s", strings.Join(t.queue.Queued, ", "))
+	}
+	for _, skipped := range t.queue.Skipped {
+		add("  skipped: %s: %s", skipped.Recipe, skipped.Reason)
+	}
+
+	t.mu.Lock()
+	add("")
+	add("--- %s %s", t.followed, strings.Repeat("-", cols))
+	if room := rows - len(lines) - 1; room > 0 {
+		logs := t.logs
+		if len(logs) > room {
+			logs = logs[len(logs)-room:]
+		}
+		for _, line := range logs {
+			add("%s", line)
+		}
+	}
+	t.mu.Unlock()
+
+	// home, clear to the end of the screen, then draw.
+	fmt.Print("\033[H\033[J" + strings.Join(lines, "\r\n"))
+}
+
+// rawTerminal turns off line buffering and echo of the terminal with stty,
+// so keys are read as they are pressed, and returns a function restoring it.
+func rawTerminal() (func(), error) {
+	stty := func(args ...string) ([]byte, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		return cmd.Output()
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("top needs a terminal: %v", err)
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, err
+	}
+	return func() { stty(strings.TrimSpace(string(saved))) }, nil
+}
+
+func readKeys(keys chan<- byte) {
+	b := make([]byte, 1)
+	for {
+		if n, err := os.Stdin.Read(b); err != nil || n == 0 {
+			return
+		}
+		keys <- b[0]
+	}
+}
+
+// terminalSize returns the rows and columns of the terminal, or 24x80.
+func terminalSize() (int, int) {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err == nil {
+		if f := strings.Fields(string(out)); len(f) == 2 {
+			rows, err1 := strconv.Atoi(f[0])
+			cols, err2 := strconv.Atoi(f[1])
+			if err1 == nil && err2 == nil && rows > 0 && cols > 0 {
+				return rows, cols
+			}
+		}
+	}
+	return 24, 80
+}
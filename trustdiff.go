@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// trustDiffMax is how much of a trust diff is included in notifications.
+const trustDiffMax = 1500
+
+// captureTrustDiff returns what changed in the parent recipes and processors
+// of a recipe which failed trust verification, as printed by autopkg
+// verify-trust-info. It is kept for /recipes/{name}/trust-diff.
+func (d *daemon) captureTrustDiff(ctx context.Context, recipe string) string {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	var lines []string
+	output := func(b []byte) { lines = append(lines, string(b)) }
+	// verify-trust-info exits non-zero when the trust info doesn't match.
+	name, args := d.conf.runnerFor(recipe).autopkg("verify-trust-info", "-vvv", recipe)
+	err := runCommand(ctx, output, name, args...)
+	if err != nil && len(lines) == 0 {
+		log.Printf("getting the trust diff of %s: %v", recipe, err)
+	}
+	diff := strings.Join(lines, "\n")
+	d.mu.Lock()
+	if diff == "" {
+		delete(d.trustDiffs, recipe)
+	} else {
+		d.trustDiffs[recipe] = diff
+	}
+	d.mu.Unlock()
+	return diff
+}
+
+// trustDiffURL links to the full trust diff of a recipe, if the API URL is
+// configured.
+func (c apiConfig) trustDiffURL(recipe string) string {
+	if c.URL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(c.URL, "/") + "/recipes/" + url.PathEscape(recipe) + "/trust-diff"
+}
+
+// trustDiffSnippet formats the start of a trust diff for slack, with a link
+// to the full diff when it is truncated.
+func trustDiffSnippet(diff, link string) string {
+	if diff == "" {
+		return ""
+	}
+	snippet := diff
+	if len(snippet) > trustDiffMax {
+		snippet = snippet[:trustDiffMax]
+		if i := strings.LastIndex(snippet, "\n"); i > 0 {
+			snippet = snippet[:i]
+		}
+		more := strings.Count(diff[len(snippet):], "\n")
+		snippet += fmt.Sprintf("\n… %d more lines", more)
+	}
+	text := "```\n" + strings.Replace(snippet, "```", "'''", -1) + "\n```"
+	if link != "" {
+		text += "\n<" + link + "|Full diff>"
+	}
+	return text
+}
+
+// handleTrustDiff returns the last trust diff of a recipe as text.
+func (d *daemon) handleTrustDiff(w http.ResponseWriter, r *http.Request, name string) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	d.mu.Lock()
+	diff, ok := d.trustDiffs[name]
+	d.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no trust diff for "+name)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, diff)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// pkginfoValidation configures checking the pkginfo files of new imports
+// before they are published by makecatalogs.
+type pkginfoValidation struct {
+	Enabled bool `toml:"enabled"`
+	// Block skips makecatalogs in a cycle which imported an invalid pkginfo,
+	// so clients never see it.
+	Block bool `toml:"block"`
+}
+
+// osVersionPattern matches macOS versions such as 10.15 or 14.2.1.
+var osVersionPattern = regexp.MustCompile(`^\d+(\.\d+){0,2}$`)
+
+// pkginfoProblems returns what is wrong with a pkginfo: missing required
+// keys, a missing installer item, implausible os versions or no catalogs.
+func pkginfoProblems(repoPath string, item map[string]interface{}) []string {
+	var problems []string
+	for _, key := range []string{"name", "version"} {
+		if s, _ := item[key].(string); s == "" {
+			problems = append(problems, "no "+key)
+		}
+	}
+	nopkg, _ := item["installer_type"].(string)
+	location, _ := item["installer_item_location"].(string)
+	switch {
+	case nopkg == "nopkg":
+	case location == "":
+		problems = append(problems, "no installer_item_location")
+	default:
+		if _, err := os.Stat(filepath.Join(repoPath, "pkgs", location)); err != nil {
+			problems = append(problems, "installer item "+location+" is missing")
+		}
+	}
+	minOS, _ := item["minimum_os_version"].(string)
+	maxOS, _ := item["maximum_os_version"].(string)
+	for _, key := range []string{"minimum_os_version", "maximum_os_version"} {
+		if v, _ := item[key].(string); v != "" && !osVersionPattern.MatchString(v) {
+			problems = append(problems, fmt.Sprintf("%s %q is not a macOS version", key, v))
+		}
+	}
+	if minOS != "" && maxOS != "" && compareVersions(minOS, maxOS) > 0 {
+		problems = append(problems, fmt.Sprintf("minimum_os_version %s is above maximum_os_version %s", minOS, maxOS))
+	}
+	catalogs, _ := item["catalogs"].([]interface{})
+	if len(catalogs) == 0 {
+		problems = append(problems, "in no catalog")
+	}
+	for _, catalog := range catalogs {
+		if s, ok := catalog.(string); !ok || s == "" {
+			problems = append(problems, fmt.Sprintf("invalid catalog %v", catalog))
+		}
+	}
+	return problems
+}
+
+// validatePkginfos checks the pkginfo files a recipe imported, adding a
+// failure to the report for each invalid one.
+func validatePkginfos(repoPath, recipe string, report *autopkgReport) {
+	for _, imported := range importedItems(*report) {
+		if imported.Pkginfo == "" {
+			continue
+		}
+		item, err := readPkginfo(filepath.Join(repoPath, "pkgsinfo", imported.Pkginfo))
+		var problems []string
+		if err != nil {
+			problems = []string{err.Error()}
+		} else {
+			problems = pkginfoProblems(repoPath, item)
+		}
+		for _, problem := range problems {
+			msg := fmt.Sprintf("invalid pkginfo %s: %s", imported.Pkginfo, problem)
+			log.Println(msg)
+			report.Failures = append(report.Failures, failure{Recipe: recipe, Message: msg})
+		}
+		if len(problems) > 0 {
+			report.InvalidPkginfos = append(report.InvalidPkginfos, imported.Pkginfo)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// maxVerbosity is autopkg's -vvvv.
+const maxVerbosity = 4
+
+// recipeVerbosity sets the autopkg verbosity of recipes, by recipe name or
+// pattern, overriding autopkg_verbosity.
+type recipeVerbosity map[string]int
+
+func validateVerbosity(level int, recipes recipeVerbosity) error {
+	if level < 0 || level > maxVerbosity {
+		return fmt.Errorf("autopkg_verbosity must be between 0 and %d", maxVerbosity)
+	}
+	for pattern, level := range recipes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("recipe_verbosity: bad pattern %q", pattern)
+		}
+		if level < 0 || level > maxVerbosity {
+			return fmt.Errorf("recipe_verbosity: %s: verbosity must be between 0 and %d", pattern, maxVerbosity)
+		}
+	}
+	return nil
+}
+
+// verbosityOf returns the number of -v autopkg runs recipe with. When
+// several patterns match, the highest verbosity wins.
+func (conf Config) verbosityOf(recipe string) int {
+	level, matched := conf.AutopkgVerbosity, false
+	for pattern, l := range conf.RecipeVerbosity {
+		if ok, _ := path.Match(pattern, recipe); ok {
+			if !matched || l > level {
+				level = l
+			}
+			matched = true
+		}
+	}
+	return level
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// virusTotalConfig configures how the results of the VirusTotalAnalyzer
+// processor are reported.
+type virusTotalConfig struct {
+	// Threshold is the number of detections an import may have before it is
+	// escalated to a warning. The default of zero warns on any detection.
+	Threshold int `toml:"threshold"`
+}
+
+// virusTotalResult is a row of the VirusTotalAnalyzer summary result.
+type virusTotalResult struct {
+	Name string `json:"name"`
+	// Ratio is the number of engines which flagged the file out of those
+	// which scanned it, e.g. 2/70.
+	Ratio      string `json:"ratio"`
+	Permalink  string `json:"permalink,omitempty"`
+	Detections int    `json:"detections"`
+	// Warning is set when the detections are above the threshold.
+	Warning bool `json:"warning,omitempty"`
+}
+
+func (r virusTotalResult) String() string {
+	s := fmt.Sprintf("VirusTotal %s", r.Ratio)
+	if r.Permalink != "" {
+		s += " " + r.Permalink
+	}
+	return s
+}
+
+// virusTotalResults returns the VirusTotalAnalyzer results of a report,
+// with the ones above threshold marked as warnings.
+func virusTotalResults(report autopkgReport, threshold int) []virusTotalResult {
+	summary, ok := report.SummaryResults["virus_total_analyzer_summary_result"]
+	if !ok {
+		return nil
+	}
+	var results []virusTotalResult
+	for _, row := range summary.DataRows {
+		r := virusTotalResult{}
+		r.Name, _ = row["name"].(string)
+		r.Ratio, _ = row["ratio"].(string)
+		r.Permalink, _ = row["permalink"].(string)
+		// the ratio is something like "Not found" for unknown files.
+		if i := strings.Index(r.Ratio, "/"); i > 0 {
+			r.Detections, _ = strconv.Atoi(strings.TrimSpace(r.Ratio[:i]))
+		}
+		r.Warning = r.Detections > threshold
+		results = append(results, r)
+	}
+	return results
+}
+
+// virusTotalWarnings returns the results which were escalated to a warning.
+func virusTotalWarnings(results []virusTotalResult) []virusTotalResult {
+	var warnings []virusTotalResult
+	for _, r := range results {
+		if r.Warning {
+			warnings = append(warnings, r)
+		}
+	}
+	return warnings
+}
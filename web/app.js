@@ -0,0 +1,173 @@
+(function () {
+  "use strict";
+
+  // the API token, if the API requires one, is kept in local storage.
+  var asked = false;
+
+  function get(path) {
+    var headers = {};
+    var token = window.localStorage.getItem("autopkgd-token");
+    if (token) {
+      headers.Authorization = "Bearer " + token;
+    }
+    return fetch(path, {headers: headers}).then(function (resp) {
+      if (resp.status === 401 && !asked) {
+        asked = true;
+        token = window.prompt("API token");
+        if (token) {
+          window.localStorage.setItem("autopkgd-token", token);
+        }
+      }
+      if (!resp.ok) {
+        throw new Error(path + ": " + resp.status);
+      }
+      return resp.json();
+    });
+  }
+
+  function cell(text, cls) {
+    var td = document.createElement("td");
+    td.textContent = text;
+    if (cls) {
+      td.className = cls;
+    }
+    return td;
+  }
+
+  function fill(id, rows) {
+    var tbody = document.getElementById(id);
+    tbody.innerHTML = "";
+    rows.forEach(function (cells) {
+      var tr = document.createElement("tr");
+      cells.forEach(function (td) { tr.appendChild(td); });
+      tbody.appendChild(tr);
+    });
+  }
+
+  // itemCell shows the name of an imported item with its icon.
+  function itemCell(item) {
+    var td = cell(item.name);
+    if (item.icon) {
+      var img = document.createElement("img");
+      img.src = "/icons/" + item.icon.split("/").map(encodeURIComponent).join("/");
+      img.alt = "";
+      img.className = "icon";
+      td.insertBefore(img, td.firstChild);
+    }
+    return td;
+  }
+
+  function recipeCell(recipe) {
+    var td = cell(recipe, "recipe");
+    td.addEventListener("click", function () { follow(recipe); });
+    return td;
+  }
+
+  // follow shows the output of the latest or in-flight run of recipe.
+  var stream = null;
+
+  function follow(recipe) {
+    if (stream) {
+      stream.close();
+    }
+    var pre = document.getElementById("log-lines");
+    pre.textContent = "";
+    document.getElementById("log-recipe").textContent = recipe;
+    document.getElementById("log").hidden = false;
+    var url = "/recipes/" + encodeURIComponent(recipe) + "/logs";
+    var token = window.localStorage.getItem("autopkgd-token");
+    if (token) {
+      url += "?access_token=" + encodeURIComponent(token);
+    }
+    stream = new EventSource(url);
+    stream.onmessage = function (e) {
+      pre.textContent += e.data + "\n";
+      pre.scrollTop = pre.scrollHeight;
+    };
+    stream.addEventListener("end", function () {
+      stream.close();
+    });
+  }
+
+  // durations are encoded as nanoseconds
+  function seconds(ns) {
+    var s = Math.round(ns / 1e9);
+    return s < 60 ? s + "s" : Math.floor(s / 60) + "m" + (s % 60) + "s";
+  }
+
+  function when(ts) {
+    return ts ? new Date(ts).toLocaleString() : "";
+  }
+
+  function result(rec) {
+    if (rec.report_unreadable) { return "unreadable"; }
+    if (rec.failures && rec.failures.length) { return "failed"; }
+    if (rec.imports && rec.imports.length) { return "imported"; }
+    if (rec.downloads && rec.downloads.length) { return "downloaded"; }
+    return "unchanged";
+  }
+
+  function renderProgress(p) {
+    var pct = p.total ? Math.round(100 * p.completed / p.total) : 0;
+    document.getElementById("bar-fill").style.width = (p.running ? pct : 0) + "%";
+    document.getElementById("progress-text").textContent = p.running ?
+      p.completed + " of " + p.total + " recipes done, started " + when(p.start) : "Idle";
+    var now = Date.now();
+    fill("active", Object.keys(p.active || {}).sort().map(function (recipe) {
+      return [recipeCell(recipe), cell(seconds((now - new Date(p.active[recipe])) * 1e6))];
+    }));
+  }
+
+  function renderStatus(s) {
+    if (!s.end || s.end.indexOf("0001") === 0) {
+      return;
+    }
+    var text = s.recipes + " recipes run, " + s.imported + " imported, " +
+      s.unchanged + " unchanged, " + s.failed + " failed, finished " + when(s.end);
+    if (s.slowest) {
+      text += ", slowest " + s.slowest + " (" + seconds(s.slowest_duration) + ")";
+    }
+    document.getElementById("last-cycle").textContent = text;
+  }
+
+  function renderRecipes(recipes) {
+    fill("recipes", recipes.map(function (r) {
+      var rec = r.last_run;
+      if (!rec) {
+        return [cell(r.recipe), cell("never run"), cell(""), cell("")];
+      }
+      var res = result(rec);
+      return [recipeCell(r.recipe), cell(res, res), cell(when(rec.start)), cell(seconds(rec.duration))];
+    }));
+  }
+
+  function renderReports(reports) {
+    var imports = [], failures = [];
+    reports.forEach(function (rec) {
+      (rec.imports || []).forEach(function (item) {
+        imports.push([itemCell(item), cell(item.version), cell(rec.recipe), cell(when(rec.start))]);
+      });
+      (rec.failures || []).forEach(function (f) {
+        failures.push([cell(rec.recipe), cell(f.message, "failed"), cell(when(rec.start))]);
+      });
+    });
+    fill("imports", imports);
+    fill("failures", failures);
+  }
+
+  function refresh() {
+    Promise.all([
+      get("/progress").then(renderProgress),
+      get("/status").then(renderStatus),
+      get("/recipes").then(renderRecipes),
+      get("/reports?limit=200").then(renderReports)
+    ]).then(function () {
+      document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+    }).catch(function (err) {
+      document.getElementById("updated").textContent = err.message;
+    });
+  }
+
+  refresh();
+  setInterval(refresh, 5000);
+}());
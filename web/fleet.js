@@ -0,0 +1,107 @@
+(function () {
+  "use strict";
+
+  // the API token, if the API requires one, is kept in local storage.
+  var asked = false;
+
+  function get(path) {
+    var headers = {};
+    var token = window.localStorage.getItem("autopkgd-token");
+    if (token) {
+      headers.Authorization = "Bearer " + token;
+    }
+    return fetch(path, {headers: headers}).then(function (resp) {
+      if (resp.status === 401 && !asked) {
+        asked = true;
+        token = window.prompt("API token");
+        if (token) {
+          window.localStorage.setItem("autopkgd-token", token);
+        }
+      }
+      if (!resp.ok) {
+        throw new Error(path + ": " + resp.status);
+      }
+      return resp.json();
+    });
+  }
+
+  function cell(text, cls) {
+    var td = document.createElement("td");
+    td.textContent = text;
+    if (cls) {
+      td.className = cls;
+    }
+    return td;
+  }
+
+  function fill(id, rows) {
+    var tbody = document.getElementById(id);
+    tbody.innerHTML = "";
+    rows.forEach(function (cells) {
+      var tr = document.createElement("tr");
+      cells.forEach(function (td) { tr.appendChild(td); });
+      tbody.appendChild(tr);
+    });
+  }
+
+  // durations are encoded as nanoseconds
+  function seconds(ns) {
+    var s = Math.round(ns / 1e9);
+    return s < 60 ? s + "s" : Math.floor(s / 60) + "m" + (s % 60) + "s";
+  }
+
+  function when(ts) {
+    return ts ? new Date(ts).toLocaleString() : "";
+  }
+
+  function result(rec) {
+    if (rec.report_unreadable) { return "unreadable"; }
+    if (rec.failures && rec.failures.length) { return "failed"; }
+    if (rec.imports && rec.imports.length) { return "imported"; }
+    if (rec.downloads && rec.downloads.length) { return "downloaded"; }
+    return "unchanged";
+  }
+
+  function renderNodes(nodes) {
+    fill("nodes", nodes.map(function (n) {
+      return [cell(n.node), cell(n.recipes), cell(n.failed, n.failed ? "failed" : ""), cell(when(n.last_seen))];
+    }));
+  }
+
+  function renderRecipes(runs) {
+    fill("recipes", runs.map(function (run) {
+      var rec = run.record, res = result(rec);
+      return [cell(rec.recipe), cell(run.node), cell(res, res), cell(when(rec.start)), cell(seconds(rec.duration))];
+    }));
+  }
+
+  function renderReports(runs) {
+    var imports = [], failures = [];
+    runs.forEach(function (run) {
+      var rec = run.record;
+      (rec.imports || []).forEach(function (item) {
+        imports.push([cell(item.name), cell(item.version), cell(rec.recipe), cell(run.node), cell(when(rec.start))]);
+      });
+      (rec.failures || []).forEach(function (f) {
+        failures.push([cell(rec.recipe), cell(run.node), cell(f.message, "failed"), cell(when(rec.start))]);
+      });
+    });
+    fill("imports", imports);
+    fill("failures", failures);
+  }
+
+  function refresh() {
+    Promise.all([
+      get("/nodes").then(renderNodes),
+      get("/recipes").then(renderRecipes),
+      get("/reports?limit=200").then(renderReports)
+    ]).then(function () {
+      document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+    }).catch(function (err) {
+      document.getElementById("updated").textContent = err.message;
+    });
+  }
+
+  refresh();
+  setInterval(refresh, 10000);
+}());
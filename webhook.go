@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// webhookConfig configures the endpoint receiving push events from the
+// recipe overrides repository. The endpoint is disabled unless Secret is set.
+type webhookConfig struct {
+	Secret string `toml:"secret"`
+	// Branch limits triggering to pushes to this branch.
+	Branch string `toml:"branch"`
+	// Paths maps path patterns, as understood by path.Match, to the recipes
+	// to run when a matching file changes. Changed override files are also
+	// matched to recipes by name, e.g. Firefox.munki.recipe runs Firefox.munki.
+	Paths map[string][]string `toml:"paths"`
+}
+
+// pushEvent is the subset of a GitHub or GitLab push event autopkgd uses.
+type pushEvent struct {
+	Ref     string `json:"ref"`
+	Commits []struct {
+		Added    []string `json:"added"`
+		Modified []string `json:"modified"`
+		Removed  []string `json:"removed"`
+	} `json:"commits"`
+}
+
+// changedFiles returns the added and modified files, since removed overrides
+// can't be run.
+func (e pushEvent) changedFiles() []string {
+	var files []string
+	for _, c := range e.Commits {
+		files = append(files, c.Added...)
+		files = append(files, c.Modified...)
+	}
+	return files
+}
+
+var recipeExtensions = []string{".recipe.yaml", ".recipe.plist", ".recipe"}
+
+// recipesForFiles maps changed files to recipes in the recipe list.
+func (c webhookConfig) recipesForFiles(files, recipeList []string) []string {
+	set := make(map[string]bool)
+	for _, file := range files {
+		for pattern, recipes := range c.Paths {
+			if ok, _ := path.Match(pattern, file); ok {
+				for _, recipe := range recipes {
+					set[recipe] = true
+				}
+			}
+		}
+		base := path.Base(file)
+		for _, ext := range recipeExtensions {
+			if strings.HasSuffix(base, ext) {
+				if name := strings.TrimSuffix(base, ext); containsString(recipeList, name) {
+					set[name] = true
+				}
+				break
+			}
+		}
+	}
+	var recipes []string
+	for recipe := range set {
+		if containsString(recipeList, recipe) {
+			recipes = append(recipes, recipe)
+		}
+	}
+	sort.Strings(recipes)
+	return recipes
+}
+
+// verify checks the GitHub HMAC signature or GitLab token of the request.
+func (c webhookConfig) verify(r *http.Request, body []byte) bool {
+	if sig := r.Header.Get("X-Hub-Signature-256"); sig != "" {
+		mac := hmac.New(sha256.New, []byte(c.Secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(sig), []byte(expected))
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(c.Secret)) == 1
+	}
+	return false
+}
+
+// handleWebhook queues the recipes affected by a push to the overrides repo.
+func (d *daemon) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	conf := d.conf.Webhook
+	if conf.Secret == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 10<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !conf.verify(r, body) {
+		writeError(w, http.StatusUnauthorized, "invalid signature")
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "" {
+		event = r.Header.Get("X-Gitlab-Event")
+	}
+	if event == "ping" {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "pong"})
+		return
+	}
+	if event != "push" && event != "Push Hook" {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ignored", "event": event})
+		return
+	}
+
+	var push pushEvent
+	if err := json.Unmarshal(body, &push); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if conf.Branch != "" && push.Ref != "refs/heads/"+conf.Branch {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ignored", "ref": push.Ref})
+		return
+	}
+
+	recipeList, err := readRecipes(d.conf.RecipesFile)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recipes := conf.recipesForFiles(push.changedFiles(), recipeList)
+	if len(recipes) == 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "no matching recipes", "recipes": []string{}})
+		return
+	}
+	if !d.enqueue(recipes, actorWebhook, false) {
+		writeError(w, http.StatusServiceUnavailable, "too many runs queued")
+		return
+	}
+	log.Printf("webhook push to %s queued %s", push.Ref, strings.Join(recipes, ", "))
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"status": "queued", "recipes": recipes})
+}